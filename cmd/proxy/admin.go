@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/experiflow/proxy/internal/middleware"
+)
+
+// cacheFlushHandler clears the middleware's API caches, optionally only
+// for the experiment given in ?experiment_id=
+// Requests must be POSTs with "Authorization: Bearer <ADMIN_TOKEN>"; the
+// endpoint answers 404 while no admin token is configured.
+func cacheFlushHandler(efMiddleware *middleware.ExperiFlowMiddleware) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := efMiddleware.Config().AdminToken
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !validAdminToken(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		experimentID := r.URL.Query().Get("experiment_id")
+		evicted := efMiddleware.FlushCaches(experimentID)
+		slog.InfoContext(r.Context(), "Flushed caches", "experiment_id", experimentID, "evicted", evicted)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			ExperimentID string `json:"experiment_id,omitempty"`
+			Evicted      int    `json:"evicted"`
+		}{experimentID, evicted})
+	}
+}
+
+// validAdminToken reports whether the request carries the admin bearer token
+func validAdminToken(r *http.Request, token string) bool {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+
+	"github.com/experiflow/proxy/internal/middleware"
+	"github.com/experiflow/proxy/internal/requestid"
+)
+
+// Error categories reported to clients; the underlying error is only logged
+const (
+	categoryOriginTimeout     = "origin_timeout"
+	categoryOriginUnreachable = "origin_unreachable"
+	categoryClientCanceled    = "client_canceled"
+	categoryTransformFailed   = "transform_failed"
+	categoryProxyError        = "proxy_error"
+)
+
+// transformError marks errors returned by ModifyResponse, as opposed to
+// failures reaching the origin
+type transformError struct {
+	err error
+}
+
+func (e *transformError) Error() string { return e.err.Error() }
+func (e *transformError) Unwrap() error { return e.err }
+
+// proxyErrorResponse is the JSON body of a proxy error
+type proxyErrorResponse struct {
+	Error     string `json:"error"`
+	Category  string `json:"category"`
+	RequestID string `json:"request_id"`
+	Timestamp string `json:"timestamp"`
+}
+
+// errorPage is the HTML body of a proxy error, for browsers
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Status}} {{.Error}}</title></head>
+<body><h1>{{.Error}}</h1><p>The page could not be loaded. Please try again.</p>
+<p><small>Request ID: {{.RequestID}} &middot; {{.Timestamp}}</small></p></body></html>
+`))
+
+// proxyErrorHandler reports proxy errors as JSON or HTML
+// Under fail-open, safe requests that failed for reasons other than a
+// timeout or cancellation are retried once straight to the origin, without
+// any transformation.
+func proxyErrorHandler(efMiddleware *middleware.ExperiFlowMiddleware) func(http.ResponseWriter, *http.Request, error) {
+	passthrough := &httputil.ReverseProxy{
+		// The request was already directed at the origin; keep the
+		// forwarding headers set on the first attempt rather than
+		// appending to them again
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			for _, key := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"} {
+				if values, ok := pr.In.Header[key]; ok {
+					pr.Out.Header[key] = values
+				}
+			}
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			resp.Header.Del(requestid.Header)
+			return nil
+		},
+	}
+	passthrough.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		slog.ErrorContext(r.Context(), "Fail-open pass-through failed", "request_path", r.URL.Path, "error", err)
+		writeProxyError(w, r, categorize(err))
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		category := categorize(err)
+		slog.ErrorContext(r.Context(), "Proxy error", "request_path", r.URL.Path, "category", category, "error", err)
+
+		if efMiddleware.Config().FailOpen && retryable(r, category) {
+			slog.InfoContext(r.Context(), "Failing open - retrying origin without transformation", "request_path", r.URL.Path)
+			passthrough.ServeHTTP(w, r)
+			return
+		}
+		writeProxyError(w, r, category)
+	}
+}
+
+// categorize maps a proxy error to a category safe to show clients
+func categorize(err error) string {
+	var transformErr *transformError
+	var netErr net.Error
+	var opErr *net.OpError
+	switch {
+	case errors.As(err, &transformErr):
+		return categoryTransformFailed
+	case errors.Is(err, context.Canceled):
+		return categoryClientCanceled
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return categoryOriginTimeout
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return categoryOriginUnreachable
+	}
+	return categoryProxyError
+}
+
+// retryable reports whether a failed request can safely be sent to the
+// origin again: a bodiless GET or HEAD whose client is still waiting, that
+// didn't already time out
+// Under fail-open, transform failures only reach here when ON_TIMEOUT is
+// fail-closed, which wants the request to fail, so they aren't retried.
+func retryable(r *http.Request, category string) bool {
+	if category == categoryTransformFailed {
+		return false
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		return false
+	}
+	if r.Context().Err() != nil {
+		return false
+	}
+	return category != categoryOriginTimeout && category != categoryClientCanceled
+}
+
+// writeProxyError writes an error response, as HTML for clients that
+// accept it (browsers) and JSON otherwise
+func writeProxyError(w http.ResponseWriter, r *http.Request, category string) {
+	status := http.StatusBadGateway
+	if category == categoryOriginTimeout {
+		status = http.StatusGatewayTimeout
+	}
+	body := proxyErrorResponse{
+		Error:     http.StatusText(status),
+		Category:  category,
+		RequestID: requestid.FromContext(r.Context()),
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if acceptsHTML(r) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		errorPage.Execute(w, struct {
+			proxyErrorResponse
+			Status int
+		}{body, status})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// acceptsHTML reports whether the client asked for HTML, as browsers do
+func acceptsHTML(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(value, ",") {
+			mediaType, _, _ = strings.Cut(mediaType, ";")
+			if strings.EqualFold(strings.TrimSpace(mediaType), "text/html") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// originHeader reports which of a route's origins served the response, by
+// position rather than address, since it goes to clients
+const originHeader = "X-EF-Origin"
+
+// failoverTransport sends requests to their route's origin, retrying them
+// on the route's failover origins in order when a connection can't be made
+// Only requests that are safe to send again are retried: idempotent
+// methods without a body, whose client is still waiting.
+type failoverTransport struct {
+	base http.RoundTripper
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	route := routeFromContext(req.Context())
+	if route == nil || len(route.failover) == 0 {
+		return resp, err
+	}
+
+	served := "primary"
+	for i, origin := range route.failover {
+		if err == nil || !failsOver(req, err) {
+			break
+		}
+		slog.WarnContext(req.Context(), "Origin unreachable - failing over",
+			"request_path", req.URL.Path, "origin", origin.Host, "error", err)
+
+		// Failover origins serve the same paths as the primary
+		retry := req.Clone(req.Context())
+		retry.URL.Scheme, retry.URL.Host = origin.Scheme, origin.Host
+		retry.Host = origin.Host
+		resp, err = t.base.RoundTrip(retry)
+		served = fmt.Sprintf("failover-%d", i+1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Header.Set(originHeader, served)
+	return resp, nil
+}
+
+// failsOver reports whether a request that failed with err should be
+// retried on the next origin
+func failsOver(req *http.Request, err error) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	return req.Context().Err() == nil && categorize(err) == categoryOriginUnreachable
+}
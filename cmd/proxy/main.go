@@ -1,70 +1,90 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"log/slog"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/experiflow/proxy/internal/config"
 	"github.com/experiflow/proxy/internal/middleware"
+	"github.com/experiflow/proxy/internal/requestid"
 )
 
 func main() {
 	// Load configuration
-	cfg := config.LoadFromEnv()
+	cfg, err := config.Load()
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+
+	// Route all logging (including the standard log package) through slog
+	slog.SetDefault(newLogger(cfg.LogFormat))
 
-	log.Printf("[ExperiFlow Proxy] Starting on port %s", cfg.Port)
-	log.Printf("[ExperiFlow Proxy] Origin: %s", cfg.OriginURL)
-	log.Printf("[ExperiFlow Proxy] API: %s", cfg.APIBaseURL)
-	log.Printf("[ExperiFlow Proxy] Fail Open: %v", cfg.FailOpen)
+	slog.Info("Starting ExperiFlow Proxy",
+		"port", cfg.Port,
+		"origins", cfg.Origins(),
+		"api", cfg.APIBaseURL,
+		"fail_open", cfg.FailOpen)
 
-	// Parse origin URL
-	originURL, err := url.Parse(cfg.OriginURL)
+	// Build host-based origin routing
+	router, err := newOriginRouter(cfg)
 	if err != nil {
-		log.Fatalf("Invalid origin URL: %v", err)
+		slog.Error("Invalid origin configuration", "error", err)
+		os.Exit(1)
+	}
+	for pattern, origin := range cfg.OriginRoutes {
+		slog.Info("Origin route", "host", pattern, "origin", origin)
 	}
 
-	// Get experiment IDs from environment
-	experimentIDs := getExperimentIDs()
+	experimentIDs := cfg.ExperimentIDs
 	if len(experimentIDs) == 0 {
-		log.Println("[ExperiFlow Proxy] WARNING: No experiment IDs configured. Set EXPERIMENT_IDS env var.")
+		slog.Warn("No experiment IDs configured. Set EXPERIMENT_IDS env var.")
 	} else {
-		log.Printf("[ExperiFlow Proxy] Active experiments: %v", experimentIDs)
+		slog.Info("Active experiments", "experiment_ids", experimentIDs)
 	}
 
 	// Create ExperiFlow middleware
 	efMiddleware := middleware.NewExperiFlowMiddleware(cfg, experimentIDs)
 
-	// Create reverse proxy
-	proxy := httputil.NewSingleHostReverseProxy(originURL)
+	// Create reverse proxy that targets the origin chosen per request,
+	// failing over to the route's other origins
+	proxy := &httputil.ReverseProxy{Transport: &failoverTransport{base: http.DefaultTransport}}
 
 	// Customize proxy behavior
-	originalDirector := proxy.Director
 	proxy.Director = func(req *http.Request) {
-		originalDirector(req)
+		route := routeFromContext(req.Context())
+		incomingHost := req.Host
+		incomingScheme := efMiddleware.Scheme(req)
+
+		route.director(req)
+		req.Host = route.origin.Host
 		// Preserve original host header
-		req.Host = originURL.Host
-		req.Header.Set("X-Forwarded-Host", req.Host)
-		req.Header.Set("X-Forwarded-Proto", req.URL.Scheme)
+		req.Header.Set("X-Forwarded-Host", incomingHost)
+		req.Header.Set("X-Forwarded-Proto", incomingScheme)
 	}
 
 	// Add response modification
 	proxy.ModifyResponse = func(resp *http.Response) error {
-		return efMiddleware.ModifyResponse(resp, resp.Request)
+		// The client already gets the proxy's request ID
+		resp.Header.Del(requestid.Header)
+		if err := efMiddleware.ModifyResponse(resp, resp.Request); err != nil {
+			return &transformError{err: err}
+		}
+		return nil
 	}
 
 	// Error handler
-	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		log.Printf("[ExperiFlow Proxy] Proxy error: %v", err)
-		if cfg.FailOpen {
-			// Try to pass through to origin directly
-			log.Println("[ExperiFlow Proxy] Failing open - attempting direct connection")
-		}
-		http.Error(w, "Proxy error", http.StatusBadGateway)
-	}
+	proxy.ErrorHandler = proxyErrorHandler(efMiddleware)
 
 	// Health check handler
 	mux := http.NewServeMux()
@@ -73,38 +93,97 @@ func main() {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`{"status":"healthy","service":"experiflow-proxy"}`))
 	})
-	mux.Handle("/", proxy)
+	mux.HandleFunc("/ready", newReadinessChecker(efMiddleware, router).handler())
+	if metricsHandler := efMiddleware.MetricsHandler(); metricsHandler != nil {
+		mux.Handle("/metrics", metricsHandler)
+	}
+	mux.HandleFunc("/admin/cache/flush", cacheFlushHandler(efMiddleware))
+	mux.Handle("/", router.handler(proxy))
 
 	// Create HTTP server
 	server := &http.Server{
 		Addr:         ":" + cfg.Port,
-		Handler:      mux,
+		Handler:      withRequestID(mux),
 		ReadTimeout:  cfg.ReadTimeout,
 		WriteTimeout: cfg.WriteTimeout,
 	}
 
+	// Reload configuration on SIGHUP
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			reloadConfig(efMiddleware)
+		}
+	}()
+
 	// Start server
-	log.Printf("[ExperiFlow Proxy] Ready to accept requests on http://localhost:%s", cfg.Port)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("[ExperiFlow Proxy] Server error: %v", err)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		slog.Info("Ready to accept requests", "address", "http://localhost:"+cfg.Port)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Server error", "error", err)
+			efMiddleware.Close()
+			os.Exit(1)
+		}
+	case <-ctx.Done():
+		// A second signal kills the process immediately
+		stop()
+		slog.Info("Shutting down", "grace_period", cfg.ShutdownTimeout)
+
+		// Stop accepting connections and let in-flight requests finish
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Graceful shutdown failed", "error", err)
+		}
 	}
+
+	efMiddleware.Close()
+	slog.Info("Shutdown complete")
 }
 
-// getExperimentIDs parses experiment IDs from environment variable
-// Format: comma-separated list, e.g., "exp1,exp2,exp3"
-func getExperimentIDs() []string {
-	idsStr := os.Getenv("EXPERIMENT_IDS")
-	if idsStr == "" {
-		return nil
+// reloadConfig loads the configuration again and applies it to the
+// middleware, keeping the current one if the new one is invalid
+func reloadConfig(efMiddleware *middleware.ExperiFlowMiddleware) {
+	cfg, err := config.Load()
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		slog.Error("Invalid configuration - keeping current settings", "error", err)
+		return
 	}
+	efMiddleware.Reload(cfg)
+}
 
-	ids := strings.Split(idsStr, ",")
-	var result []string
-	for _, id := range ids {
-		id = strings.TrimSpace(id)
-		if id != "" {
-			result = append(result, id)
-		}
+// newLogger creates the process logger in text or JSON format
+func newLogger(format string) *slog.Logger {
+	var handler slog.Handler
+	if strings.EqualFold(format, "json") {
+		handler = slog.NewJSONHandler(os.Stderr, nil)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, nil)
 	}
-	return result
+	return slog.New(requestid.LogHandler{Handler: handler}).With("service", "experiflow-proxy")
+}
+
+// withRequestID gives each request an ID, honoring a valid incoming
+// X-Request-ID, and passes it on in the context, to the origin, and back
+// to the client
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := requestid.FromHeader(r.Header.Get(requestid.Header))
+		r.Header.Set(requestid.Header, id)
+		w.Header().Set(requestid.Header, id)
+		next.ServeHTTP(w, r.WithContext(requestid.NewContext(r.Context(), id)))
+	})
 }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/experiflow/proxy/internal/middleware"
+)
+
+const (
+	// readyCacheTTL is how long a readiness result is reused, so frequent
+	// probes don't load the API or the origins
+	readyCacheTTL = 5 * time.Second
+	// readyCheckTimeout bounds each dependency check
+	readyCheckTimeout = 2 * time.Second
+)
+
+// readyCheck is the outcome of one dependency check
+type readyCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` // "ok" or "down"
+	Error  string `json:"error,omitempty"`
+}
+
+// readyResponse is the JSON body of /ready
+type readyResponse struct {
+	Status string       `json:"status"` // "ready" or "not_ready"
+	Checks []readyCheck `json:"checks"`
+}
+
+// readinessChecker checks that the ExperiFlow API and every origin are
+// reachable, caching the result briefly
+type readinessChecker struct {
+	efMiddleware *middleware.ExperiFlowMiddleware
+	routes       []*originRoute
+	client       *http.Client
+
+	mu        sync.Mutex
+	last      readyResponse
+	checkedAt time.Time
+}
+
+// newReadinessChecker builds a checker for the router's origins
+func newReadinessChecker(efMiddleware *middleware.ExperiFlowMiddleware, router *originRouter) *readinessChecker {
+	routes := append([]*originRoute(nil), router.routes...)
+	if router.fallback != nil {
+		routes = append(routes, router.fallback)
+	}
+	return &readinessChecker{
+		efMiddleware: efMiddleware,
+		routes:       routes,
+		client: &http.Client{
+			// Any response shows the origin is up, redirects included
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// handler serves /ready: 200 when all dependencies are reachable, 503 with
+// the failing checks otherwise
+func (c *readinessChecker) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result := c.check(r.Context())
+
+		status := http.StatusOK
+		if result.Status != "ready" {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// check returns the cached result, running the checks again once it is
+// older than readyCacheTTL
+// Concurrent probes wait for a single round of checks.
+func (c *readinessChecker) check(ctx context.Context) readyResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.checkedAt.IsZero() && time.Since(c.checkedAt) < readyCacheTTL {
+		return c.last
+	}
+
+	// Detach from the probe so a canceled probe doesn't cache a failure
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), readyCheckTimeout)
+	defer cancel()
+
+	checks := make([]readyCheck, 1+len(c.routes))
+	var wg sync.WaitGroup
+	wg.Add(len(checks))
+	go func() {
+		defer wg.Done()
+		checks[0] = checkResult(ctx, "experiflow_api", c.efMiddleware.PingAPI(ctx))
+	}()
+	for i, route := range c.routes {
+		go func(i int, route *originRoute) {
+			defer wg.Done()
+			checks[i+1] = checkResult(ctx, originCheckName(route), c.pingOrigin(ctx, route))
+		}(i, route)
+	}
+	wg.Wait()
+
+	c.last = readyResponse{Status: "ready", Checks: checks}
+	for _, check := range checks {
+		if check.Status != "ok" {
+			c.last.Status = "not_ready"
+		}
+	}
+	c.checkedAt = time.Now()
+	return c.last
+}
+
+// pingOrigin sends a HEAD request to the route's origin root, then to each
+// failover origin until one is serving
+// Server errors count as down; any other response shows it is serving.
+func (c *readinessChecker) pingOrigin(ctx context.Context, route *originRoute) error {
+	err := c.ping(ctx, route.origin)
+	for _, origin := range route.failover {
+		if err == nil {
+			break
+		}
+		err = c.ping(ctx, origin)
+	}
+	return err
+}
+
+// ping sends a HEAD request to an origin's root
+func (c *readinessChecker) ping(ctx context.Context, origin *url.URL) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, origin.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("origin returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// checkResult turns a check's error into a readyCheck
+// Errors are logged in full but only reported by category, as /ready is
+// served on the public listener.
+func checkResult(ctx context.Context, name string, err error) readyCheck {
+	if err == nil {
+		return readyCheck{Name: name, Status: "ok"}
+	}
+	slog.WarnContext(ctx, "Readiness check failed", "check", name, "error", err)
+	return readyCheck{Name: name, Status: "down", Error: checkErrorCategory(err)}
+}
+
+// checkErrorCategory describes a check failure without internal details
+func checkErrorCategory(err error) string {
+	switch categorize(err) {
+	case categoryOriginTimeout:
+		return "timeout"
+	case categoryOriginUnreachable:
+		return "unreachable"
+	}
+	return "unhealthy"
+}
+
+// originCheckName names an origin's check by its host pattern
+func originCheckName(route *originRoute) string {
+	if route.pattern == "" {
+		return "origin"
+	}
+	return "origin:" + route.pattern
+}
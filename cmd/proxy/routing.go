@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/experiflow/proxy/internal/config"
+)
+
+// originRoute maps a host pattern to an origin server
+type originRoute struct {
+	pattern  string // Exact host or "*.example.com" wildcard
+	origin   *url.URL
+	director func(*http.Request) // Rewrites the request URL to the origin
+	failover []*url.URL          // Tried in order when origin can't be reached
+}
+
+// originRouter picks the origin for each request by its Host header
+type originRouter struct {
+	routes   []*originRoute // Exact hosts first, then wildcards by specificity
+	fallback *originRoute   // nil when unmatched hosts should 404
+}
+
+type routeContextKey struct{}
+
+// newOriginRouter builds the router from ORIGIN_ROUTES, with ORIGIN_URL
+// (or ORIGIN_URLS) as the fallback for unmatched hosts when enabled
+func newOriginRouter(cfg *config.Config) (*originRouter, error) {
+	router := &originRouter{}
+
+	for pattern, rawURL := range cfg.OriginRoutes {
+		route, err := newOriginRoute(strings.ToLower(pattern), rawURL)
+		if err != nil {
+			return nil, err
+		}
+		router.routes = append(router.routes, route)
+	}
+	sort.Slice(router.routes, func(i, j int) bool {
+		a, b := router.routes[i].pattern, router.routes[j].pattern
+		aWild, bWild := strings.HasPrefix(a, "*."), strings.HasPrefix(b, "*.")
+		if aWild != bWild {
+			return !aWild
+		}
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+
+	if len(router.routes) == 0 || cfg.UnmatchedHostFallback {
+		origins := cfg.Origins()
+		fallback, err := newOriginRoute("", origins[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, rawURL := range origins[1:] {
+			origin, err := url.Parse(rawURL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid origin URL %q: %w", rawURL, err)
+			}
+			fallback.failover = append(fallback.failover, origin)
+		}
+		router.fallback = fallback
+	}
+
+	return router, nil
+}
+
+// newOriginRoute parses an origin URL into a route
+func newOriginRoute(pattern, rawURL string) (*originRoute, error) {
+	origin, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid origin URL %q: %w", rawURL, err)
+	}
+	return &originRoute{
+		pattern:  pattern,
+		origin:   origin,
+		director: httputil.NewSingleHostReverseProxy(origin).Director,
+	}, nil
+}
+
+// match returns the route for a Host header, or nil if nothing matches
+func (r *originRouter) match(host string) *originRoute {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	for _, route := range r.routes {
+		if suffix, ok := strings.CutPrefix(route.pattern, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return route
+			}
+		} else if host == route.pattern {
+			return route
+		}
+	}
+	return r.fallback
+}
+
+// handler resolves the origin for each request before proxying it
+// Requests for unknown hosts get a 404 when there is no fallback origin
+func (r *originRouter) handler(proxy http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		route := r.match(req.Host)
+		if route == nil {
+			http.NotFound(w, req)
+			return
+		}
+		ctx := context.WithValue(req.Context(), routeContextKey{}, route)
+		proxy.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// routeFromContext returns the route chosen for a request
+func routeFromContext(ctx context.Context) *originRoute {
+	route, _ := ctx.Value(routeContextKey{}).(*originRoute)
+	return route
+}
@@ -2,42 +2,365 @@ package config
 
 import (
 	"os"
+	"reflect"
 	"strconv"
+	"strings"
 	"time"
 )
 
 // Config holds the proxy configuration
 type Config struct {
 	// Proxy settings
-	Port         string
-	OriginURL    string
-	ReadTimeout  time.Duration
-	WriteTimeout time.Duration
+	Port         string        `yaml:"port"`
+	OriginURL    string        `yaml:"origin_url"`
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+
+	// OriginURLs, when set, replaces OriginURL with a list of origins in
+	// priority order; requests that can't reach one are retried on the next
+	OriginURLs []string `yaml:"origin_urls"`
+
+	// ShutdownTimeout is how long in-flight requests get to finish after
+	// SIGINT or SIGTERM
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	// Host-based routing
+	// OriginRoutes maps host patterns ("shop.example.com", "*.example.com")
+	// to origin URLs. Unmatched hosts use OriginURL when UnmatchedHostFallback
+	// is set, or get a 404 otherwise.
+	OriginRoutes          map[string]string `yaml:"origin_routes"`
+	UnmatchedHostFallback bool              `yaml:"origin_fallback"`
+
+	// ETagMode controls the origin's ETag and Last-Modified on transformed
+	// responses: "rewrite" (default), "strip", or "preserve"
+	ETagMode string `yaml:"etag_mode"`
+
+	// Only responses to TransformMethods requests with a TransformStatuses
+	// status are transformed; others, such as form posts, redirects, and
+	// error pages, pass through
+	TransformMethods  []string `yaml:"transform_methods"`
+	TransformStatuses []int    `yaml:"transform_statuses"`
 
 	// ExperiFlow API settings
-	APIBaseURL string
-	EdgeToken  string
-	Timeout    time.Duration
+	APIBaseURL string `yaml:"experiflow_api_url"`
+	EdgeToken  string `yaml:"experiflow_edge_token"`
+
+	// APITimeout bounds each HTTP call to the API; TransformBudget bounds
+	// all experiment work for a response, including cache lookups
+	APITimeout      time.Duration `yaml:"api_timeout"`
+	TransformBudget time.Duration `yaml:"transform_budget"`
+
+	// Retry settings for ExperiFlow API calls
+	APIRetries      int           `yaml:"api_retries"`
+	APIRetryBackoff time.Duration `yaml:"api_retry_backoff"`
+
+	// Circuit breaker for ExperiFlow API calls
+	BreakerThreshold int           `yaml:"breaker_threshold"`
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown"`
+
+	// Rate limit for ExperiFlow API calls, in requests per second; 0 disables it
+	APIRateLimit     float64       `yaml:"api_rate_limit"`
+	APIRateBurst     int           `yaml:"api_rate_burst"`
+	APIRateLimitWait time.Duration `yaml:"api_rate_limit_wait"`
+
+	// Connection pool for ExperiFlow API calls
+	APIMaxIdleConns        int           `yaml:"api_max_idle_conns"`
+	APIMaxIdleConnsPerHost int           `yaml:"api_max_idle_conns_per_host"`
+	APIIdleConnTimeout     time.Duration `yaml:"api_idle_conn_timeout"`
+
+	// Cache settings
+	// Variant lists are cached for VariantsCacheTTL, or VariantsNegativeTTL
+	// when an experiment has none
+	SpecCacheSize       int           `yaml:"spec_cache_size"`
+	VariantsCacheTTL    time.Duration `yaml:"variants_cache_ttl"`
+	VariantsNegativeTTL time.Duration `yaml:"variants_negative_ttl"`
+
+	// OnTimeout decides what happens when a transform spec fetch times out:
+	// "fail-open", "serve-stale", or "fail-closed"; empty follows FailOpen.
+	// SpecStaleGrace is how long expired specs are kept for serve-stale.
+	OnTimeout      string        `yaml:"on_timeout"`
+	SpecStaleGrace time.Duration `yaml:"spec_stale_grace"`
+
+	// MaxTransformBytes is the largest origin body that will be transformed;
+	// larger responses pass through untouched. Zero disables the limit.
+	MaxTransformBytes int `yaml:"max_transform_bytes"`
+
+	// MaxOperations rejects specs with more operations, and MaxMatchedNodes
+	// fails operations whose selector matches more nodes. Zero disables each.
+	MaxOperations   int `yaml:"max_operations"`
+	MaxMatchedNodes int `yaml:"max_matched_nodes"`
+
+	// MaxConcurrentTransforms bounds how many bodies are parsed and
+	// transformed at once, capping peak memory. Beyond it, requests wait up
+	// to TransformQueueTimeout for a slot, then pass through. Zero is unlimited.
+	MaxConcurrentTransforms int           `yaml:"max_concurrent_transforms"`
+	TransformQueueTimeout   time.Duration `yaml:"transform_queue_timeout"`
+
+	// ExperimentIDs are the experiments to run, in order
+	ExperimentIDs []string `yaml:"experiment_ids"`
+
+	// ActiveExperimentsRefresh is how often the active experiment list is
+	// fetched from the API and merged with EXPERIMENT_IDS; zero disables it
+	ActiveExperimentsRefresh time.Duration `yaml:"active_experiments_refresh"`
+
+	// Assignment settings
+	// Changing AssignmentSalt reshuffles every existing assignment
+	AssignmentSalt string `yaml:"assignment_salt"`
+
+	// ExperimentSalts maps experiment IDs to an extra salt for their
+	// bucketing, so one experiment can be reshuffled on its own
+	ExperimentSalts map[string]string `yaml:"experiment_salts"`
+
+	// UserIDCookie names a first-party cookie (e.g. "_uid") whose value
+	// identifies users for bucketing; IP + User-Agent is used without it
+	UserIDCookie string `yaml:"user_id_cookie"`
+
+	// AssignmentBundle assigns new users and fetches their spec in a single
+	// API call, falling back to two calls where the endpoint is missing
+	AssignmentBundle bool `yaml:"assignment_bundle"`
+
+	// AssignmentStoreURL points at a Redis server (redis://host:6379/0)
+	// that shares assignments across instances and with clients that drop
+	// cookies; empty disables the store. Entries live for AssignmentStoreTTL,
+	// and each store call waits at most AssignmentStoreTimeout.
+	AssignmentStoreURL     string        `yaml:"assignment_store_url"`
+	AssignmentStoreTTL     time.Duration `yaml:"assignment_store_ttl"`
+	AssignmentStoreTimeout time.Duration `yaml:"assignment_store_timeout"`
+
+	// Holdback settings
+	// HoldbackPercent of users (0-100) never see any experiment; HoldbackSalt
+	// keeps the holdback independent of AssignmentSalt
+	HoldbackPercent float64 `yaml:"holdback_percent"`
+	HoldbackSalt    string  `yaml:"holdback_salt"`
+
+	// SamplePercent of users (0-100) are transformed at all; the rest pass
+	// straight through, consistently per user
+	SamplePercent float64 `yaml:"sample_percent"`
+
+	// Assignment cookie settings
+	CookieDomain   string        `yaml:"cookie_domain"`
+	CookieSecure   bool          `yaml:"cookie_secure"`
+	CookieMaxAge   time.Duration `yaml:"cookie_max_age"`
+	CookieSameSite string        `yaml:"cookie_samesite"` // "lax", "strict", "none", or "default"
+
+	// CookieMode stores assignments in one cookie per experiment
+	// ("per-experiment") or all together in one cookie ("single")
+	CookieMode string `yaml:"cookie_mode"`
+
+	// RewriteCookieDomain rewrites the Domain of origin Set-Cookie headers
+	// that don't match the host the client sees: "host" for that host, or a
+	// fixed domain. Empty leaves origin cookies alone.
+	RewriteCookieDomain string `yaml:"rewrite_cookie_domain"`
+
+	// Targeting settings
+	// ExperimentPaths maps experiment IDs to the URL path patterns they run on
+	// Experiments without an entry run on every path
+	ExperimentPaths map[string][]string `yaml:"experiment_paths"`
+
+	// ExperimentAudiences maps experiment IDs to cookie/header rules that
+	// must all match, e.g. "cookie:session" or "header:X-Audience=beta"
+	ExperimentAudiences map[string][]string `yaml:"experiment_audiences"`
+
+	// ExclusionGroups maps group names to mutually exclusive experiment IDs
+	// Each user participates in at most one experiment per group
+	ExclusionGroups map[string][]string `yaml:"exclusion_groups"`
+
+	// BotUserAgents are case-insensitive User-Agent substrings (e.g.
+	// "Googlebot") whose requests get the original page and no assignment
+	BotUserAgents []string `yaml:"bot_user_agents"`
 
 	// Feature flags
-	FailOpen      bool
-	EnableLogging bool
-	EnableMetrics bool
+	FailOpen      bool   `yaml:"fail_open"`
+	EnableLogging bool   `yaml:"enable_logging"`
+	LogFormat     string `yaml:"log_format"` // "text" or "json"
+	EnableMetrics bool   `yaml:"enable_metrics"`
+	SanitizeHTML  bool   `yaml:"sanitize_html"` // Strip scripts, styles, and event handlers from injected HTML
+	CSPNonce      bool   `yaml:"csp_nonce"`     // Copy the page's CSP nonce onto injected scripts and styles
+	SniffHTML     bool   `yaml:"sniff_html"`    // Sniff bodies without a specific Content-Type for HTML
+	StreamHTML    bool   `yaml:"stream_html"`   // Transform pages as they arrive instead of buffering them
+
+	// TrustedProxies lists proxy IPs/CIDRs whose X-Forwarded-For and
+	// X-Real-IP headers are believed when resolving the client IP
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// PreviewAllowlist lists client IPs/CIDRs allowed to request preview
+	// mode with X-EF-Preview: 1; empty disables preview mode
+	PreviewAllowlist []string `yaml:"preview_allowlist"`
+
+	// AdminToken authenticates admin endpoints such as the cache flush;
+	// empty disables them
+	AdminToken string `yaml:"admin_token"`
+
+	// BypassSecret lets requests with X-EF-Bypass: <secret> skip every
+	// experiment and get the origin page unchanged; empty disables bypass
+	BypassSecret string `yaml:"bypass_secret"`
+
+	// DebugOps adds X-EF-Debug-Ops, listing every applied operation, to all
+	// transformed responses; DebugSecret enables it per request via
+	// X-EF-Debug: <secret>
+	DebugOps    bool   `yaml:"debug_ops"`
+	DebugSecret string `yaml:"debug_secret"`
+
+	// AllowForcedVariants lets ?ef_<experimentID>=<variantKey> pick a variant for QA
+	// Keep disabled in production
+	AllowForcedVariants bool `yaml:"allow_forced_variants"`
+}
+
+// staticSettings only take effect at startup, so a reload keeps their
+// current values
+var staticSettings = []string{
+	"port", "read_timeout", "write_timeout", "shutdown_timeout",
+	"origin_url", "origin_urls", "origin_routes", "origin_fallback",
+	"experiflow_api_url", "experiflow_edge_token", "api_timeout",
+	"api_retries", "api_retry_backoff", "breaker_threshold", "breaker_cooldown",
+	"api_rate_limit", "api_rate_burst", "api_rate_limit_wait",
+	"api_max_idle_conns", "api_max_idle_conns_per_host", "api_idle_conn_timeout",
+	"spec_cache_size", "spec_stale_grace", "variants_cache_ttl", "variants_negative_ttl",
+	"active_experiments_refresh", "max_concurrent_transforms",
+	"assignment_store_url", "assignment_store_ttl",
+	"enable_metrics", "log_format",
+}
+
+// Origins returns the default origins in priority order: OriginURLs, or
+// just OriginURL when that isn't set
+func (c *Config) Origins() []string {
+	if len(c.OriginURLs) > 0 {
+		return c.OriginURLs
+	}
+	return []string{c.OriginURL}
+}
+
+// KeepStatic copies the settings that can't change at runtime from old,
+// returning the keys of those whose values differed
+func (c *Config) KeepStatic(old *Config) []string {
+	fields, oldFields := fileFields(c), fileFields(old)
+
+	var changed []string
+	for _, key := range staticSettings {
+		if !reflect.DeepEqual(fields[key].Interface(), oldFields[key].Interface()) {
+			changed = append(changed, key)
+		}
+		fields[key].Set(oldFields[key])
+	}
+	return changed
 }
 
 // LoadFromEnv loads configuration from environment variables
 func LoadFromEnv() *Config {
+	// TRANSFORM_TIMEOUT used to set both timeouts; it now only provides
+	// their defaults
+	legacyTimeout := getDuration("TRANSFORM_TIMEOUT", 50*time.Millisecond)
+
 	return &Config{
-		Port:          getEnv("PORT", "8090"),
-		OriginURL:     getEnv("ORIGIN_URL", "http://localhost:8080"),
-		ReadTimeout:   getDuration("READ_TIMEOUT", 10*time.Second),
-		WriteTimeout:  getDuration("WRITE_TIMEOUT", 10*time.Second),
-		APIBaseURL:    getEnv("EXPERIFLOW_API_URL", "http://localhost:8000"),
-		EdgeToken:     getEnv("EXPERIFLOW_EDGE_TOKEN", ""),
-		Timeout:       getDuration("TRANSFORM_TIMEOUT", 50*time.Millisecond),
+		// Proxy settings
+		Port:         getEnv("PORT", "8090"),
+		OriginURL:    getEnv("ORIGIN_URL", "http://localhost:8080"),
+		OriginURLs:   getList("ORIGIN_URLS"),
+		ReadTimeout:  getDuration("READ_TIMEOUT", 10*time.Second),
+		WriteTimeout: getDuration("WRITE_TIMEOUT", 10*time.Second),
+
+		ShutdownTimeout: getDuration("SHUTDOWN_TIMEOUT", 15*time.Second),
+
+		// Host-based routing
+		OriginRoutes:          getMap("ORIGIN_ROUTES"),
+		UnmatchedHostFallback: getBool("ORIGIN_FALLBACK", true),
+
+		ETagMode: getEnv("ETAG_MODE", "rewrite"),
+
+		TransformMethods:  getListDefault("TRANSFORM_METHODS", []string{"GET", "HEAD"}),
+		TransformStatuses: getIntList("TRANSFORM_STATUSES", []int{200}),
+
+		// ExperiFlow API settings
+		APIBaseURL: getEnv("EXPERIFLOW_API_URL", "http://localhost:8000"),
+		EdgeToken:  getEnv("EXPERIFLOW_EDGE_TOKEN", ""),
+
+		APITimeout:      getDuration("API_TIMEOUT", legacyTimeout),
+		TransformBudget: getDuration("TRANSFORM_BUDGET", 2*legacyTimeout),
+
+		// Retry settings for ExperiFlow API calls
+		APIRetries:      getInt("API_RETRIES", 1),
+		APIRetryBackoff: getDuration("API_RETRY_BACKOFF", 5*time.Millisecond),
+
+		// Circuit breaker for ExperiFlow API calls
+		BreakerThreshold: getInt("BREAKER_THRESHOLD", 5),
+		BreakerCooldown:  getDuration("BREAKER_COOLDOWN", 10*time.Second),
+
+		// Rate limit for ExperiFlow API calls
+		APIRateLimit:     getFloat("API_RATE_LIMIT", 0),
+		APIRateBurst:     getInt("API_RATE_BURST", 10),
+		APIRateLimitWait: getDuration("API_RATE_LIMIT_WAIT", 0),
+
+		// Connection pool for ExperiFlow API calls
+		APIMaxIdleConns:        getInt("API_MAX_IDLE_CONNS", 100),
+		APIMaxIdleConnsPerHost: getInt("API_MAX_IDLE_CONNS_PER_HOST", 32),
+		APIIdleConnTimeout:     getDuration("API_IDLE_CONN_TIMEOUT", 90*time.Second),
+
+		// Cache settings
+		SpecCacheSize:       getInt("SPEC_CACHE_SIZE", 1000),
+		VariantsCacheTTL:    getDuration("VARIANTS_CACHE_TTL", time.Minute),
+		VariantsNegativeTTL: getDuration("VARIANTS_NEGATIVE_TTL", 10*time.Second),
+
+		OnTimeout:      getEnv("ON_TIMEOUT", ""),
+		SpecStaleGrace: getDuration("SPEC_STALE_GRACE", time.Hour),
+
+		MaxTransformBytes: getInt("MAX_TRANSFORM_BYTES", 5<<20),
+		MaxOperations:     getInt("MAX_OPERATIONS", 1000),
+		MaxMatchedNodes:   getInt("MAX_MATCHED_NODES", 1000),
+
+		MaxConcurrentTransforms: getInt("MAX_CONCURRENT_TRANSFORMS", 0),
+		TransformQueueTimeout:   getDuration("TRANSFORM_QUEUE_TIMEOUT", 0),
+
+		ExperimentIDs:            getList("EXPERIMENT_IDS"),
+		ActiveExperimentsRefresh: getDuration("ACTIVE_EXPERIMENTS_REFRESH", 0),
+
+		// Assignment settings
+		AssignmentSalt:   getEnv("ASSIGNMENT_SALT", "production-salt"),
+		ExperimentSalts:  getMap("EXPERIMENT_SALTS"),
+		AssignmentBundle: getBool("ASSIGNMENT_BUNDLE", true),
+		UserIDCookie:     getEnv("USER_ID_COOKIE", ""),
+
+		AssignmentStoreURL:     getEnv("ASSIGNMENT_STORE_URL", ""),
+		AssignmentStoreTTL:     getDuration("ASSIGNMENT_STORE_TTL", 30*24*time.Hour),
+		AssignmentStoreTimeout: getDuration("ASSIGNMENT_STORE_TIMEOUT", 20*time.Millisecond),
+
+		// Holdback settings
+		HoldbackPercent: getFloat("HOLDBACK_PERCENT", 0),
+		HoldbackSalt:    getEnv("HOLDBACK_SALT", "holdback-salt"),
+
+		SamplePercent: getFloat("SAMPLE_PERCENT", 100),
+
+		// Assignment cookie settings
+		CookieDomain:   getEnv("COOKIE_DOMAIN", ""),
+		CookieSecure:   getBool("COOKIE_SECURE", false),
+		CookieMaxAge:   getDuration("COOKIE_MAX_AGE", 30*24*time.Hour),
+		CookieSameSite: getEnv("COOKIE_SAMESITE", "lax"),
+		CookieMode:     getEnv("COOKIE_MODE", "per-experiment"),
+
+		RewriteCookieDomain: getEnv("REWRITE_COOKIE_DOMAIN", ""),
+
+		// Targeting settings
+		ExperimentPaths:     getListMap("EXPERIMENT_PATHS"),
+		ExperimentAudiences: getListMap("EXPERIMENT_AUDIENCES"),
+		ExclusionGroups:     getListMap("EXCLUSION_GROUPS"),
+		BotUserAgents:       getList("BOT_USER_AGENTS"),
+
+		// Feature flags
 		FailOpen:      getBool("FAIL_OPEN", true),
 		EnableLogging: getBool("ENABLE_LOGGING", true),
+		LogFormat:     getEnv("LOG_FORMAT", "text"),
 		EnableMetrics: getBool("ENABLE_METRICS", true),
+		SanitizeHTML:  getBool("SANITIZE_HTML", true),
+		CSPNonce:      getBool("CSP_NONCE", false),
+		SniffHTML:     getBool("SNIFF_HTML", true),
+		StreamHTML:    getBool("STREAM_HTML", false),
+
+		TrustedProxies:      getList("TRUSTED_PROXIES"),
+		PreviewAllowlist:    getList("PREVIEW_ALLOWLIST"),
+		BypassSecret:        getEnv("BYPASS_SECRET", ""),
+		AdminToken:          getEnv("ADMIN_TOKEN", ""),
+		DebugOps:            getBool("DEBUG_OPS", false),
+		DebugSecret:         getEnv("DEBUG_SECRET", ""),
+		AllowForcedVariants: getBool("ALLOW_FORCED_VARIANTS", false),
 	}
 }
 
@@ -57,6 +380,24 @@ func getDuration(key string, defaultValue time.Duration) time.Duration {
 	return defaultValue
 }
 
+func getInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if i, err := strconv.Atoi(value); err == nil {
+			return i
+		}
+	}
+	return defaultValue
+}
+
+func getFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+	return defaultValue
+}
+
 func getBool(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
 		if b, err := strconv.ParseBool(value); err == nil {
@@ -65,3 +406,90 @@ func getBool(key string, defaultValue bool) bool {
 	}
 	return defaultValue
 }
+
+// getList parses a comma-separated list, skipping empty items
+func getList(key string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return nil
+	}
+
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// getListDefault parses a comma-separated list like getList, or returns
+// defaultValue when the variable is unset
+func getListDefault(key string, defaultValue []string) []string {
+	if list := getList(key); list != nil {
+		return list
+	}
+	return defaultValue
+}
+
+// getIntList parses a comma-separated list of integers, or returns
+// defaultValue when the variable is unset or any item isn't a number
+func getIntList(key string, defaultValue []int) []int {
+	items := getList(key)
+	if items == nil {
+		return defaultValue
+	}
+
+	result := make([]int, len(items))
+	for i, item := range items {
+		n, err := strconv.Atoi(item)
+		if err != nil {
+			return defaultValue
+		}
+		result[i] = n
+	}
+	return result
+}
+
+// getMap parses a map of strings
+// Format: "key1=value1;key2=value2"
+func getMap(key string) map[string]string {
+	value := os.Getenv(key)
+	if value == "" {
+		return nil
+	}
+
+	result := make(map[string]string)
+	for _, entry := range strings.Split(value, ";") {
+		name, item, found := strings.Cut(entry, "=")
+		name, item = strings.TrimSpace(name), strings.TrimSpace(item)
+		if found && name != "" && item != "" {
+			result[name] = item
+		}
+	}
+	return result
+}
+
+// getListMap parses a map of comma-separated lists
+// Format: "key1=a,b;key2=c"
+func getListMap(key string) map[string][]string {
+	value := os.Getenv(key)
+	if value == "" {
+		return nil
+	}
+
+	result := make(map[string][]string)
+	for _, entry := range strings.Split(value, ";") {
+		name, list, found := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			continue
+		}
+		for _, item := range strings.Split(list, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				result[name] = append(result[name], item)
+			}
+		}
+	}
+	return result
+}
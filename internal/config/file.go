@@ -0,0 +1,73 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Load loads configuration from the file named by CONFIG_FILE, or from
+// environment variables alone when it isn't set
+func Load() (*Config, error) {
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		return LoadFromFile(path)
+	}
+	return LoadFromEnv(), nil
+}
+
+// LoadFromFile loads configuration from a YAML or JSON file
+// Keys are the lowercase environment variable names (origin_url,
+// experiment_paths, ...). Environment variables override file values, and
+// settings in neither fall back to the LoadFromEnv defaults. Unknown keys,
+// values of the wrong type, and a missing origin_url or
+// experiflow_api_url are errors.
+func LoadFromFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+
+	// JSON is valid YAML, so one decoder handles both
+	var values map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("parse config file %s: %w", path, err)
+	}
+
+	cfg := LoadFromEnv()
+	fields := fileFields(cfg)
+	for key, node := range values {
+		field, ok := fields[key]
+		if !ok {
+			return nil, fmt.Errorf("config file %s: unknown setting %q", path, key)
+		}
+		if os.Getenv(strings.ToUpper(key)) != "" {
+			continue
+		}
+		if err := node.Decode(field.Addr().Interface()); err != nil {
+			return nil, fmt.Errorf("config file %s: %s: %w", path, key, err)
+		}
+	}
+
+	// Required settings must be given explicitly rather than defaulted
+	for _, key := range []string{"origin_url", "experiflow_api_url"} {
+		if _, inFile := values[key]; !inFile && os.Getenv(strings.ToUpper(key)) == "" {
+			return nil, fmt.Errorf("config file %s: %s is required", path, key)
+		}
+	}
+	return cfg, nil
+}
+
+// fileFields maps each setting's file key to its field in cfg
+func fileFields(cfg *Config) map[string]reflect.Value {
+	v := reflect.ValueOf(cfg).Elem()
+	fields := make(map[string]reflect.Value, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		if key := v.Type().Field(i).Tag.Get("yaml"); key != "" {
+			fields[key] = v.Field(i)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,160 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Validate reports misconfiguration that would otherwise only show up as
+// odd runtime behavior, such as unparsable environment values that were
+// silently replaced by defaults
+func (c *Config) Validate() error {
+	errs := c.envErrors()
+
+	if _, err := strconv.ParseUint(c.Port, 10, 16); err != nil {
+		errs = append(errs, fmt.Errorf("PORT %q is not a valid port number", c.Port))
+	}
+	if len(c.OriginURLs) == 0 {
+		if err := validateURL(c.OriginURL); err != nil {
+			errs = append(errs, fmt.Errorf("ORIGIN_URL: %w", err))
+		}
+	}
+	for _, origin := range c.OriginURLs {
+		if err := validateURL(origin); err != nil {
+			errs = append(errs, fmt.Errorf("ORIGIN_URLS: %w", err))
+		}
+	}
+	if c.APIBaseURL == "" {
+		errs = append(errs, errors.New("EXPERIFLOW_API_URL is required"))
+	} else if dir, ok := strings.CutPrefix(c.APIBaseURL, "file://"); ok {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			errs = append(errs, fmt.Errorf("EXPERIFLOW_API_URL: %q is not a directory", dir))
+		}
+	} else if err := validateURL(c.APIBaseURL); err != nil {
+		errs = append(errs, fmt.Errorf("EXPERIFLOW_API_URL: %w", err))
+	}
+	if c.AssignmentStoreURL != "" {
+		if err := validateURL(c.AssignmentStoreURL); err != nil {
+			errs = append(errs, fmt.Errorf("ASSIGNMENT_STORE_URL: %w", err))
+		} else if u, _ := url.Parse(c.AssignmentStoreURL); u.Scheme != "redis" && u.Scheme != "rediss" {
+			errs = append(errs, fmt.Errorf("ASSIGNMENT_STORE_URL: scheme must be redis or rediss, got %q", u.Scheme))
+		}
+		if c.AssignmentStoreTimeout <= 0 {
+			errs = append(errs, fmt.Errorf("ASSIGNMENT_STORE_TIMEOUT must be positive, got %s", c.AssignmentStoreTimeout))
+		}
+	}
+
+	for _, status := range c.TransformStatuses {
+		if status < 100 || status > 599 {
+			errs = append(errs, fmt.Errorf("TRANSFORM_STATUSES: %d is not an HTTP status code", status))
+		}
+	}
+
+	if c.APIRateLimit < 0 {
+		errs = append(errs, fmt.Errorf("API_RATE_LIMIT must not be negative, got %g", c.APIRateLimit))
+	} else if c.APIRateLimit > 0 && c.APIRateBurst < 1 {
+		errs = append(errs, fmt.Errorf("API_RATE_BURST must be at least 1, got %d", c.APIRateBurst))
+	}
+
+	// Values that fall back to a default when unrecognized; empty picks
+	// the default on purpose
+	choices := []struct {
+		name    string
+		value   string
+		allowed []string
+	}{
+		{"COOKIE_SAMESITE", c.CookieSameSite, []string{"lax", "strict", "none", "default"}},
+		{"COOKIE_MODE", c.CookieMode, []string{"per-experiment", "single"}},
+		{"ETAG_MODE", c.ETagMode, []string{"rewrite", "strip", "preserve"}},
+		{"ON_TIMEOUT", c.OnTimeout, []string{"fail-open", "serve-stale", "fail-closed"}},
+		{"LOG_FORMAT", c.LogFormat, []string{"text", "json"}},
+	}
+	for _, choice := range choices {
+		if value := strings.ToLower(strings.TrimSpace(choice.value)); value != "" && !slices.Contains(choice.allowed, value) {
+			errs = append(errs, fmt.Errorf("%s %q must be one of %s", choice.name, choice.value, strings.Join(choice.allowed, ", ")))
+		}
+	}
+
+	timeouts := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"READ_TIMEOUT", c.ReadTimeout},
+		{"WRITE_TIMEOUT", c.WriteTimeout},
+		{"SHUTDOWN_TIMEOUT", c.ShutdownTimeout},
+		{"API_TIMEOUT", c.APITimeout},
+		{"TRANSFORM_BUDGET", c.TransformBudget},
+	}
+	for _, timeout := range timeouts {
+		if timeout.value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive, got %s", timeout.name, timeout.value))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateURL checks that a URL parses and has a scheme and host
+func validateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("%q must be an absolute URL such as http://host:port", raw)
+	}
+	return nil
+}
+
+// envErrors reports environment variables whose values don't parse as
+// their setting's type, which LoadFromEnv replaces with defaults
+func (c *Config) envErrors() []error {
+	fields := fileFields(c)
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, key := range keys {
+		field := fields[key]
+		name := strings.ToUpper(key)
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+
+		var err error
+		switch {
+		case field.Type() == durationType:
+			_, err = time.ParseDuration(value)
+		case field.Kind() == reflect.Int:
+			_, err = strconv.Atoi(value)
+		case field.Kind() == reflect.Float64:
+			_, err = strconv.ParseFloat(value, 64)
+		case field.Kind() == reflect.Bool:
+			_, err = strconv.ParseBool(value)
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Int:
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" && err == nil {
+					_, err = strconv.Atoi(item)
+				}
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s=%q is invalid and was ignored", name, value))
+		}
+	}
+	return errs
+}
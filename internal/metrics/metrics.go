@@ -0,0 +1,296 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Label values used when a variant key can't be attributed
+const (
+	UnknownVariant = "unknown"
+	OtherVariant   = "other"
+)
+
+// maxVariantsPerExperiment bounds the variant_key label cardinality
+const maxVariantsPerExperiment = 32
+
+// Metrics records proxy metrics in a Prometheus registry
+// A nil *Metrics is valid and records nothing, so callers don't need to
+// check whether metrics are enabled
+type Metrics struct {
+	registry *prometheus.Registry
+
+	transformOutcomes *prometheus.CounterVec
+	assignments       *prometheus.CounterVec
+	operationsApplied *prometheus.CounterVec
+	operationFailures *prometheus.CounterVec
+	unmatchedOps      *prometheus.CounterVec
+	unknownOps        *prometheus.CounterVec
+	conflictingOps    *prometheus.CounterVec
+	unsupportedSpecs  *prometheus.CounterVec
+	oversizedSpecs    *prometheus.CounterVec
+	specFetchErrors   *prometheus.CounterVec
+	invalidVariants   *prometheus.CounterVec
+	storeErrors       prometheus.Counter
+	failOpen          prometheus.Counter
+	transformsShed    prometheus.Counter
+	transformDuration prometheus.Histogram
+
+	mu            sync.RWMutex
+	knownVariants map[string]map[string]bool // experiment ID -> variant keys
+}
+
+// New creates a metrics recorder with its own registry
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		transformOutcomes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "experiflow_transform_outcomes_total",
+			Help: "Experiment outcomes per response by status (hit, control, miss).",
+		}, []string{"experiment_id", "variant_key", "status"}),
+		assignments: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "experiflow_assignments_total",
+			Help: "New variant assignments made by bucketing or the assignment bundle endpoint, excluding cookie and store lookups.",
+		}, []string{"experiment_id", "variant_key"}),
+		operationsApplied: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "experiflow_operations_applied_total",
+			Help: "Transform operations applied to responses.",
+		}, []string{"experiment_id", "variant_key"}),
+		operationFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "experiflow_operation_failures_total",
+			Help: "Transform operations that failed to apply, excluding selectors that matched nothing and unknown operation types.",
+		}, []string{"experiment_id"}),
+		unmatchedOps: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "experiflow_operation_unmatched_total",
+			Help: "Transform operations whose selector matched no elements.",
+		}, []string{"experiment_id"}),
+		unknownOps: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "experiflow_operation_unknown_total",
+			Help: "Transform operations skipped because their type isn't supported.",
+		}, []string{"experiment_id"}),
+		conflictingOps: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "experiflow_operation_conflicts_total",
+			Help: "Transform operations that overrode a property an earlier operation in the spec set on the same element.",
+		}, []string{"experiment_id"}),
+		unsupportedSpecs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "experiflow_spec_unsupported_total",
+			Help: "Transform specs skipped because their format version isn't supported.",
+		}, []string{"experiment_id"}),
+		oversizedSpecs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "experiflow_spec_oversized_total",
+			Help: "Transform specs skipped because they have more operations than allowed.",
+		}, []string{"experiment_id"}),
+		specFetchErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "experiflow_spec_fetch_errors_total",
+			Help: "Failed transform spec fetches from the ExperiFlow API.",
+		}, []string{"experiment_id"}),
+		invalidVariants: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "experiflow_variant_config_errors_total",
+			Help: "Problems found in variant lists fetched from the API: missing or duplicate IDs, several controls, or negative allocations.",
+		}, []string{"experiment_id"}),
+		storeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "experiflow_assignment_store_errors_total",
+			Help: "Failed assignment store lookups and writes, which fall back to fresh assignment.",
+		}),
+		failOpen: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "experiflow_fail_open_total",
+			Help: "Errors where the proxy failed open and served the response untransformed.",
+		}),
+		transformsShed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "experiflow_transforms_shed_total",
+			Help: "Responses served untransformed because the concurrent transform limit was reached.",
+		}),
+		transformDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "experiflow_transform_duration_seconds",
+			Help:    "Time spent transforming a response across all experiments.",
+			Buckets: []float64{.001, .0025, .005, .01, .02, .03, .05, .075, .1, .25},
+		}),
+		knownVariants: make(map[string]map[string]bool),
+	}
+
+	m.registry.MustRegister(
+		m.transformOutcomes,
+		m.assignments,
+		m.operationsApplied,
+		m.operationFailures,
+		m.unmatchedOps,
+		m.unknownOps,
+		m.conflictingOps,
+		m.unsupportedSpecs,
+		m.oversizedSpecs,
+		m.specFetchErrors,
+		m.invalidVariants,
+		m.storeErrors,
+		m.failOpen,
+		m.transformsShed,
+		m.transformDuration,
+	)
+	return m
+}
+
+// Handler serves the registry in the Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// RegisterVariants records the variant keys known for an experiment
+// Only registered keys are used as label values; others report as "other"
+func (m *Metrics) RegisterVariants(experimentID string, variantKeys []string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	known := m.knownVariants[experimentID]
+	if known == nil {
+		known = make(map[string]bool)
+		m.knownVariants[experimentID] = known
+	}
+	for _, key := range variantKeys {
+		if len(known) >= maxVariantsPerExperiment {
+			return
+		}
+		known[key] = true
+	}
+}
+
+// TransformOutcome counts an experiment outcome for a response
+func (m *Metrics) TransformOutcome(experimentID, variantKey, status string) {
+	if m == nil {
+		return
+	}
+	m.transformOutcomes.WithLabelValues(experimentID, m.variantLabel(experimentID, variantKey), status).Inc()
+}
+
+// Assignment counts a new assignment to an experiment variant
+func (m *Metrics) Assignment(experimentID, variantKey string) {
+	if m == nil {
+		return
+	}
+	m.assignments.WithLabelValues(experimentID, m.variantLabel(experimentID, variantKey)).Inc()
+}
+
+// OperationsApplied counts operations applied for an experiment variant
+func (m *Metrics) OperationsApplied(experimentID, variantKey string, count int) {
+	if m == nil {
+		return
+	}
+	m.operationsApplied.WithLabelValues(experimentID, m.variantLabel(experimentID, variantKey)).Add(float64(count))
+}
+
+// OperationFailures counts operations that failed to apply for an experiment
+func (m *Metrics) OperationFailures(experimentID string, count int) {
+	if m == nil {
+		return
+	}
+	m.operationFailures.WithLabelValues(experimentID).Add(float64(count))
+}
+
+// OperationsUnmatched counts operations whose selector matched nothing
+func (m *Metrics) OperationsUnmatched(experimentID string, count int) {
+	if m == nil {
+		return
+	}
+	m.unmatchedOps.WithLabelValues(experimentID).Add(float64(count))
+}
+
+// OperationsUnknown counts operations whose type isn't supported
+func (m *Metrics) OperationsUnknown(experimentID string, count int) {
+	if m == nil {
+		return
+	}
+	m.unknownOps.WithLabelValues(experimentID).Add(float64(count))
+}
+
+// OperationConflicts counts operations that overrode earlier ones
+func (m *Metrics) OperationConflicts(experimentID string, count int) {
+	if m == nil {
+		return
+	}
+	m.conflictingOps.WithLabelValues(experimentID).Add(float64(count))
+}
+
+// UnsupportedSpec counts a transform spec skipped for its format version
+func (m *Metrics) UnsupportedSpec(experimentID string) {
+	if m == nil {
+		return
+	}
+	m.unsupportedSpecs.WithLabelValues(experimentID).Inc()
+}
+
+// OversizedSpec counts a transform spec skipped for having too many operations
+func (m *Metrics) OversizedSpec(experimentID string) {
+	if m == nil {
+		return
+	}
+	m.oversizedSpecs.WithLabelValues(experimentID).Inc()
+}
+
+// SpecFetchError counts a failed transform spec fetch
+func (m *Metrics) SpecFetchError(experimentID string) {
+	if m == nil {
+		return
+	}
+	m.specFetchErrors.WithLabelValues(experimentID).Inc()
+}
+
+// InvalidVariants counts problems found in an experiment's variant list
+func (m *Metrics) InvalidVariants(experimentID string, count int) {
+	if m == nil {
+		return
+	}
+	m.invalidVariants.WithLabelValues(experimentID).Add(float64(count))
+}
+
+// StoreError counts a failed assignment store call
+func (m *Metrics) StoreError() {
+	if m == nil {
+		return
+	}
+	m.storeErrors.Inc()
+}
+
+// FailOpen counts a response served untransformed because of an error
+func (m *Metrics) FailOpen() {
+	if m == nil {
+		return
+	}
+	m.failOpen.Inc()
+}
+
+// TransformShed counts a response passed through because the concurrent
+// transform limit was reached
+func (m *Metrics) TransformShed() {
+	if m == nil {
+		return
+	}
+	m.transformsShed.Inc()
+}
+
+// TransformDuration records the time spent transforming a response
+func (m *Metrics) TransformDuration(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.transformDuration.Observe(d.Seconds())
+}
+
+// variantLabel maps a variant key to a bounded label value
+func (m *Metrics) variantLabel(experimentID, variantKey string) string {
+	if variantKey == "" {
+		return UnknownVariant
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.knownVariants[experimentID][variantKey] {
+		return variantKey
+	}
+	return OtherVariant
+}
@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// audienceRule matches a request cookie or header
+type audienceRule struct {
+	source  string         // "cookie" or "header"
+	name    string         // Cookie or header name
+	op      byte           // 0 for presence, '=' for equality, '~' for a regex
+	value   string         // Required value for '=' rules
+	pattern *regexp.Regexp // Required pattern for '~' rules
+	negate  bool           // Match when the rule doesn't hold
+}
+
+// parseAudienceRule parses a rule such as "cookie:session" (present),
+// "header:X-Audience=beta" (equals), or "header:X-Tier~^gold" (regex)
+// A leading "!" negates the rule.
+func parseAudienceRule(rule string) (audienceRule, error) {
+	var r audienceRule
+	spec := strings.TrimSpace(rule)
+	if rest, ok := strings.CutPrefix(spec, "!"); ok {
+		r.negate, spec = true, rest
+	}
+
+	source, spec, ok := strings.Cut(spec, ":")
+	if !ok || (source != "cookie" && source != "header") {
+		return r, fmt.Errorf("invalid audience rule %q: must start with cookie: or header:", rule)
+	}
+	r.source, r.name = source, spec
+
+	if i := strings.IndexAny(spec, "=~"); i >= 0 {
+		r.name, r.op, r.value = spec[:i], spec[i], spec[i+1:]
+		if r.op == '~' {
+			pattern, err := regexp.Compile(r.value)
+			if err != nil {
+				return r, fmt.Errorf("invalid audience rule %q: %w", rule, err)
+			}
+			r.pattern = pattern
+		}
+	}
+	if r.name == "" {
+		return r, fmt.Errorf("invalid audience rule %q: missing %s name", rule, source)
+	}
+	return r, nil
+}
+
+// matches reports whether a request satisfies the rule
+func (r audienceRule) matches(req *http.Request) bool {
+	var value string
+	var present bool
+	if r.source == "cookie" {
+		if cookie, err := req.Cookie(r.name); err == nil {
+			value, present = cookie.Value, true
+		}
+	} else {
+		values := req.Header.Values(r.name)
+		value, present = strings.Join(values, ", "), len(values) > 0
+	}
+
+	matched := present
+	switch r.op {
+	case '=':
+		matched = present && value == r.value
+	case '~':
+		matched = present && r.pattern.MatchString(value)
+	}
+	return matched != r.negate
+}
+
+// parseAudiences compiles each experiment's audience rules
+// Experiments with an invalid rule get a nil list, which matches no one,
+// so a typo can't widen an audience.
+func parseAudiences(audiences map[string][]string) map[string][]audienceRule {
+	if len(audiences) == 0 {
+		return nil
+	}
+
+	compiled := make(map[string][]audienceRule, len(audiences))
+	for experimentID, rules := range audiences {
+		parsed := make([]audienceRule, 0, len(rules))
+		for _, rule := range rules {
+			r, err := parseAudienceRule(rule)
+			if err != nil {
+				slog.Warn("Invalid audience rule - experiment disabled", "experiment_id", experimentID, "error", err)
+				parsed = nil
+				break
+			}
+			parsed = append(parsed, r)
+		}
+		compiled[experimentID] = parsed
+	}
+	return compiled
+}
+
+// matchesAudience reports whether the request satisfies every audience
+// rule of an experiment
+// Experiments without rules target everyone.
+func (m *ExperiFlowMiddleware) matchesAudience(req *http.Request, experimentID string) bool {
+	rules, ok := m.current(req).audiences[experimentID]
+	if !ok {
+		return true
+	}
+	if rules == nil {
+		return false
+	}
+
+	for _, rule := range rules {
+		if !rule.matches(req) {
+			return false
+		}
+	}
+	return true
+}
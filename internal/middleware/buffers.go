@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// maxPooledBuffer is the largest buffer capacity returned to the pool, so
+// one huge page doesn't pin its memory for the life of the process
+const maxPooledBuffer = 4 << 20
+
+// bufferPool holds reusable buffers for reading and rendering bodies
+var bufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// getBuffer takes an empty buffer from the pool
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer returns a buffer to the pool unless it has grown too large
+// The caller must not use the buffer or any slice of it afterwards.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// pooledBody is a response body backed by a pooled buffer
+// The reverse proxy writes the body after ModifyResponse returns, so the
+// buffer can only go back to the pool once the body is closed.
+type pooledBody struct {
+	io.Reader
+	buf    *bytes.Buffer
+	closer io.Closer // Unread remainder of the original body, if any
+}
+
+// newPooledBody serves data, which may be a slice of buf, returning buf to
+// the pool on Close
+func newPooledBody(buf *bytes.Buffer, data []byte) *pooledBody {
+	return &pooledBody{Reader: bytes.NewReader(data), buf: buf}
+}
+
+// Close releases the buffer and closes any remainder of the original body
+// Closing more than once is harmless.
+func (b *pooledBody) Close() error {
+	if b.buf != nil {
+		putBuffer(b.buf)
+		b.buf = nil
+	}
+	if b.closer != nil {
+		return b.closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// metaPrescanBytes is how much of the body is searched for <meta charset>
+const metaPrescanBytes = 1024
+
+// responseCharset determines the character encoding of an HTML body
+// The Content-Type charset wins over a <meta> declaration; with neither,
+// UTF-8 is assumed. Returns nil for UTF-8, which needs no conversion, and
+// ok=false if the declared charset is unknown.
+func responseCharset(resp *http.Response, body []byte) (encoding.Encoding, bool) {
+	label := ""
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil {
+		label = params["charset"]
+	}
+	if label == "" {
+		label = metaCharset(body)
+	}
+	if label == "" {
+		return nil, true
+	}
+
+	enc, name := charset.Lookup(label)
+	if enc == nil {
+		return nil, false
+	}
+	if name == "utf-8" || enc == unicode.UTF8 {
+		return nil, true
+	}
+	return enc, true
+}
+
+// metaCharset finds a charset declared by <meta charset> or
+// <meta http-equiv="Content-Type"> near the start of the document
+func metaCharset(body []byte) string {
+	if len(body) > metaPrescanBytes {
+		body = body[:metaPrescanBytes]
+	}
+
+	z := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			if string(name) != "meta" || !hasAttr {
+				continue
+			}
+
+			var httpEquiv, content string
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = z.TagAttr()
+				switch string(key) {
+				case "charset":
+					return strings.TrimSpace(string(val))
+				case "http-equiv":
+					httpEquiv = strings.ToLower(string(val))
+				case "content":
+					content = string(val)
+				}
+			}
+			if httpEquiv == "content-type" {
+				if _, params, err := mime.ParseMediaType(content); err == nil && params["charset"] != "" {
+					return params["charset"]
+				}
+			}
+		}
+	}
+}
+
+// decodeCharset converts a body from the given charset to UTF-8
+func decodeCharset(enc encoding.Encoding, body []byte) ([]byte, error) {
+	if enc == nil {
+		return body, nil
+	}
+	return enc.NewDecoder().Bytes(body)
+}
+
+// encodeCharset converts a UTF-8 body back to the given charset
+// Characters the charset can't represent become HTML numeric references
+func encodeCharset(enc encoding.Encoding, body []byte) ([]byte, error) {
+	if enc == nil {
+		return body, nil
+	}
+	return encoding.HTMLEscapeUnsupported(enc.NewEncoder()).Bytes(body)
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIP returns the IP of the client that sent the request
+// X-Forwarded-For and X-Real-IP are only honored when the request comes
+// from a trusted proxy; otherwise the RemoteAddr IP is used.
+func (m *ExperiFlowMiddleware) clientIP(req *http.Request) net.IP {
+	remote := remoteIP(req)
+	if remote == nil || !containsIP(m.current(req).trustedNets, remote) {
+		return remote
+	}
+
+	if ip := forwardedFor(req.Header, m.current(req).trustedNets); ip != nil {
+		return ip
+	}
+	if ip := net.ParseIP(strings.TrimSpace(req.Header.Get("X-Real-IP"))); ip != nil {
+		return ip
+	}
+	return remote
+}
+
+// Scheme returns the scheme ("http" or "https") the client used
+// X-Forwarded-Proto is only honored when the request comes from a trusted
+// proxy; otherwise the scheme follows the connection's TLS state.
+func (m *ExperiFlowMiddleware) Scheme(req *http.Request) string {
+	if remote := remoteIP(req); remote != nil && containsIP(m.current(req).trustedNets, remote) {
+		proto, _, _ := strings.Cut(req.Header.Get("X-Forwarded-Proto"), ",")
+		switch proto = strings.ToLower(strings.TrimSpace(proto)); proto {
+		case "http", "https":
+			return proto
+		}
+	}
+
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// forwardedFor walks the X-Forwarded-For chain from the nearest hop back,
+// returning the first address that isn't a trusted proxy
+// If every hop is trusted, the originating (leftmost) address is returned.
+// A hop that doesn't parse as an IP ends the walk, since nothing before it
+// can be trusted.
+func forwardedFor(header http.Header, trusted []*net.IPNet) net.IP {
+	var hops []string
+	for _, value := range header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+
+	var leftmost net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			return leftmost
+		}
+		if !containsIP(trusted, ip) {
+			return ip
+		}
+		leftmost = ip
+	}
+	return leftmost
+}
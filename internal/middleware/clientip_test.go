@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/experiflow/proxy/internal/config"
+)
+
+func TestForwardedFor(t *testing.T) {
+	trusted := parseCIDRs([]string{"10.0.0.0/8", "2001:db8::1"})
+	tests := []struct {
+		name string
+		xff  []string
+		want string // Empty for nil
+	}{
+		{"no header", nil, ""},
+		{"single client", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"client behind trusted hops", []string{"203.0.113.7, 10.0.0.2, 10.0.0.1"}, "203.0.113.7"},
+		{"nearest untrusted hop wins", []string{"203.0.113.7, 198.51.100.3, 10.0.0.1"}, "198.51.100.3"},
+		{"spoofed leftmost entry", []string{"1.2.3.4, 198.51.100.3"}, "198.51.100.3"},
+		{"spoofed entry behind trusted hop", []string{"1.2.3.4, 203.0.113.7, 10.0.0.1"}, "203.0.113.7"},
+		{"all hops trusted", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"several headers", []string{"203.0.113.7", "10.0.0.2, 10.0.0.1"}, "203.0.113.7"},
+		{"spaces around hops", []string{" 203.0.113.7 ,10.0.0.1 "}, "203.0.113.7"},
+		{"IPv6 hops", []string{"2001:db8::7, 2001:db8::1"}, "2001:db8::7"},
+		{"malformed nearest hop", []string{"203.0.113.7, garbage"}, ""},
+		{"malformed hop behind trusted hop", []string{"203.0.113.7, garbage, 10.0.0.1"}, "10.0.0.1"},
+		{"port not stripped", []string{"203.0.113.7:443, 10.0.0.1"}, "10.0.0.1"},
+		{"empty entry", []string{"203.0.113.7, , 10.0.0.1"}, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for _, value := range tt.xff {
+				header.Add("X-Forwarded-For", value)
+			}
+			got := forwardedFor(header, trusted)
+			if (got == nil && tt.want != "") || (got != nil && !got.Equal(net.ParseIP(tt.want))) {
+				t.Errorf("forwardedFor(%q) = %v, want %q", tt.xff, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	m := NewExperiFlowMiddleware(&config.Config{TrustedProxies: []string{"10.0.0.0/8"}}, nil)
+	defer m.Close()
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    string
+		realIP string
+		want   string
+	}{
+		{"untrusted remote ignores headers", "198.51.100.3:1234", "203.0.113.7", "203.0.113.8", "198.51.100.3"},
+		{"trusted remote uses X-Forwarded-For", "10.0.0.1:1234", "203.0.113.7", "203.0.113.8", "203.0.113.7"},
+		{"X-Real-IP without X-Forwarded-For", "10.0.0.1:1234", "", "203.0.113.8", "203.0.113.8"},
+		{"X-Real-IP after malformed X-Forwarded-For", "10.0.0.1:1234", "garbage", " 203.0.113.8 ", "203.0.113.8"},
+		{"malformed X-Real-IP", "10.0.0.1:1234", "", "garbage", "10.0.0.1"},
+		{"no headers", "10.0.0.1:1234", "", "", "10.0.0.1"},
+		{"remote without port", "198.51.100.3", "", "", "198.51.100.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remote
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := m.clientIP(req); !got.Equal(net.ParseIP(tt.want)) {
+				t.Errorf("clientIP = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
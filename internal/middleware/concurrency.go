@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// acquireTransformSlot waits up to the configured queue timeout for one of
+// the limited transform slots, reporting whether one was taken
+// Without a limit it always succeeds. Callers that get a slot must release it.
+func (m *ExperiFlowMiddleware) acquireTransformSlot(ctx context.Context, req *http.Request) bool {
+	if m.transformSlots == nil {
+		return true
+	}
+
+	select {
+	case m.transformSlots <- struct{}{}:
+		return true
+	default:
+	}
+
+	wait := m.config(req).TransformQueueTimeout
+	if wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case m.transformSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// releaseTransformSlot frees a slot taken by acquireTransformSlot
+func (m *ExperiFlowMiddleware) releaseTransformSlot() {
+	if m.transformSlots != nil {
+		<-m.transformSlots
+	}
+}
+
+// skipBusy logs and counts a response passed through because every
+// transform slot was taken
+func (m *ExperiFlowMiddleware) skipBusy(req *http.Request) error {
+	if m.config(req).EnableLogging {
+		slog.WarnContext(req.Context(), "Too many concurrent transforms - skipping transformation",
+			"limit", cap(m.transformSlots), "request_path", req.URL.Path)
+	}
+	m.metrics.TransformShed()
+	return &skipError{status: "skipped-busy"}
+}
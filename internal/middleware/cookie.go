@@ -0,0 +1,230 @@
+package middleware
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// assignmentDelimiter separates the variant ID from the variant key in the
+// assignment cookie value
+const assignmentDelimiter = "|"
+
+// assignmentsCookie holds every experiment's assignment in single cookie
+// mode, as <experiment>:<assignment> pairs separated by "&"
+const assignmentsCookie = "ef_assignments"
+
+// maxCookieBytes is the cookie size browsers are required to keep; larger
+// cookies may be dropped
+const maxCookieBytes = 4096
+
+// cookieMode controls how assignments are stored in cookies
+type cookieMode int
+
+const (
+	cookiePerExperiment cookieMode = iota // One ef_var_<experiment> cookie each
+	cookieSingle                          // All in ef_assignments
+)
+
+// parseCookieMode converts a COOKIE_MODE config value to its cookieMode
+func parseCookieMode(value string) (cookieMode, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "per-experiment", "":
+		return cookiePerExperiment, nil
+	case "single":
+		return cookieSingle, nil
+	}
+	return cookiePerExperiment, fmt.Errorf("invalid cookie mode %q: must be per-experiment or single", value)
+}
+
+// experimentCookie names an experiment's own assignment cookie
+func experimentCookie(experimentID string) string {
+	return fmt.Sprintf("ef_var_%s", experimentID)
+}
+
+// encodeAssignment builds the assignment cookie value for a variant
+// The key is query-escaped so variant names with spaces stay cookie-safe
+func encodeAssignment(variantID, variantKey string) string {
+	if variantKey == "" {
+		return variantID
+	}
+	return variantID + assignmentDelimiter + url.QueryEscape(variantKey)
+}
+
+// decodeAssignment parses an assignment cookie value into variant ID and key
+// Legacy cookies without a delimiter contain only the variant ID
+func decodeAssignment(value string) (string, string) {
+	variantID, escapedKey, found := strings.Cut(value, assignmentDelimiter)
+	if !found {
+		return value, ""
+	}
+
+	variantKey, err := url.QueryUnescape(escapedKey)
+	if err != nil {
+		return variantID, ""
+	}
+	return variantID, variantKey
+}
+
+// encodeAssignments builds the single cookie value from assignment cookie
+// values by experiment, sorted by experiment ID
+// Experiment and variant IDs are query-escaped, like variant keys, so
+// they can't be confused with the delimiters.
+func encodeAssignments(assignments map[string]string) string {
+	ids := make([]string, 0, len(assignments))
+	for id := range assignments {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	pairs := make([]string, len(ids))
+	for i, id := range ids {
+		variantID, variantKey := decodeAssignment(assignments[id])
+		pairs[i] = url.QueryEscape(id) + ":" + encodeAssignment(url.QueryEscape(variantID), variantKey)
+	}
+	return strings.Join(pairs, "&")
+}
+
+// decodeAssignments parses a single cookie value into assignment cookie
+// values by experiment, skipping malformed pairs
+func decodeAssignments(value string) map[string]string {
+	assignments := make(map[string]string)
+	for _, pair := range strings.Split(value, "&") {
+		escapedID, encoded, ok := strings.Cut(pair, ":")
+		if !ok {
+			continue
+		}
+		id, err := url.QueryUnescape(escapedID)
+		if err != nil || id == "" {
+			continue
+		}
+		escapedVariant, variantKey := decodeAssignment(encoded)
+		variantID, err := url.QueryUnescape(escapedVariant)
+		if err != nil || variantID == "" {
+			continue
+		}
+		assignments[id] = encodeAssignment(variantID, variantKey)
+	}
+	return assignments
+}
+
+// assignmentJar reads a request's assignment cookies and collects the
+// response's, storing them per experiment or in one cookie by COOKIE_MODE
+// In single cookie mode, assignments still in legacy per-experiment
+// cookies are moved into the single cookie, and the legacy cookies are
+// expired.
+type assignmentJar struct {
+	m    *ExperiFlowMiddleware
+	req  *http.Request
+	mode cookieMode
+
+	// Single cookie mode only
+	assignments map[string]string // Assignment cookie values by experiment
+	changed     bool              // assignments differs from the request's cookie
+	legacy      []string          // Legacy cookies to expire
+}
+
+// newAssignmentJar returns a jar holding the request's assignments
+func (m *ExperiFlowMiddleware) newAssignmentJar(req *http.Request) *assignmentJar {
+	jar := &assignmentJar{m: m, req: req, mode: m.current(req).cookieMode}
+	if jar.mode == cookieSingle {
+		jar.assignments = make(map[string]string)
+		if cookie, err := req.Cookie(assignmentsCookie); err == nil {
+			jar.assignments = decodeAssignments(cookie.Value)
+		}
+	}
+	return jar
+}
+
+// get returns the variant the request's cookies assign for an experiment,
+// or empty strings when there is none
+func (j *assignmentJar) get(experimentID string) (string, string) {
+	if value, ok := j.assignments[experimentID]; ok {
+		return decodeAssignment(value)
+	}
+
+	cookie, err := j.req.Cookie(experimentCookie(experimentID))
+	if err != nil || cookie.Value == "" {
+		return "", ""
+	}
+	variantID, variantKey := decodeAssignment(cookie.Value)
+	if variantID != "" && j.mode == cookieSingle {
+		j.assignments[experimentID] = encodeAssignment(variantID, variantKey)
+		j.changed = true
+		j.legacy = append(j.legacy, cookie.Name)
+	}
+	return variantID, variantKey
+}
+
+// set records a new assignment, setting its cookie right away in
+// per-experiment mode
+func (j *assignmentJar) set(resp *http.Response, experimentID, variantID, variantKey string) {
+	value := encodeAssignment(variantID, variantKey)
+	if j.mode == cookiePerExperiment {
+		cookie := j.m.newAssignmentCookie(j.req, experimentCookie(experimentID), value)
+		resp.Header.Add("Set-Cookie", cookie.String())
+		return
+	}
+	j.assignments[experimentID] = value
+	j.changed = true
+}
+
+// save sets the single cookie when its assignments changed, keeping only
+// active experiments, and expires migrated legacy cookies
+func (j *assignmentJar) save(resp *http.Response, active []string) {
+	if j.mode != cookieSingle || !j.changed {
+		return
+	}
+	for id := range j.assignments {
+		if !slices.Contains(active, id) {
+			delete(j.assignments, id)
+		}
+	}
+
+	cookie := j.m.newAssignmentCookie(j.req, assignmentsCookie, encodeAssignments(j.assignments))
+	if len(cookie.Value) > maxCookieBytes && j.m.config(j.req).EnableLogging {
+		slog.WarnContext(j.req.Context(), "Assignment cookie is too large for some browsers",
+			"bytes", len(cookie.Value), "experiments", len(j.assignments))
+	}
+	resp.Header.Add("Set-Cookie", cookie.String())
+
+	for _, name := range j.legacy {
+		expired := j.m.newAssignmentCookie(j.req, name, "")
+		expired.MaxAge = -1
+		resp.Header.Add("Set-Cookie", expired.String())
+	}
+}
+
+// parseSameSite converts a SameSite config value to its http.SameSite mode
+func parseSameSite(value string) (http.SameSite, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	case "default", "":
+		return http.SameSiteDefaultMode, nil
+	}
+	return http.SameSiteLaxMode, fmt.Errorf("invalid SameSite value %q: must be lax, strict, none, or default", value)
+}
+
+// newAssignmentCookie builds an assignment cookie from the cookie config
+// The cookie is always Secure when the client connected over HTTPS.
+func (m *ExperiFlowMiddleware) newAssignmentCookie(req *http.Request, name, value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		MaxAge:   int(m.config(req).CookieMaxAge.Seconds()),
+		Path:     "/",
+		Domain:   m.config(req).CookieDomain,
+		Secure:   m.config(req).CookieSecure || m.Scheme(req) == "https",
+		HttpOnly: true,
+		SameSite: m.current(req).sameSite,
+	}
+}
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+)
+
+// cspSources holds what the page's Content-Security-Policy allows for
+// inline scripts or styles
+type cspSources struct {
+	nonce  string // First 'nonce-...' value, if any
+	hashed bool   // Uses 'sha256-...' style hashes
+}
+
+// parseCSP extracts the nonce and hash sources for scripts and styles from
+// the Content-Security-Policy headers
+// script-src and style-src fall back to default-src, as in browsers.
+func parseCSP(header http.Header) (script, style cspSources) {
+	directives := make(map[string][]string)
+	for _, policy := range header.Values("Content-Security-Policy") {
+		for _, directive := range strings.Split(policy, ";") {
+			fields := strings.Fields(directive)
+			if len(fields) == 0 {
+				continue
+			}
+			name := strings.ToLower(fields[0])
+			// The first occurrence of a directive wins
+			if _, ok := directives[name]; !ok {
+				directives[name] = fields[1:]
+			}
+		}
+	}
+
+	sources := func(name string) cspSources {
+		values, ok := directives[name]
+		if !ok {
+			values = directives["default-src"]
+		}
+
+		var result cspSources
+		for _, value := range values {
+			value = strings.Trim(value, "'")
+			lower := strings.ToLower(value)
+			switch {
+			case strings.HasPrefix(lower, "nonce-") && result.nonce == "":
+				result.nonce = value[len("nonce-"):]
+			case strings.HasPrefix(lower, "sha256-"), strings.HasPrefix(lower, "sha384-"), strings.HasPrefix(lower, "sha512-"):
+				result.hashed = true
+			}
+		}
+		return result
+	}
+	return sources("script-src"), sources("style-src")
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+)
+
+// maxDebugHeaderBytes bounds X-EF-Debug-Ops, since proxies and CDNs reject
+// oversized response headers; operations past the limit are left out
+const maxDebugHeaderBytes = 8 << 10
+
+// debugOp describes one operation in X-EF-Debug-Ops
+type debugOp struct {
+	ExperimentID string `json:"experiment_id"`
+	Index        int    `json:"index"`
+	Type         string `json:"type"`
+	Selector     string `json:"selector"`
+	Matched      int    `json:"matched"`
+	Applied      int    `json:"applied"`
+	Error        string `json:"error,omitempty"`
+	Conflicts    []int  `json:"conflicts,omitempty"` // Operations it overrode, by position in the spec
+}
+
+// isDebug reports whether the response should list its applied operations,
+// either for every request or for requests carrying the debug secret
+func (m *ExperiFlowMiddleware) isDebug(req *http.Request) bool {
+	if m.config(req).DebugOps {
+		return true
+	}
+	secret := m.config(req).DebugSecret
+	if secret == "" {
+		return false
+	}
+	given := req.Header.Get("X-EF-Debug")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(secret)) == 1
+}
+
+// setDebugHeader sets X-EF-Debug-Ops to a JSON array of every operation's
+// outcome across the applied experiments
+func setDebugHeader(resp *http.Response, results []*experimentResult) {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+entries:
+	for _, result := range results {
+		for _, res := range result.opResults {
+			op := debugOp{
+				ExperimentID: result.experimentID,
+				Index:        res.Index,
+				Type:         res.Type,
+				Selector:     res.Selector,
+				Matched:      res.Matched,
+				Conflicts:    res.Conflicts,
+			}
+			if res.Err != nil {
+				op.Error = res.Err.Error()
+			} else {
+				op.Applied = res.Matched - res.Skipped
+			}
+
+			entry, err := json.Marshal(op)
+			if err != nil {
+				continue
+			}
+			if buf.Len()+len(entry)+2 > maxDebugHeaderBytes {
+				break entries
+			}
+			if buf.Len() > 1 {
+				buf.WriteByte(',')
+			}
+			buf.Write(entry)
+		}
+	}
+	buf.WriteByte(']')
+	resp.Header.Set("X-EF-Debug-Ops", buf.String())
+}
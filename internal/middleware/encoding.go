@@ -0,0 +1,193 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Content encodings the middleware can decode and re-encode
+const (
+	encodingIdentity = ""
+	encodingGzip     = "gzip"
+	encodingDeflate  = "deflate"
+	encodingBrotli   = "br"
+)
+
+// contentEncoding returns the normalized Content-Encoding of a response
+func contentEncoding(resp *http.Response) string {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "identity" {
+		return encodingIdentity
+	}
+	return encoding
+}
+
+// isSupportedEncoding reports whether bodies with this encoding can be transformed
+func isSupportedEncoding(encoding string) bool {
+	switch encoding {
+	case encodingIdentity, encodingGzip, encodingDeflate, encodingBrotli:
+		return true
+	}
+	return false
+}
+
+// decodeBody decompresses a response body according to its Content-Encoding
+func decodeBody(encoding string, body []byte) ([]byte, error) {
+	if encoding == encodingIdentity {
+		return body, nil
+	}
+	reader, err := newDecoder(encoding, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s body: %w", encoding, err)
+	}
+	return decoded, nil
+}
+
+// newDecoder returns a reader decompressing r according to its
+// Content-Encoding
+func newDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	var reader io.ReadCloser
+	var err error
+
+	switch encoding {
+	case encodingIdentity:
+		return io.NopCloser(r), nil
+	case encodingGzip:
+		reader, err = gzip.NewReader(r)
+	case encodingDeflate:
+		// Most servers send zlib-wrapped deflate, but some send raw deflate
+		buffered := bufio.NewReader(r)
+		if header, _ := buffered.Peek(2); isZlibHeader(header) {
+			reader, err = zlib.NewReader(buffered)
+		} else {
+			reader = flate.NewReader(buffered)
+		}
+	case encodingBrotli:
+		reader = io.NopCloser(brotli.NewReader(r))
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create %s reader: %w", encoding, err)
+	}
+	return reader, nil
+}
+
+// isZlibHeader reports whether a stream starts with a zlib header: deflate
+// with a valid window size and header checksum
+func isZlibHeader(header []byte) bool {
+	return len(header) == 2 && header[0]&0x0f == 8 && header[0]>>4 <= 7 &&
+		(uint16(header[0])<<8|uint16(header[1]))%31 == 0
+}
+
+// encodeBody compresses a body with the given Content-Encoding
+func encodeBody(encoding string, body []byte) ([]byte, error) {
+	if encoding == encodingIdentity {
+		return body, nil
+	}
+	var buf bytes.Buffer
+	writer, err := newEncoder(encoding, &buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := writer.Write(body); err != nil {
+		return nil, fmt.Errorf("encode %s body: %w", encoding, err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("encode %s body: %w", encoding, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// streamEncoder compresses a body as it is written; Flush sends on what
+// has been compressed so far
+type streamEncoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// newEncoder returns a writer compressing to w with the given
+// Content-Encoding
+func newEncoder(encoding string, w io.Writer) (streamEncoder, error) {
+	switch encoding {
+	case encodingIdentity:
+		return identityEncoder{w}, nil
+	case encodingGzip:
+		return gzip.NewWriter(w), nil
+	case encodingDeflate:
+		return zlib.NewWriter(w), nil
+	case encodingBrotli:
+		return brotli.NewWriter(w), nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+}
+
+// identityEncoder writes straight through
+type identityEncoder struct {
+	io.Writer
+}
+
+func (identityEncoder) Flush() error { return nil }
+func (identityEncoder) Close() error { return nil }
+
+// acceptsEncoding reports whether a request's Accept-Encoding allows a
+// content encoding
+// Identity is always acceptable, as is anything when the header is absent.
+func acceptsEncoding(req *http.Request, encoding string) bool {
+	values := req.Header.Values("Accept-Encoding")
+	if encoding == encodingIdentity || len(values) == 0 {
+		return true
+	}
+
+	wildcard := false
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			coding, params, _ := strings.Cut(part, ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != encoding && coding != "*" {
+				continue
+			}
+
+			accepted := true
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				weight, err := strconv.ParseFloat(q, 64)
+				accepted = err == nil && weight > 0
+			}
+			if coding == encoding {
+				return accepted
+			}
+			wildcard = accepted
+		}
+	}
+	return wildcard
+}
+
+// headerHasToken reports whether a comma-separated header lists a token,
+// compared case-insensitively
+func headerHasToken(header http.Header, key, token string) bool {
+	for _, value := range header.Values(key) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
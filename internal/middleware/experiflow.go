@@ -3,205 +3,1110 @@ package middleware
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"mime"
 	"net/http"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/experiflow/proxy/internal/config"
+	"github.com/experiflow/proxy/internal/metrics"
 	"github.com/experiflow/proxy/internal/transform"
 	"github.com/experiflow/proxy/internal/variant"
 	"golang.org/x/net/html"
+	"golang.org/x/text/encoding"
 )
 
 // ExperiFlowMiddleware handles A/B testing transformations
 type ExperiFlowMiddleware struct {
-	config       *config.Config
-	client       *transform.Client
-	assigner     *variant.Assigner
-	experiments  map[string]bool // Active experiment IDs
+	client  *transform.Client
+	metrics *metrics.Metrics // nil when metrics are disabled
+	store   variant.Store    // nil without an assignment store
+
+	// Background assignment store writes, which Close waits for
+	storeMu     sync.Mutex
+	storeWrites sync.WaitGroup
+	storeClosed bool
+
+	// Live configuration, swapped as a whole by Reload
+	state atomic.Pointer[settings]
+
+	// Bounds concurrent body transforms; nil when unlimited
+	transformSlots chan struct{}
+
+	// Experiments fetched from the API, merged with the static list
+	mu                 sync.RWMutex
+	dynamicExperiments []string
+	dynamicExpiresAt   time.Time
+	done               chan struct{}
+	closeOnce          sync.Once
+}
+
+// experimentResult holds the resolved variant and operations for one experiment
+type experimentResult struct {
+	experimentID string
+	variantKey   string
+	operations   []transform.Operation
+	headers      []transform.HeaderOperation
+	opResults    []transform.OpResult // Filled in once operations are applied
+	stale        bool                 // The spec is an expired copy, served after a fetch timed out
+	applied      bool                 // Listed in the page's ef-applied marker, so left alone
+	elapsed      time.Duration        // Spent resolving and applying this experiment alone
+}
+
+// outcome returns the status reported for a transformed experiment
+func (r *experimentResult) outcome() string {
+	if r.applied {
+		return "already-applied"
+	}
+	if r.stale {
+		return "stale"
+	}
+	return "hit"
+}
+
+// succeeded returns how many operations applied without error
+func (r *experimentResult) succeeded() int {
+	count := 0
+	for _, res := range r.opResults {
+		if res.Err == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// unmatched returns how many operations failed because their selector
+// matched no elements
+func (r *experimentResult) unmatched() int {
+	count := 0
+	for _, res := range r.opResults {
+		if res.Unmatched() {
+			count++
+		}
+	}
+	return count
+}
+
+// unknown returns how many operations failed because their type isn't supported
+func (r *experimentResult) unknown() int {
+	count := 0
+	for _, res := range r.opResults {
+		if res.Unknown() {
+			count++
+		}
+	}
+	return count
+}
+
+// conflicts returns how many operations overrode an earlier operation's
+// change to the same element
+func (r *experimentResult) conflicts() int {
+	count := 0
+	for _, res := range r.opResults {
+		if len(res.Conflicts) > 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// skipError abandons transformation without treating it as a failure
+// The original response passes through and status is reported in X-EF-Transform
+type skipError struct {
+	status string
+}
+
+func (e *skipError) Error() string {
+	return "transformation skipped: " + e.status
 }
 
 // NewExperiFlowMiddleware creates a new middleware instance
 func NewExperiFlowMiddleware(cfg *config.Config, experimentIDs []string) *ExperiFlowMiddleware {
-	experiments := make(map[string]bool)
-	for _, id := range experimentIDs {
-		experiments[id] = true
+	var recorder *metrics.Metrics
+	if cfg.EnableMetrics {
+		recorder = metrics.New()
+	}
+
+	m := &ExperiFlowMiddleware{
+		metrics: recorder,
+		store:   newStore(cfg),
+		done:    make(chan struct{}),
+	}
+	m.client = transform.NewClient(cfg.APIBaseURL, cfg.EdgeToken, cfg.APITimeout, transform.ClientOptions{
+		SpecCacheSize:    cfg.SpecCacheSize,
+		SpecStaleGrace:   cfg.SpecStaleGrace,
+		Retries:          cfg.APIRetries,
+		RetryBackoff:     cfg.APIRetryBackoff,
+		BreakerThreshold: cfg.BreakerThreshold,
+		BreakerCooldown:  cfg.BreakerCooldown,
+		RateLimit:        cfg.APIRateLimit,
+		RateBurst:        cfg.APIRateBurst,
+		RateLimitWait:    cfg.APIRateLimitWait,
+
+		VariantsTTL:         cfg.VariantsCacheTTL,
+		VariantsNegativeTTL: cfg.VariantsNegativeTTL,
+		OnVariants:          m.variantsLoaded,
+
+		MaxIdleConns:        cfg.APIMaxIdleConns,
+		MaxIdleConnsPerHost: cfg.APIMaxIdleConnsPerHost,
+		IdleConnTimeout:     cfg.APIIdleConnTimeout,
+	})
+	m.state.Store(newSettings(cfg, experimentIDs))
+	if cfg.MaxConcurrentTransforms > 0 {
+		m.transformSlots = make(chan struct{}, cfg.MaxConcurrentTransforms)
 	}
 
-	return &ExperiFlowMiddleware{
-		config:      cfg,
-		client:      transform.NewClient(cfg.APIBaseURL, cfg.EdgeToken, cfg.Timeout),
-		assigner:    variant.NewAssigner("production-salt"), // TODO: Move to config
-		experiments: experiments,
+	if cfg.ActiveExperimentsRefresh > 0 {
+		go m.refreshExperiments(cfg.ActiveExperimentsRefresh)
 	}
+
+	return m
+}
+
+// Close stops background work such as the active experiment refresh and
+// releases idle API and assignment store connections
+// Pending assignment store writes are given up to the store timeout to
+// finish first.
+func (m *ExperiFlowMiddleware) Close() {
+	m.closeOnce.Do(func() {
+		close(m.done)
+		m.client.Close()
+		m.waitStoreWrites()
+		if closer, ok := m.store.(io.Closer); ok {
+			closer.Close()
+		}
+	})
+}
+
+// FlushCaches drops cached API responses for one experiment, or for all
+// when experimentID is empty, and returns the number of entries removed
+func (m *ExperiFlowMiddleware) FlushCaches(experimentID string) int {
+	return m.client.FlushCaches(experimentID)
+}
+
+// PingAPI checks that the ExperiFlow API is reachable
+func (m *ExperiFlowMiddleware) PingAPI(ctx context.Context) error {
+	return m.client.Ping(ctx)
+}
+
+// MetricsHandler serves the Prometheus metrics, or nil when metrics are disabled
+func (m *ExperiFlowMiddleware) MetricsHandler() http.Handler {
+	if m.metrics == nil {
+		return nil
+	}
+	return m.metrics.Handler()
 }
 
 // ModifyResponse transforms the HTML response
+// The body is parsed once and every active experiment's operations are
+// applied to the same document before it is rendered back. The settings
+// are pinned to the request first, so a reload can't mix two configurations
+// in one response.
 func (m *ExperiFlowMiddleware) ModifyResponse(resp *http.Response, req *http.Request) error {
 	startTime := time.Now()
+	req = m.pinSettings(req)
+	m.rewriteCookieDomains(resp, req)
+
+	// Engineers with the bypass secret get the origin page as is
+	if m.isBypassed(req) {
+		resp.Header.Set("X-EF-Bypass", "applied")
+		return nil
+	}
+
+	// Only transform HTML responses; 304s have no body and the client
+	// already holds the transformed copy
+	experiments := m.activeExperiments(req)
+	if resp.StatusCode == http.StatusNotModified || len(experiments) == 0 || !m.isHTML(resp, req) {
+		return nil
+	}
 
-	// Only transform HTML responses
-	if !m.isHTML(resp) {
+	// Form posts, redirects, and error pages pass through unless configured
+	if skip := m.transformSkip(resp, req); skip != "" {
+		resp.Header.Set("X-EF-Transform", skip)
 		return nil
 	}
+	defer func() {
+		m.metrics.TransformDuration(time.Since(startTime))
+	}()
 
-	// For each active experiment, apply transformations
-	for experimentID := range m.experiments {
-		if err := m.applyExperiment(resp, req, experimentID, startTime); err != nil {
-			if m.config.EnableLogging {
-				log.Printf("[ExperiFlow] Error applying experiment %s: %v", experimentID, err)
+	// Crawlers get the original page and aren't bucketed
+	if m.isBot(req) {
+		resp.Header.Set("X-EF-Bot", "1")
+		return nil
+	}
+
+	// Users in the global holdback never see any experiment
+	if m.inHoldback(req) {
+		resp.Header.Set("X-EF-Holdback", "1")
+		return nil
+	}
+
+	// Only the sampled share of users gets transformed
+	if !m.isSampled(req) {
+		resp.Header.Set("X-EF-Sampled", "0")
+		return nil
+	}
+
+	// 1. Resolve variants and transform specs for each active experiment,
+	// all within the transform budget
+	ctx, cancel := context.WithTimeout(req.Context(), m.config(req).TransformBudget)
+	defer cancel()
+
+	var results []*experimentResult
+	jar := m.newAssignmentJar(req)
+	for _, experimentID := range experiments {
+		result, err := m.resolveExperiment(ctx, resp, req, jar, experimentID, startTime)
+		if err != nil {
+			if m.config(req).EnableLogging {
+				slog.ErrorContext(req.Context(), "Error applying experiment",
+					"experiment_id", experimentID, "request_path", req.URL.Path, "error", err)
 			}
+			m.metrics.TransformOutcome(experimentID, "", "miss")
 
-			// Fail open: continue without transformation if configured
-			if m.config.FailOpen {
-				return nil
+			// Fail open: continue without this experiment if configured
+			if m.failsOpen(req, err) {
+				m.metrics.FailOpen()
+				continue
 			}
 			return err
 		}
+		if result != nil {
+			results = append(results, result)
+		}
+	}
+	jar.save(resp, experiments)
+
+	// Nothing to transform (all control variants)
+	if len(results) == 0 {
+		return nil
+	}
+
+	// Leave experiments a proxy in front of this one already applied. Its
+	// X-EF-Applied header also covers experiments that only change headers,
+	// which leave no marker in the page.
+	m.skipApplied(req, results, appliedHeader(resp.Header))
+
+	// 2. Transform the body once for all experiments, or only report the
+	// changes in preview mode
+	transformBody, status := m.transformBody, "hit"
+	if m.isPreviewRequest(req) {
+		transformBody, status = m.previewBody, "preview"
+	}
+	streamed := status == "hit" && anyOperations(results) && m.streamBody(resp, req, results, startTime)
+	var err error
+	switch {
+	case !anyOperations(results) || streamed:
+		// Experiments that only change headers leave the body alone, and
+		// streamed bodies are transformed as the proxy copies them
+	case m.acquireTransformSlot(ctx, req):
+		err = transformBody(resp, req, results)
+		m.releaseTransformSlot()
+	default:
+		err = m.skipBusy(req)
+	}
+	if err != nil {
+		var skip *skipError
+		if errors.As(err, &skip) {
+			resp.Header.Set("X-EF-Transform", skip.status)
+			return nil
+		}
+
+		if m.config(req).EnableLogging {
+			slog.ErrorContext(req.Context(), "Error transforming response", "request_path", req.URL.Path, "error", err)
+		}
+		for _, result := range results {
+			m.metrics.TransformOutcome(result.experimentID, result.variantKey, "miss")
+		}
+		if m.config(req).FailOpen {
+			m.metrics.FailOpen()
+			return nil
+		}
+		return err
+	}
+
+	// 3. Add observability headers
+	if status == "preview" {
+		for _, result := range results {
+			m.addHeaders(resp, result.experimentID, result.variantKey, status, startTime, result.elapsed)
+		}
+		return nil
+	}
+
+	for _, result := range results {
+		if !result.applied {
+			m.applyHeaders(resp, req, result)
+		}
+		m.addHeaders(resp, result.experimentID, result.variantKey, result.outcome(), startTime, result.elapsed)
+		m.metrics.TransformOutcome(result.experimentID, result.variantKey, result.outcome())
+	}
+	if ids := appliedIDs(results); len(ids) > 0 && (streamed || anyChanged(results) || anyHeaders(results)) {
+		resp.Header.Set("X-EF-Applied", strings.Join(ids, ","))
+	}
+	if streamed {
+		// Operations are reported in trailers once the body is done
+		return nil
+	}
+	m.reportOperations(resp.Header, req, results, startTime)
+	if m.isDebug(req) {
+		setDebugHeader(resp, results)
 	}
 
 	return nil
 }
 
-// applyExperiment applies a single experiment's transformations
-func (m *ExperiFlowMiddleware) applyExperiment(resp *http.Response, req *http.Request, experimentID string, startTime time.Time) error {
-	ctx, cancel := context.WithTimeout(context.Background(), m.config.Timeout)
-	defer cancel()
+// reportOperations records the outcome of every experiment's operations
+// in metrics and logs, and as X-EF-Ops and friends in header
+func (m *ExperiFlowMiddleware) reportOperations(header http.Header, req *http.Request, results []*experimentResult, startTime time.Time) {
+	succeeded, total, unmatched, unknown := 0, 0, 0, 0
+	for _, result := range results {
+		if result.applied {
+			continue
+		}
+		applied, missed, unsupported := result.succeeded(), result.unmatched(), result.unknown()
+		succeeded += applied
+		total += len(result.opResults)
+		unmatched += missed
+		unknown += unsupported
+
+		m.metrics.OperationsApplied(result.experimentID, result.variantKey, applied)
+		m.metrics.OperationFailures(result.experimentID, len(result.opResults)-applied-missed-unsupported)
+		m.metrics.OperationsUnmatched(result.experimentID, missed)
+		m.metrics.OperationsUnknown(result.experimentID, unsupported)
+		m.metrics.OperationConflicts(result.experimentID, result.conflicts())
+
+		if m.config(req).EnableLogging {
+			for _, res := range result.opResults {
+				if res.Unmatched() {
+					slog.WarnContext(req.Context(), "Selector matched no elements",
+						"experiment_id", result.experimentID,
+						"operation_index", res.Index,
+						"type", res.Type,
+						"selector", res.Selector,
+						"request_path", req.URL.Path)
+				} else if res.Unknown() {
+					slog.WarnContext(req.Context(), "Unknown operation type",
+						"experiment_id", result.experimentID,
+						"operation_index", res.Index,
+						"type", res.Type,
+						"request_path", req.URL.Path)
+				} else if res.Err != nil {
+					slog.WarnContext(req.Context(), "Failed to apply operation",
+						"experiment_id", result.experimentID,
+						"operation_index", res.Index,
+						"type", res.Type,
+						"selector", res.Selector,
+						"error", res.Err,
+						"request_path", req.URL.Path)
+				}
+				if len(res.Conflicts) > 0 {
+					slog.WarnContext(req.Context(), "Operation overrides earlier operations",
+						"experiment_id", result.experimentID,
+						"operation_index", res.Index,
+						"type", res.Type,
+						"selector", res.Selector,
+						"overridden", res.Conflicts,
+						"request_path", req.URL.Path)
+				}
+			}
+			slog.InfoContext(req.Context(), "Applied transformations",
+				"experiment_id", result.experimentID,
+				"variant_key", result.variantKey,
+				"status", result.outcome(),
+				"operations", applied,
+				"duration_ms", time.Since(startTime).Milliseconds(),
+				"request_path", req.URL.Path)
+		}
+	}
+	header.Set("X-EF-Ops", fmt.Sprintf("%d/%d", succeeded, total))
+	if unmatched > 0 {
+		header.Set("X-EF-Unmatched", fmt.Sprintf("%d", unmatched))
+	}
+	if unknown > 0 {
+		header.Set("X-EF-Unknown-Ops", fmt.Sprintf("%d", unknown))
+	}
+}
+
+// anyOperations reports whether any experiment has DOM operations to apply
+func anyOperations(results []*experimentResult) bool {
+	for _, result := range results {
+		if len(result.operations) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// applyHeaders applies an experiment's header operations to the response
+// Rejected operations are logged and counted as failed operations.
+func (m *ExperiFlowMiddleware) applyHeaders(resp *http.Response, req *http.Request, result *experimentResult) {
+	errs := transform.ApplyHeaderOperations(resp.Header, result.headers)
+	if len(errs) == 0 {
+		return
+	}
+	m.metrics.OperationFailures(result.experimentID, len(errs))
+	if m.config(req).EnableLogging {
+		for _, err := range errs {
+			slog.WarnContext(req.Context(), "Failed to apply header operation",
+				"experiment_id", result.experimentID,
+				"error", err,
+				"request_path", req.URL.Path)
+		}
+	}
+}
+
+// resolveExperiment assigns a variant and fetches its transform spec
+// Returns nil for control variants, which have no operations to apply,
+// for experiments that don't target the request path or audience, for
+// experiments the user was excluded from by an exclusion group, and for
+// specs whose format version isn't supported or that have too many
+// operations
+func (m *ExperiFlowMiddleware) resolveExperiment(ctx context.Context, resp *http.Response, req *http.Request, jar *assignmentJar, experimentID string, startTime time.Time) (*experimentResult, error) {
+	if !m.matchesPath(req, experimentID) || !m.matchesAudience(req, experimentID) ||
+		!m.inExclusionGroups(req, experimentID) {
+		return nil, nil
+	}
+	resolveStart := time.Now()
 
 	// 1. Get or assign variant
-	cookieName := fmt.Sprintf("ef_var_%s", experimentID)
-	variantID, variantKey, isNew := m.getOrAssignVariant(ctx, req, experimentID, cookieName)
-	if variantID == "" {
-		return fmt.Errorf("failed to assign variant")
+	assigned := m.getOrAssignVariant(ctx, req, jar, experimentID)
+	if assigned.variantID == "" {
+		return nil, fmt.Errorf("failed to assign variant")
 	}
+	variantKey := assigned.variantKey
 
 	// 2. Set cookie if new assignment
-	if isNew {
-		cookie := &http.Cookie{
-			Name:     cookieName,
-			Value:    variantID,
-			MaxAge:   30 * 24 * 60 * 60, // 30 days
-			Path:     "/",
-			HttpOnly: true,
-			SameSite: http.SameSiteLaxMode,
+	if assigned.isNew {
+		jar.set(resp, experimentID, assigned.variantID, variantKey)
+	}
+
+	// Control never changes the page, so don't fetch its spec
+	if assigned.isControl {
+		m.serveControl(resp, req, experimentID, variantKey, startTime, time.Since(resolveStart))
+		return nil, nil
+	}
+
+	// 3. Fetch transform spec, unless it came with the assignment
+	spec, stale := assigned.spec, false
+	if spec == nil {
+		var err error
+		spec, err = m.client.GetTransformSpec(ctx, experimentID, assigned.variantID)
+		if err != nil {
+			m.metrics.SpecFetchError(experimentID)
+			if spec, err = m.specAfterError(req, experimentID, assigned.variantID, err); err != nil {
+				return nil, err
+			}
+			stale = true
 		}
-		// Add cookie to response headers
-		if resp.Header.Get("Set-Cookie") == "" {
-			resp.Header.Set("Set-Cookie", cookie.String())
-		} else {
-			resp.Header.Add("Set-Cookie", cookie.String())
+	}
+	// Returning users' variants would otherwise report as "other" until
+	// this instance fetches the variant list
+	if spec.VariantKey != "" {
+		m.metrics.RegisterVariants(experimentID, []string{spec.VariantKey})
+	}
+
+	// Skip specs in a format this proxy can't apply correctly
+	if err := spec.CheckVersion(); err != nil {
+		if m.config(req).EnableLogging {
+			slog.WarnContext(req.Context(), "Skipping experiment with unsupported transform spec",
+				"experiment_id", experimentID,
+				"variant_key", variantKey,
+				"version", spec.Version,
+				"request_path", req.URL.Path)
 		}
+		m.metrics.UnsupportedSpec(experimentID)
+		m.metrics.TransformOutcome(experimentID, variantKey, "miss")
+		return nil, nil
 	}
 
-	// 3. Fetch transform spec
-	spec, err := m.client.GetTransformSpec(ctx, experimentID, variantID)
-	if err != nil {
-		return fmt.Errorf("fetch transform spec: %w", err)
+	// Reject oversized specs up front rather than failing the whole page
+	if limit := m.config(req).MaxOperations; limit > 0 && len(spec.Operations) > limit {
+		if m.config(req).EnableLogging {
+			slog.WarnContext(req.Context(), "Skipping experiment with too many operations",
+				"experiment_id", experimentID,
+				"variant_key", variantKey,
+				"operations", len(spec.Operations),
+				"limit", limit,
+				"request_path", req.URL.Path)
+		}
+		m.metrics.OversizedSpec(experimentID)
+		m.metrics.TransformOutcome(experimentID, variantKey, "miss")
+		return nil, nil
 	}
 
 	// If no operations (control variant), skip transformation
-	if len(spec.Operations) == 0 {
-		if m.config.EnableLogging {
-			log.Printf("[ExperiFlow] Control variant - no transformations applied")
+	if len(spec.Operations) == 0 && len(spec.Headers) == 0 {
+		m.serveControl(resp, req, experimentID, variantKey, startTime, time.Since(resolveStart))
+		return nil, nil
+	}
+
+	return &experimentResult{
+		experimentID: experimentID,
+		variantKey:   variantKey,
+		operations:   spec.ScopedOperations(),
+		headers:      spec.Headers,
+		stale:        stale,
+		elapsed:      time.Since(resolveStart),
+	}, nil
+}
+
+// serveControl records a control outcome, leaving the page untransformed
+func (m *ExperiFlowMiddleware) serveControl(resp *http.Response, req *http.Request, experimentID, variantKey string, startTime time.Time, elapsed time.Duration) {
+	if m.config(req).EnableLogging {
+		slog.InfoContext(req.Context(), "Control variant - no transformations applied",
+			"experiment_id", experimentID,
+			"variant_key", variantKey,
+			"status", "control",
+			"duration_ms", time.Since(startTime).Milliseconds(),
+			"request_path", req.URL.Path)
+	}
+	m.addHeaders(resp, experimentID, variantKey, "control", startTime, elapsed)
+	m.metrics.TransformOutcome(experimentID, variantKey, "control")
+}
+
+// transformBody reads, parses, transforms, and rewrites the response body
+// The original body is restored if any step fails, and kept if nothing changed
+func (m *ExperiFlowMiddleware) transformBody(resp *http.Response, req *http.Request, results []*experimentResult) error {
+	// 1. Read and parse the response body
+	doc, format, err := m.parseBody(resp, req)
+	if err != nil {
+		return err
+	}
+
+	// 2. Apply every experiment's transformations to the shared document,
+	// except those an earlier pass already applied
+	m.skipApplied(req, results, transform.AppliedExperiments(doc))
+	opts := m.applyOptions(resp, req)
+	for _, result := range results {
+		if result.applied {
+			continue
 		}
-		m.addHeaders(resp, experimentID, variantKey, "control", startTime)
+		applyStart := time.Now()
+		opResults, err := transform.ApplyTransformations(doc, result.operations, opts)
+		if err != nil {
+			return fmt.Errorf("apply transformations for %s: %w", result.experimentID, err)
+		}
+		result.opResults = opResults
+		result.elapsed += time.Since(applyStart)
+	}
+
+	// Keep the origin's bytes when no operation changed anything, since
+	// re-rendering can still reorder tags or normalize attributes
+	if !anyChanged(results) {
 		return nil
 	}
+	if _, err := transform.ApplyTransformations(doc, []transform.Operation{transform.MarkApplied(appliedIDs(results))}, opts); err != nil {
+		return fmt.Errorf("mark applied experiments: %w", err)
+	}
+
+	// 3. Render transformed HTML
+	out := getBuffer()
+	if err := html.Render(out, doc); err != nil {
+		putBuffer(out)
+		return fmt.Errorf("render HTML: %w", err)
+	}
 
-	// 4. Read response body
-	body, err := io.ReadAll(resp.Body)
+	// 4. Update response with transformed HTML, re-encoded like the origin's
+	transformedBody, err := encodeCharset(format.charset, out.Bytes())
+	if err != nil {
+		putBuffer(out)
+		return fmt.Errorf("encode charset: %w", err)
+	}
+	transformedBody, err = m.encodeForClient(resp, req, format.contentEncoding, transformedBody)
 	if err != nil {
-		return fmt.Errorf("read body: %w", err)
+		putBuffer(out)
+		return err
+	}
+	resp.Body.Close() // Releases the original body's buffer
+	resp.Body = newPooledBody(out, transformedBody)
+	resp.ContentLength = int64(len(transformedBody))
+	resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(transformedBody)))
+	// A chunked origin body is now a fixed-length one, which must not
+	// claim both framings
+	resp.TransferEncoding = nil
+	resp.Header.Del("Transfer-Encoding")
+	m.updateValidators(resp, req, transformedBody)
+
+	return nil
+}
+
+// skipApplied marks the experiments listed as already applied to the page,
+// e.g. by another proxy in front of the origin, so they aren't applied twice
+func (m *ExperiFlowMiddleware) skipApplied(req *http.Request, results []*experimentResult, applied []string) {
+	for _, result := range results {
+		if result.applied || !slices.Contains(applied, result.experimentID) {
+			continue
+		}
+		result.applied = true
+		if m.config(req).EnableLogging {
+			slog.InfoContext(req.Context(), "Experiment already applied to page - skipping",
+				"experiment_id", result.experimentID, "request_path", req.URL.Path)
+		}
+	}
+}
+
+// appliedHeader returns the experiments listed in a response's
+// X-EF-Applied header
+func appliedHeader(header http.Header) []string {
+	var ids []string
+	for _, value := range header.Values("X-EF-Applied") {
+		for _, id := range strings.Split(value, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// appliedIDs returns the experiments applied on this pass, for the page's
+// ef-applied marker
+func appliedIDs(results []*experimentResult) []string {
+	var ids []string
+	for _, result := range results {
+		if !result.applied {
+			ids = append(ids, result.experimentID)
+		}
+	}
+	return ids
+}
+
+// anyHeaders reports whether any experiment applied on this pass has
+// header operations
+func anyHeaders(results []*experimentResult) bool {
+	for _, result := range results {
+		if !result.applied && len(result.headers) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// anyChanged reports whether any experiment's operations may have modified
+// the document
+func anyChanged(results []*experimentResult) bool {
+	for _, result := range results {
+		for _, res := range result.opResults {
+			if res.Changed() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// encodeForClient re-encodes a transformed body with the origin's
+// Content-Encoding, falling back to identity when the client doesn't accept
+// it or it can't be produced
+func (m *ExperiFlowMiddleware) encodeForClient(resp *http.Response, req *http.Request, contentEncoding string, body []byte) ([]byte, error) {
+	if acceptsEncoding(req, contentEncoding) {
+		encoded, err := encodeBody(contentEncoding, body)
+		if err == nil {
+			return encoded, nil
+		}
+		if m.config(req).EnableLogging {
+			slog.WarnContext(req.Context(), "Failed to re-encode response - sending identity",
+				"encoding", contentEncoding, "request_path", req.URL.Path, "error", err)
+		}
+	}
+
+	sendIdentity(resp)
+	return body, nil
+}
+
+// sendIdentity marks a response as sent without the origin's
+// Content-Encoding, so it now depends on the client's Accept-Encoding
+func sendIdentity(resp *http.Response) {
+	resp.Header.Del("Content-Encoding")
+	if !headerHasToken(resp.Header, "Vary", "Accept-Encoding") {
+		resp.Header.Add("Vary", "Accept-Encoding")
+	}
+}
+
+// bodyFormat records how the origin body was encoded so the transformed
+// body can be written back the same way
+type bodyFormat struct {
+	contentEncoding string            // Content-Encoding, e.g. gzip
+	charset         encoding.Encoding // nil for UTF-8
+}
+
+// parseBody reads, decodes, and parses the response body
+// resp.Body is left holding the original bytes so it can be passed
+// through untouched if transformation is abandoned
+func (m *ExperiFlowMiddleware) parseBody(resp *http.Response, req *http.Request) (*html.Node, *bodyFormat, error) {
+	// Leave encodings we can't decode untouched
+	format := &bodyFormat{contentEncoding: contentEncoding(resp)}
+	if !isSupportedEncoding(format.contentEncoding) {
+		if m.config(req).EnableLogging {
+			slog.InfoContext(req.Context(), "Unsupported content encoding - skipping transformation",
+				"encoding", format.contentEncoding, "request_path", req.URL.Path)
+		}
+		return nil, nil, &skipError{status: "skipped-encoding"}
+	}
+
+	// Leave bodies too large to buffer untouched, whether or not the
+	// origin declared a Content-Length
+	limit := int64(m.config(req).MaxTransformBytes)
+	if limit > 0 && resp.ContentLength > limit {
+		return nil, nil, m.skipSize(req, resp.ContentLength)
+	}
+
+	var reader io.Reader = resp.Body
+	if limit > 0 {
+		reader = io.LimitReader(resp.Body, limit+1)
+	}
+	raw := getBuffer()
+	if _, err := raw.ReadFrom(reader); err != nil {
+		putBuffer(raw)
+		return nil, nil, fmt.Errorf("read body: %w", err)
+	}
+	body := raw.Bytes()
+	if limit > 0 && int64(len(body)) > limit {
+		// Replay what was read ahead of the unread remainder
+		resp.Body = &pooledBody{Reader: io.MultiReader(bytes.NewReader(body), resp.Body), buf: raw, closer: resp.Body}
+		return nil, nil, m.skipSize(req, int64(len(body)))
 	}
 	resp.Body.Close()
+	resp.Body = newPooledBody(raw, body)
 
-	// 5. Parse HTML
-	doc, err := html.Parse(bytes.NewReader(body))
+	decoded, err := decodeBody(format.contentEncoding, body)
 	if err != nil {
-		return fmt.Errorf("parse HTML: %w", err)
+		return nil, nil, err
 	}
 
-	// 6. Apply transformations
-	if err := transform.ApplyTransformations(doc, spec.Operations); err != nil {
-		return fmt.Errorf("apply transformations: %w", err)
+	// html.Parse expects UTF-8, so convert other charsets first
+	var ok bool
+	if format.charset, ok = responseCharset(resp, decoded); !ok {
+		if m.config(req).EnableLogging {
+			slog.InfoContext(req.Context(), "Unknown charset - skipping transformation",
+				"content_type", resp.Header.Get("Content-Type"), "request_path", req.URL.Path)
+		}
+		return nil, nil, &skipError{status: "skipped-charset"}
+	}
+	if decoded, err = decodeCharset(format.charset, decoded); err != nil {
+		return nil, nil, fmt.Errorf("decode charset: %w", err)
 	}
 
-	// 7. Render transformed HTML
-	transformed, err := transform.RenderHTML(doc)
+	doc, err := transform.ParseDocument(decoded)
 	if err != nil {
-		return fmt.Errorf("render HTML: %w", err)
+		return nil, nil, fmt.Errorf("parse HTML: %w", err)
 	}
+	return doc, format, nil
+}
 
-	// 8. Update response with transformed HTML
-	transformedBody := []byte(transformed)
-	resp.Body = io.NopCloser(bytes.NewReader(transformedBody))
-	resp.ContentLength = int64(len(transformedBody))
-	resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(transformedBody)))
-
-	// 9. Add observability headers
-	m.addHeaders(resp, experimentID, variantKey, "hit", startTime)
+// replayBody serves already-read bytes followed by the rest of the
+// original body, closing the original when done
+type replayBody struct {
+	io.Reader
+	io.Closer
+}
 
-	if m.config.EnableLogging {
-		log.Printf("[ExperiFlow] Applied %d transformations for variant %s (took %v)",
-			len(spec.Operations), variantKey, time.Since(startTime))
+// skipSize logs and reports a body over MAX_TRANSFORM_BYTES
+// size is the Content-Length, or how much was read before giving up
+func (m *ExperiFlowMiddleware) skipSize(req *http.Request, size int64) error {
+	if m.config(req).EnableLogging {
+		slog.InfoContext(req.Context(), "Response body too large - skipping transformation",
+			"bytes", size, "limit", m.config(req).MaxTransformBytes, "request_path", req.URL.Path)
 	}
+	return &skipError{status: "skipped-size"}
+}
 
-	return nil
+// assignment is the variant a request was placed in
+type assignment struct {
+	variantID  string // Empty when no variant could be assigned
+	variantKey string
+	isNew      bool                     // Not yet stored in a cookie
+	isControl  bool                     // Known to be control, so no spec is needed
+	spec       *transform.TransformSpec // Set when fetched with the assignment
 }
 
 // getOrAssignVariant gets existing variant from cookie or assigns a new one
-func (m *ExperiFlowMiddleware) getOrAssignVariant(ctx context.Context, req *http.Request, experimentID, cookieName string) (string, string, bool) {
+func (m *ExperiFlowMiddleware) getOrAssignVariant(ctx context.Context, req *http.Request, jar *assignmentJar, experimentID string) assignment {
+	// QA override via query parameter, when enabled
+	if m.config(req).AllowForcedVariants {
+		if forced := m.getForcedVariant(ctx, req, experimentID); forced != nil {
+			return assignment{variantID: forced.ID, variantKey: forced.Name, isNew: true, isControl: forced.IsControl}
+		}
+	}
+
 	// Check for existing assignment in cookie
-	if cookie, err := req.Cookie(cookieName); err == nil && cookie.Value != "" {
-		// TODO: Also store variant key in cookie to avoid lookup
-		return cookie.Value, "", false
+	if variantID, variantKey := jar.get(experimentID); variantID != "" {
+		return assignment{variantID: variantID, variantKey: variantKey}
+	}
+
+	// Generate user ID
+	userID := m.userID(req)
+
+	// Shared assignments from other instances, or manual overrides
+	if stored, ok := m.storedAssignment(ctx, req, experimentID, userID); ok {
+		return assignment{variantID: stored.VariantID, variantKey: stored.VariantKey, isNew: true}
+	}
+
+	// New assignment needed - get the variant and spec in one call when the
+	// API supports it
+	if m.config(req).AssignmentBundle {
+		bundle, err := m.client.GetAssignmentBundle(ctx, experimentID, userID, m.current(req).assigner.Bucket(userID, experimentID))
+		if err == nil {
+			m.recordAssignment(req, experimentID, &bundle.Variant)
+			m.storeAssignment(ctx, req, experimentID, userID, &bundle.Variant)
+			return assignment{variantID: bundle.Variant.ID, variantKey: bundle.Variant.Name, isNew: true, spec: &bundle.Spec}
+		}
+		if !errors.Is(err, transform.ErrBundleUnsupported) {
+			if m.config(req).EnableLogging {
+				slog.ErrorContext(req.Context(), "Failed to fetch assignment bundle", "experiment_id", experimentID, "error", err)
+			}
+			return assignment{}
+		}
 	}
 
-	// New assignment needed - fetch variants
 	variants, err := m.client.GetVariants(ctx, experimentID)
 	if err != nil {
-		if m.config.EnableLogging {
-			log.Printf("[ExperiFlow] Failed to fetch variants: %v", err)
+		if m.config(req).EnableLogging {
+			slog.ErrorContext(req.Context(), "Failed to fetch variants", "experiment_id", experimentID, "error", err)
 		}
-		return "", "", false
+		return assignment{}
 	}
 
 	if len(variants) == 0 {
-		if m.config.EnableLogging {
-			log.Printf("[ExperiFlow] No variants found for experiment %s", experimentID)
+		if m.config(req).EnableLogging {
+			slog.WarnContext(req.Context(), "No variants found", "experiment_id", experimentID)
 		}
-		return "", "", false
+		return assignment{}
 	}
 
-	// Generate user ID
-	userID := variant.GetUserID("", req.RemoteAddr, req.UserAgent())
-
 	// Assign variant
-	assigned := m.assigner.AssignVariant(userID, experimentID, variants)
+	assigned := m.current(req).assigner.AssignVariant(userID, experimentID, variants)
 	if assigned == nil {
-		return "", "", false
+		return assignment{}
+	}
+
+	m.recordAssignment(req, experimentID, assigned)
+	m.storeAssignment(ctx, req, experimentID, userID, assigned)
+	return assignment{variantID: assigned.ID, variantKey: assigned.Name, isNew: true, isControl: assigned.IsControl}
+}
+
+// variantsLoaded registers and validates a variant list when the client
+// fetches it, so each list is handled once rather than on every assignment
+func (m *ExperiFlowMiddleware) variantsLoaded(ctx context.Context, experimentID string, variants []transform.Variant) {
+	variantKeys := make([]string, len(variants))
+	for i, v := range variants {
+		variantKeys[i] = v.Name
+	}
+	m.metrics.RegisterVariants(experimentID, variantKeys)
+	m.validateVariants(ctx, experimentID, variants)
+}
+
+// validateVariants logs and counts problems in a variant list, and logs
+// allocations assignment will normalize
+// Assignment goes ahead regardless, so a bad list degrades rather than
+// breaks the experiment.
+func (m *ExperiFlowMiddleware) validateVariants(ctx context.Context, experimentID string, variants []transform.Variant) {
+	if variant.NormalizesAllocations(variants) && m.Config().EnableLogging {
+		slog.WarnContext(ctx, "Traffic allocations do not sum to 1.0 - normalizing", "experiment_id", experimentID)
+	}
+
+	problems := variant.ValidateVariants(variants)
+	if len(problems) == 0 {
+		return
+	}
+	m.metrics.InvalidVariants(experimentID, len(problems))
+	if m.Config().EnableLogging {
+		slog.WarnContext(ctx, "Invalid variant configuration", "experiment_id", experimentID, "error", errors.Join(problems...))
+	}
+}
+
+// userID returns the ID users are bucketed by: the configured first-party
+// cookie when present, otherwise a hash of the client IP and User-Agent
+// The client IP is resolved through trusted proxies when any are configured.
+func (m *ExperiFlowMiddleware) userID(req *http.Request) string {
+	cookieValue := ""
+	if m.config(req).UserIDCookie != "" {
+		if cookie, err := req.Cookie(m.config(req).UserIDCookie); err == nil {
+			cookieValue = cookie.Value
+		}
+	}
+
+	// Without trusted proxies, keep hashing RemoteAddr as before
+	ipAddress := req.RemoteAddr
+	if len(m.current(req).trustedNets) > 0 {
+		if ip := m.clientIP(req); ip != nil {
+			ipAddress = ip.String()
+		}
+	}
+	return variant.GetUserID(cookieValue, ipAddress, req.UserAgent())
+}
+
+// recordAssignment logs and counts a new variant assignment made by
+// bucketing or the bundle endpoint
+// Cookie, store, and forced assignments aren't counted, so the metric
+// shows the split the assignment mechanism actually produces.
+func (m *ExperiFlowMiddleware) recordAssignment(req *http.Request, experimentID string, assigned *transform.Variant) {
+	m.metrics.Assignment(experimentID, assigned.Name)
+	if m.config(req).EnableLogging {
+		slog.InfoContext(req.Context(), "Assigned user to variant",
+			"experiment_id", experimentID,
+			"variant_key", assigned.Name,
+			"control", assigned.IsControl,
+			"request_path", req.URL.Path)
+	}
+}
+
+// getForcedVariant returns the variant requested via query parameter, if any
+// Accepts ?ef_<experimentID>=<variantKey> or ?ef_force=<experimentID>:<variantKey>
+// Unknown variant keys return nil so normal assignment takes over
+func (m *ExperiFlowMiddleware) getForcedVariant(ctx context.Context, req *http.Request, experimentID string) *transform.Variant {
+	query := req.URL.Query()
+	variantKey := query.Get("ef_" + experimentID)
+	if variantKey == "" {
+		for _, force := range query["ef_force"] {
+			if id, key, found := strings.Cut(force, ":"); found && id == experimentID {
+				variantKey = key
+				break
+			}
+		}
+	}
+	if variantKey == "" {
+		return nil
+	}
+
+	variants, err := m.client.GetVariants(ctx, experimentID)
+	if err != nil {
+		if m.config(req).EnableLogging {
+			slog.ErrorContext(req.Context(), "Failed to fetch variants", "experiment_id", experimentID, "error", err)
+		}
+		return nil
 	}
 
-	if m.config.EnableLogging {
-		log.Printf("[ExperiFlow] Assigned user to variant: %s (control: %v)", assigned.Name, assigned.IsControl)
+	for i := range variants {
+		if variants[i].Name == variantKey || variants[i].ID == variantKey {
+			if m.config(req).EnableLogging {
+				slog.InfoContext(req.Context(), "Forced variant", "experiment_id", experimentID, "variant_key", variants[i].Name)
+			}
+			return &variants[i]
+		}
 	}
 
-	return assigned.ID, assigned.Name, true
+	if m.config(req).EnableLogging {
+		slog.WarnContext(req.Context(), "Forced variant not found", "experiment_id", experimentID, "variant_key", variantKey)
+	}
+	return nil
 }
 
+// applyOptions builds the transform options from config and, when CSP
+// nonce propagation is enabled, the response's Content-Security-Policy
+func (m *ExperiFlowMiddleware) applyOptions(resp *http.Response, req *http.Request) transform.ApplyOptions {
+	opts := transform.ApplyOptions{
+		AllowUnsafeHTML: !m.config(req).SanitizeHTML,
+		MaxOperations:   m.config(req).MaxOperations,
+		MaxMatchedNodes: m.config(req).MaxMatchedNodes,
+	}
+	if !m.config(req).CSPNonce {
+		return opts
+	}
+
+	script, style := parseCSP(resp.Header)
+	opts.ScriptNonce, opts.StyleNonce = script.nonce, style.nonce
+	if m.config(req).EnableLogging && ((script.hashed && script.nonce == "") || (style.hashed && style.nonce == "")) {
+		slog.WarnContext(req.Context(), "Content-Security-Policy uses hashes without a nonce - injected scripts and styles will be blocked",
+			"request_path", req.URL.Path)
+	}
+	return opts
+}
+
+// sniffLength is how much of the body is inspected when sniffing for HTML
+const sniffLength = 512
+
 // isHTML checks if the response is HTML
-func (m *ExperiFlowMiddleware) isHTML(resp *http.Response) bool {
+// text/html and application/xhtml+xml match by Content-Type. Responses with
+// no or a generic Content-Type are sniffed for an HTML prefix unless
+// sniffing is disabled.
+func (m *ExperiFlowMiddleware) isHTML(resp *http.Response, req *http.Request) bool {
 	contentType := resp.Header.Get("Content-Type")
-	return strings.Contains(contentType, "text/html")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+
+	switch mediaType {
+	case "text/html", "application/xhtml+xml":
+		return true
+	case "", "application/octet-stream":
+		return m.config(req).SniffHTML && sniffHTML(resp)
+	}
+	return false
+}
+
+// transformSkip returns the X-EF-Transform status for responses whose
+// request method or status code isn't configured to be transformed, or ""
+func (m *ExperiFlowMiddleware) transformSkip(resp *http.Response, req *http.Request) string {
+	methodAllowed := slices.ContainsFunc(m.config(req).TransformMethods, func(method string) bool {
+		return strings.EqualFold(method, req.Method)
+	})
+	switch {
+	case !methodAllowed:
+		return "skipped-method"
+	case !slices.Contains(m.config(req).TransformStatuses, resp.StatusCode):
+		return "skipped-status"
+	}
+	return ""
+}
+
+// sniffHTML reports whether the body starts like an HTML document
+// The peeked bytes are put back in front of the body. Compressed bodies are
+// not sniffed.
+func sniffHTML(resp *http.Response) bool {
+	if resp.Body == nil || resp.Body == http.NoBody || contentEncoding(resp) != encodingIdentity {
+		return false
+	}
+
+	prefix := make([]byte, sniffLength)
+	n, err := io.ReadFull(resp.Body, prefix)
+	prefix = prefix[:n]
+	resp.Body = &replayBody{Reader: io.MultiReader(bytes.NewReader(prefix), resp.Body), Closer: resp.Body}
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return false
+	}
+
+	text := bytes.TrimLeft(bytes.TrimPrefix(prefix, []byte("\xef\xbb\xbf")), " \t\r\n\f")
+	text = bytes.ToLower(text)
+	return bytes.HasPrefix(text, []byte("<!doctype html")) || bytes.HasPrefix(text, []byte("<html"))
 }
 
 // addHeaders adds observability headers to the response
-func (m *ExperiFlowMiddleware) addHeaders(resp *http.Response, experimentID, variantKey, status string, startTime time.Time) {
+// X-EF-Timing is the total since startTime, while the experiment's
+// Server-Timing entry covers only its own elapsed time, so entries for
+// several experiments can be summed.
+func (m *ExperiFlowMiddleware) addHeaders(resp *http.Response, experimentID, variantKey, status string, startTime time.Time, elapsed time.Duration) {
 	resp.Header.Set("X-EF-Experiment", experimentID)
 	resp.Header.Set("X-EF-Variant", variantKey)
 	resp.Header.Set("X-EF-Transform", status)
 	resp.Header.Set("X-EF-Timing", fmt.Sprintf("total=%dms", time.Since(startTime).Milliseconds()))
+
+	// Server-Timing shows up in browser devtools; keep entries from the
+	// origin and from other experiments. Every entry keeps the ef metric
+	// name dashboards key on, with the experiment told apart in desc.
+	entry := fmt.Sprintf(`ef;dur=%.2f;desc="experiflow-transform %s"`, float64(elapsed.Microseconds())/1000, serverTimingID(experimentID))
+	if existing := resp.Header.Values("Server-Timing"); len(existing) > 0 {
+		entry = strings.Join(existing, ", ") + ", " + entry
+	}
+	resp.Header.Set("Server-Timing", entry)
+}
+
+// serverTimingID makes an experiment ID safe to quote in a Server-Timing
+// description by replacing anything but letters, digits, '-', '_', and '.'
+// with '-'
+func serverTimingID(experimentID string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '-'
+	}, experimentID)
 }
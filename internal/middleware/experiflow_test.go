@@ -0,0 +1,273 @@
+package middleware
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/experiflow/proxy/internal/config"
+	"github.com/experiflow/proxy/internal/transform"
+)
+
+// newTestAPI serves a single treatment variant for every experiment, whose
+// transform spec is the experiment's operations in specs
+func newTestAPI(t *testing.T, specs map[string][]transform.Operation) *httptest.Server {
+	t.Helper()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/public/variants"):
+			json.NewEncoder(w).Encode([]transform.Variant{{ID: "v1", Name: "treatment", TrafficAllocation: 1}})
+		case strings.HasSuffix(r.URL.Path, "/transform-spec") && len(parts) == 4:
+			json.NewEncoder(w).Encode(transform.TransformSpec{VariantID: "v1", VariantKey: "treatment", Operations: specs[parts[2]]})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(api.Close)
+	return api
+}
+
+// newTestMiddleware returns a middleware using api for the experiments,
+// with the default configuration changed by configure
+func newTestMiddleware(t *testing.T, api *httptest.Server, experiments []string, configure func(*config.Config)) *ExperiFlowMiddleware {
+	t.Helper()
+	cfg := config.LoadFromEnv()
+	cfg.APIBaseURL = api.URL
+	cfg.APITimeout, cfg.TransformBudget = time.Second, time.Second
+	cfg.EnableLogging = false
+	cfg.ExperimentIDs = experiments
+	if configure != nil {
+		configure(cfg)
+	}
+	m := NewExperiFlowMiddleware(cfg, experiments)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// newTestProxy serves origin through a reverse proxy transforming
+// responses with m, as cmd/proxy does
+func newTestProxy(t *testing.T, m *ExperiFlowMiddleware, origin http.Handler) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(origin)
+	t.Cleanup(upstream.Close)
+	target, _ := url.Parse(upstream.URL)
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		return m.ModifyResponse(resp, resp.Request)
+	}
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestReturningUserVariantRegistered(t *testing.T) {
+	api := newTestAPI(t, map[string][]transform.Operation{
+		"exp": {{Type: transform.OpSetText, Selector: "h1", Value: "B"}},
+	})
+	m := newTestMiddleware(t, api, []string{"exp"}, func(cfg *config.Config) { cfg.EnableMetrics = true })
+	proxy := newTestProxy(t, m, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<h1>A</h1>"))
+	}))
+
+	req, _ := http.NewRequest("GET", proxy.URL, nil)
+	req.AddCookie(&http.Cookie{Name: experimentCookie("exp"), Value: encodeAssignment("v1", "treatment")})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	scrape := httptest.NewRecorder()
+	m.MetricsHandler().ServeHTTP(scrape, httptest.NewRequest("GET", "/metrics", nil))
+	if body := scrape.Body.String(); !strings.Contains(body, `variant_key="treatment"`) {
+		t.Errorf("returning user's variant not labelled:\n%s", body)
+	}
+}
+
+func TestFragmentResponse(t *testing.T) {
+	api := newTestAPI(t, map[string][]transform.Operation{
+		"exp": {{Type: transform.OpSetText, Selector: "h2", Value: "New"}},
+	})
+	m := newTestMiddleware(t, api, []string{"exp"}, nil)
+	proxy := newTestProxy(t, m, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<div class="card"><h2>Old</h2><p>Body</p></div>`))
+	}))
+
+	resp, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if want := `<div class="card"><h2>New</h2><p>Body</p></div>`; string(body) != want {
+		t.Errorf("got  %s\nwant %s", body, want)
+	}
+}
+
+func TestChunkedOriginGetsContentLength(t *testing.T) {
+	api := newTestAPI(t, map[string][]transform.Operation{
+		"exp": {{Type: transform.OpSetText, Selector: "h1", Value: "New"}},
+	})
+	m := newTestMiddleware(t, api, []string{"exp"}, nil)
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<!DOCTYPE html><html><body><h1>Old</h1>"))
+		w.(http.Flusher).Flush() // Commits to chunked encoding
+		w.Write([]byte("<p>rest</p></body></html>"))
+	})
+	const want = `<!DOCTYPE html><html><head><meta name="ef-applied" content="exp"/></head><body><h1>New</h1><p>rest</p></body></html>`
+
+	t.Run("ModifyResponse", func(t *testing.T) {
+		upstream := httptest.NewServer(origin)
+		defer upstream.Close()
+		resp, err := http.Get(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.ContentLength != -1 || len(resp.TransferEncoding) == 0 {
+			t.Fatalf("origin isn't chunked: Content-Length %d, Transfer-Encoding %v", resp.ContentLength, resp.TransferEncoding)
+		}
+		resp.Header.Set("Transfer-Encoding", "chunked") // As some upstream clients leave it
+
+		if err := m.ModifyResponse(resp, resp.Request); err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != want {
+			t.Errorf("body %s, want %s", body, want)
+		}
+		if resp.ContentLength != int64(len(body)) || resp.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+			t.Errorf("Content-Length %d (header %q), want %d", resp.ContentLength, resp.Header.Get("Content-Length"), len(body))
+		}
+		if resp.TransferEncoding != nil || resp.Header.Get("Transfer-Encoding") != "" {
+			t.Errorf("Transfer-Encoding kept: %v, header %q", resp.TransferEncoding, resp.Header.Get("Transfer-Encoding"))
+		}
+	})
+
+	t.Run("proxied", func(t *testing.T) {
+		proxy := newTestProxy(t, m, origin)
+		resp, err := http.Get(proxy.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != want {
+			t.Errorf("body %s, want %s", body, want)
+		}
+		if resp.ContentLength != int64(len(body)) {
+			t.Errorf("Content-Length %d, want %d", resp.ContentLength, len(body))
+		}
+		if len(resp.TransferEncoding) != 0 {
+			t.Errorf("Transfer-Encoding %v, want none", resp.TransferEncoding)
+		}
+	})
+}
+
+func TestChainedHeaderOnlyExperiment(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/public/variants"):
+			json.NewEncoder(w).Encode([]transform.Variant{{ID: "v1", Name: "treatment", TrafficAllocation: 1}})
+		case strings.HasSuffix(r.URL.Path, "/transform-spec"):
+			json.NewEncoder(w).Encode(transform.TransformSpec{Headers: []transform.HeaderOperation{
+				{Type: transform.HeaderAdd, Name: "Link", Value: "</promo.css>; rel=preload"},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(api.Close)
+
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<!DOCTYPE html><h1>Page</h1>"))
+	})
+	inner := newTestProxy(t, newTestMiddleware(t, api, []string{"exp"}, nil), origin)
+	innerURL, _ := url.Parse(inner.URL)
+	outer := newTestProxy(t, newTestMiddleware(t, api, []string{"exp"}, nil), httputil.NewSingleHostReverseProxy(innerURL))
+
+	resp, err := http.Get(outer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if links := resp.Header.Values("Link"); len(links) != 1 {
+		t.Errorf("Link headers %q, want the experiment's once", links)
+	}
+	if got := resp.Header.Get("X-EF-Transform"); got != "already-applied" {
+		t.Errorf("outer X-EF-Transform = %q, want already-applied", got)
+	}
+	if got := resp.Header.Get("X-EF-Applied"); got != "exp" {
+		t.Errorf("X-EF-Applied = %q, want the inner proxy's exp", got)
+	}
+}
+
+func TestAppliedHeader(t *testing.T) {
+	header := http.Header{}
+	header.Add("X-EF-Applied", "a, b,")
+	header.Add("X-EF-Applied", "c")
+	if got := appliedHeader(header); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Errorf("appliedHeader = %q", got)
+	}
+}
+
+func TestServerTimingPerExperiment(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	api := newTestAPI(t, map[string][]transform.Operation{
+		"slow": {{Type: transform.OpSetText, Selector: "h1", Value: "B"}},
+		"fast": {{Type: transform.OpSetText, Selector: "p", Value: "B"}},
+	})
+	slowAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/slow/") && strings.HasSuffix(r.URL.Path, "/transform-spec") {
+			time.Sleep(delay)
+		}
+		api.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(slowAPI.Close)
+	m := newTestMiddleware(t, slowAPI, []string{"slow", "fast"}, nil)
+	proxy := newTestProxy(t, m, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Server-Timing", "db;dur=1")
+		w.Write([]byte("<h1>A</h1><p>A</p>"))
+	}))
+
+	resp, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Experiment entries are keyed by desc, since they share the ef name
+	durations := make(map[string]float64)
+	for _, entry := range strings.Split(resp.Header.Get("Server-Timing"), ", ") {
+		name, params, _ := strings.Cut(entry, ";")
+		dur, desc, _ := strings.Cut(strings.TrimPrefix(params, "dur="), ";")
+		if name == "ef" {
+			name = strings.TrimPrefix(desc, "desc=")
+		}
+		durations[name], _ = strconv.ParseFloat(dur, 64)
+	}
+	if len(durations) != 3 {
+		t.Fatalf("Server-Timing %q, want the origin's entry and one ef entry per experiment", resp.Header.Get("Server-Timing"))
+	}
+	if slow := durations[`"experiflow-transform slow"`]; slow < float64(delay.Milliseconds()) {
+		t.Errorf("slow dur %g, want at least %d", slow, delay.Milliseconds())
+	}
+	if fast := durations[`"experiflow-transform fast"`]; fast >= float64(delay.Milliseconds()) {
+		t.Errorf("fast dur %g includes slow's time", fast)
+	}
+}
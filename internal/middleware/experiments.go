@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// activeExperimentsTTL is how many refresh intervals a fetched experiment
+// list stays valid; after that only the static list is used
+const activeExperimentsTTL = 3
+
+// activeExperiments returns the static experiment IDs merged with the
+// list fetched from the API, if it is still fresh
+func (m *ExperiFlowMiddleware) activeExperiments(req *http.Request) []string {
+	static := m.current(req).experiments
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if len(m.dynamicExperiments) == 0 || time.Now().After(m.dynamicExpiresAt) {
+		return static
+	}
+	return mergeExperimentIDs(static, m.dynamicExperiments)
+}
+
+// refreshExperiments periodically fetches the active experiment list
+// until Close is called
+func (m *ExperiFlowMiddleware) refreshExperiments(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		m.fetchActiveExperiments(interval)
+
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetchActiveExperiments fetches and stores the active experiment list
+// On failure the previous list is kept until it expires
+func (m *ExperiFlowMiddleware) fetchActiveExperiments(interval time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), interval)
+	defer cancel()
+
+	ids, err := m.client.GetActiveExperiments(ctx)
+	if err != nil {
+		if m.Config().EnableLogging {
+			slog.Error("Failed to fetch active experiments", "error", err)
+		}
+		return
+	}
+
+	m.mu.Lock()
+	m.dynamicExperiments = mergeExperimentIDs(nil, ids)
+	m.dynamicExpiresAt = time.Now().Add(activeExperimentsTTL * interval)
+	m.mu.Unlock()
+}
+
+// mergeExperimentIDs appends IDs from extra that aren't already in base,
+// skipping blanks and duplicates
+func mergeExperimentIDs(base, extra []string) []string {
+	seen := make(map[string]bool, len(base)+len(extra))
+	merged := make([]string, 0, len(base)+len(extra))
+	for _, ids := range [][]string{base, extra} {
+		for _, id := range ids {
+			if id != "" && !seen[id] {
+				seen[id] = true
+				merged = append(merged, id)
+			}
+		}
+	}
+	return merged
+}
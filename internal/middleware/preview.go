@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/experiflow/proxy/internal/transform"
+)
+
+// experimentPreview is one experiment's entry in X-EF-Preview-Diff
+type experimentPreview struct {
+	ExperimentID string                `json:"experiment_id"`
+	VariantKey   string                `json:"variant_key"`
+	Operations   []transform.OpPreview `json:"operations"`
+}
+
+// parseCIDRs parses IPs and CIDR ranges, logging and skipping invalid entries
+// Plain IPs are treated as single-address ranges
+func parseCIDRs(entries []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			slog.Warn("Ignoring invalid IP range", "entry", entry, "error", err)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+// containsIP reports whether ip falls in any of the ranges
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP extracts the IP from a request's RemoteAddr
+func remoteIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// isPreviewRequest reports whether the request asks for preview mode from
+// an allowlisted client
+func (m *ExperiFlowMiddleware) isPreviewRequest(req *http.Request) bool {
+	if req.Header.Get("X-EF-Preview") != "1" || len(m.current(req).previewNets) == 0 {
+		return false
+	}
+	ip := m.clientIP(req)
+	return ip != nil && containsIP(m.current(req).previewNets, ip)
+}
+
+// previewBody applies the experiments to a parsed copy of the body and
+// reports the changes in X-EF-Preview-Diff, leaving the delivered page as is
+func (m *ExperiFlowMiddleware) previewBody(resp *http.Response, req *http.Request, results []*experimentResult) error {
+	doc, _, err := m.parseBody(resp, req)
+	if err != nil {
+		return err
+	}
+
+	opts := m.applyOptions(resp, req)
+	previews := make([]experimentPreview, 0, len(results))
+	for _, result := range results {
+		previews = append(previews, experimentPreview{
+			ExperimentID: result.experimentID,
+			VariantKey:   result.variantKey,
+			Operations:   transform.PreviewTransformations(doc, result.operations, opts),
+		})
+	}
+
+	diff, err := json.Marshal(previews)
+	if err != nil {
+		return fmt.Errorf("marshal preview: %w", err)
+	}
+	resp.Header.Set("X-EF-Preview-Diff", string(diff))
+	return nil
+}
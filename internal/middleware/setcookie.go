@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// rewriteCookieDomains points the Domain of origin cookies at the host the
+// client sees, so cookies set for the origin's own domain aren't rejected
+// Only cookies whose Domain doesn't already cover that host are changed;
+// every other attribute is kept byte for byte.
+func (m *ExperiFlowMiddleware) rewriteCookieDomains(resp *http.Response, req *http.Request) {
+	target := m.config(req).RewriteCookieDomain
+	cookies := resp.Header.Values("Set-Cookie")
+	if target == "" || len(cookies) == 0 {
+		return
+	}
+
+	host := clientHost(req)
+	if target == "host" {
+		target = host
+	}
+
+	rewritten := make([]string, len(cookies))
+	for i, cookie := range cookies {
+		rewritten[i] = rewriteSetCookieDomain(cookie, host, target)
+	}
+	resp.Header["Set-Cookie"] = rewritten
+}
+
+// clientHost returns the host the client requested, without a port
+// The director records it in X-Forwarded-Host before pointing the request
+// at the origin.
+func clientHost(req *http.Request) string {
+	host := req.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = req.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// rewriteSetCookieDomain replaces a Set-Cookie header's Domain attribute
+// with domain unless it already matches host
+// Host-only cookies (no Domain) are returned unchanged.
+func rewriteSetCookieDomain(setCookie, host, domain string) string {
+	parts := strings.Split(setCookie, ";")
+	for i, part := range parts {
+		key, value, _ := strings.Cut(part, "=")
+		if !strings.EqualFold(strings.TrimSpace(key), "domain") {
+			continue
+		}
+		if domainMatches(host, strings.TrimSpace(value)) {
+			return setCookie
+		}
+		parts[i] = " Domain=" + domain
+	}
+	return strings.Join(parts, ";")
+}
+
+// domainMatches reports whether a cookie Domain covers host
+func domainMatches(host, domain string) bool {
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
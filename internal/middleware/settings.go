@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/experiflow/proxy/internal/config"
+	"github.com/experiflow/proxy/internal/variant"
+)
+
+// settings is the live configuration together with the values derived
+// from it, replaced as a unit when the configuration is reloaded
+type settings struct {
+	config      *config.Config
+	assigner    *variant.Assigner
+	holdback    *variant.Assigner
+	experiments []string      // Static experiment IDs, in configured order
+	previewNets []*net.IPNet  // Clients allowed to request preview mode
+	trustedNets []*net.IPNet  // Proxies whose X-Forwarded-For is believed
+	sameSite    http.SameSite // SameSite mode for assignment cookies
+	cookieMode  cookieMode    // How assignments are stored in cookies
+	etagMode    etagMode      // Validator handling for transformed responses
+	onTimeout   timeoutPolicy // Handling of transform spec fetch timeouts
+
+	// bots matches bot User-Agents; nil when none are configured
+	bots *regexp.Regexp
+
+	// audiences holds each targeted experiment's compiled audience rules
+	audiences map[string][]audienceRule
+}
+
+// newSettings derives the middleware settings from a config, warning
+// about values that fall back to defaults
+func newSettings(cfg *config.Config, experimentIDs []string) *settings {
+	sameSite, err := parseSameSite(cfg.CookieSameSite)
+	if err != nil {
+		slog.Warn("Invalid cookie SameSite setting - using lax", "error", err)
+	}
+	if sameSite == http.SameSiteNoneMode && !cfg.CookieSecure {
+		slog.Warn("SameSite=None cookies require COOKIE_SECURE=true; browsers will reject them")
+	}
+
+	cookieMode, err := parseCookieMode(cfg.CookieMode)
+	if err != nil {
+		slog.Warn("Invalid cookie mode - using per-experiment", "error", err)
+	}
+
+	etagMode, err := parseETagMode(cfg.ETagMode)
+	if err != nil {
+		slog.Warn("Invalid ETag mode - using rewrite", "error", err)
+	}
+
+	onTimeout, err := parseTimeoutPolicy(cfg.OnTimeout)
+	if err != nil {
+		slog.Warn("Invalid timeout policy - following FAIL_OPEN", "error", err)
+	}
+
+	return &settings{
+		config:      cfg,
+		assigner:    variant.NewAssigner(cfg.AssignmentSalt).WithExperimentSalts(cfg.ExperimentSalts),
+		holdback:    variant.NewAssigner(cfg.HoldbackSalt),
+		experiments: mergeExperimentIDs(nil, experimentIDs),
+		previewNets: parseCIDRs(cfg.PreviewAllowlist),
+		trustedNets: parseCIDRs(cfg.TrustedProxies),
+		sameSite:    sameSite,
+		cookieMode:  cookieMode,
+		etagMode:    etagMode,
+		onTimeout:   onTimeout,
+		bots:        compileUserAgents(cfg.BotUserAgents),
+		audiences:   parseAudiences(cfg.ExperimentAudiences),
+	}
+}
+
+// compileUserAgents builds one case-insensitive matcher for a list of
+// User-Agent substrings, or nil if the list is empty
+func compileUserAgents(substrings []string) *regexp.Regexp {
+	var quoted []string
+	for _, s := range substrings {
+		if s = strings.TrimSpace(s); s != "" {
+			quoted = append(quoted, regexp.QuoteMeta(s))
+		}
+	}
+	if len(quoted) == 0 {
+		return nil
+	}
+	return regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+}
+
+// settingsKey is the request context key for settings pinned by pinSettings
+type settingsKey struct{}
+
+// pinSettings returns req carrying the live settings, so everything done
+// for one response sees the same settings even if they are reloaded meanwhile
+func (m *ExperiFlowMiddleware) pinSettings(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), settingsKey{}, m.state.Load()))
+}
+
+// current returns the settings pinned to req, or the live settings
+func (m *ExperiFlowMiddleware) current(req *http.Request) *settings {
+	if s, ok := req.Context().Value(settingsKey{}).(*settings); ok {
+		return s
+	}
+	return m.state.Load()
+}
+
+// config returns the configuration pinned to req, or the live configuration
+func (m *ExperiFlowMiddleware) config(req *http.Request) *config.Config {
+	return m.current(req).config
+}
+
+// Config returns the live configuration, which callers must not modify
+func (m *ExperiFlowMiddleware) Config() *config.Config {
+	return m.state.Load().config
+}
+
+// Reload swaps in a new configuration and its experiment list
+// Responses already being transformed keep the settings ModifyResponse
+// pinned to their request. Settings
+// that only take effect at startup keep their current values, and changes
+// to them are logged as ignored.
+func (m *ExperiFlowMiddleware) Reload(cfg *config.Config) {
+	current := m.Config()
+	for _, key := range cfg.KeepStatic(current) {
+		slog.Warn("Setting can't change at runtime - ignored until restart", "setting", key)
+	}
+
+	m.state.Store(newSettings(cfg, cfg.ExperimentIDs))
+	slog.Info("Configuration reloaded", "experiment_ids", cfg.ExperimentIDs)
+}
@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/experiflow/proxy/internal/config"
+	"github.com/experiflow/proxy/internal/transform"
+	"github.com/experiflow/proxy/internal/variant"
+)
+
+// newStore connects the configured assignment store, or returns nil when
+// none is configured or it can't be set up
+func newStore(cfg *config.Config) variant.Store {
+	if cfg.AssignmentStoreURL == "" {
+		return nil
+	}
+	store, err := variant.NewRedisStore(cfg.AssignmentStoreURL, cfg.AssignmentStoreTTL)
+	if err != nil {
+		slog.Error("Assignment store disabled", "error", err)
+		return nil
+	}
+	return store
+}
+
+// storedAssignment looks up a user's assignment in the store
+// Store errors are logged and treated as a miss, so assignment carries on
+// without the store.
+func (m *ExperiFlowMiddleware) storedAssignment(ctx context.Context, req *http.Request, experimentID, userID string) (variant.StoredAssignment, bool) {
+	if m.store == nil || userID == "" {
+		return variant.StoredAssignment{}, false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.config(req).AssignmentStoreTimeout)
+	defer cancel()
+	stored, ok, err := m.store.Get(ctx, userID, experimentID)
+	if err != nil {
+		m.metrics.StoreError()
+		if m.config(req).EnableLogging {
+			slog.WarnContext(ctx, "Assignment store lookup failed", "experiment_id", experimentID, "error", err)
+		}
+		return variant.StoredAssignment{}, false
+	}
+	return stored, ok
+}
+
+// storeAssignment saves a new assignment in the background, so a slow
+// store doesn't delay the response
+// Assignments made after Close aren't saved.
+func (m *ExperiFlowMiddleware) storeAssignment(ctx context.Context, req *http.Request, experimentID, userID string, assigned *transform.Variant) {
+	if m.store == nil || userID == "" {
+		return
+	}
+
+	m.storeMu.Lock()
+	defer m.storeMu.Unlock()
+	if m.storeClosed {
+		return
+	}
+	m.storeWrites.Add(1)
+
+	stored := variant.StoredAssignment{VariantID: assigned.ID, VariantKey: assigned.Name}
+	timeout := m.config(req).AssignmentStoreTimeout
+	ctx = context.WithoutCancel(ctx) // Outlive the response, keeping the request ID
+	go func() {
+		defer m.storeWrites.Done()
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		if err := m.store.Set(ctx, userID, experimentID, stored); err != nil {
+			m.metrics.StoreError()
+			if m.config(req).EnableLogging {
+				slog.WarnContext(ctx, "Assignment store write failed", "experiment_id", experimentID, "error", err)
+			}
+		}
+	}()
+}
+
+// waitStoreWrites stops new assignment store writes and waits for pending
+// ones, for at most the store timeout that already bounds each of them
+func (m *ExperiFlowMiddleware) waitStoreWrites() {
+	m.storeMu.Lock()
+	m.storeClosed = true
+	m.storeMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.storeWrites.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(m.Config().AssignmentStoreTimeout):
+	}
+}
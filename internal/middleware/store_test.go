@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/experiflow/proxy/internal/config"
+	"github.com/experiflow/proxy/internal/transform"
+	"github.com/experiflow/proxy/internal/variant"
+)
+
+// slowStore takes delay to save an assignment, ignoring its context if
+// stubborn is set
+type slowStore struct {
+	delay    time.Duration
+	stubborn bool
+	saved    atomic.Int32
+}
+
+func (s *slowStore) Get(ctx context.Context, userID, experimentID string) (variant.StoredAssignment, bool, error) {
+	return variant.StoredAssignment{}, false, nil
+}
+
+func (s *slowStore) Set(ctx context.Context, userID, experimentID string, assignment variant.StoredAssignment) error {
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		if !s.stubborn {
+			return ctx.Err()
+		}
+		time.Sleep(s.delay)
+	}
+	s.saved.Add(1)
+	return nil
+}
+
+func TestCloseWaitsForStoreWrites(t *testing.T) {
+	tests := []struct {
+		name      string
+		store     *slowStore
+		timeout   time.Duration
+		wantSaved int32
+		maxClose  time.Duration
+	}{
+		{"pending writes finish", &slowStore{delay: 50 * time.Millisecond}, time.Second, 3, time.Second},
+		{"bounded by the store timeout", &slowStore{delay: 5 * time.Second, stubborn: true}, 50 * time.Millisecond, 0, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewExperiFlowMiddleware(&config.Config{AssignmentStoreTimeout: tt.timeout}, nil)
+			m.store = tt.store
+			req := httptest.NewRequest("GET", "/", nil)
+			for _, experimentID := range []string{"a", "b", "c"} {
+				m.storeAssignment(req.Context(), req, experimentID, "user", &transform.Variant{ID: "v1"})
+			}
+
+			start := time.Now()
+			m.Close()
+			if elapsed := time.Since(start); elapsed > tt.maxClose {
+				t.Errorf("Close took %v, want under %v", elapsed, tt.maxClose)
+			}
+			if saved := tt.store.saved.Load(); saved != tt.wantSaved {
+				t.Errorf("%d assignments saved by Close, want %d", saved, tt.wantSaved)
+			}
+		})
+	}
+}
+
+func TestNoStoreWritesAfterClose(t *testing.T) {
+	store := &slowStore{}
+	m := NewExperiFlowMiddleware(&config.Config{AssignmentStoreTimeout: time.Second}, nil)
+	m.store = store
+	m.Close()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	m.storeAssignment(req.Context(), req, "exp", "user", &transform.Variant{ID: "v1"})
+	time.Sleep(20 * time.Millisecond)
+	if saved := store.saved.Load(); saved != 0 {
+		t.Errorf("%d assignments saved after Close, want 0", saved)
+	}
+}
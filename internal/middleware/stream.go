@@ -0,0 +1,247 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/experiflow/proxy/internal/transform"
+	"golang.org/x/text/encoding"
+	texttransform "golang.org/x/text/transform"
+)
+
+// streamWriteBuffer is how much transformed output is gathered before it
+// is encoded for the client
+const streamWriteBuffer = 32 << 10
+
+// operationTrailers carry the operation counts on streamed responses,
+// which are only known once the whole body has been sent
+var operationTrailers = []string{"X-EF-Ops", "X-EF-Unmatched", "X-EF-Unknown-Ops"}
+
+// streamBody sets the response up to be transformed as the proxy copies
+// it to the client, and reports whether it did
+// Pages are only streamed when every operation can be, and only once
+// enough has been read to know the page's charset; otherwise the body is
+// left ready for the buffered path. Streaming doesn't take a transform
+// slot, since it never holds the whole page and runs at the client's pace.
+func (m *ExperiFlowMiddleware) streamBody(resp *http.Response, req *http.Request, results []*experimentResult, startTime time.Time) bool {
+	if !m.config(req).StreamHTML || m.isDebug(req) {
+		return false
+	}
+	for _, result := range results {
+		if !transform.CanStream(result.operations) {
+			return false
+		}
+	}
+	originEncoding := contentEncoding(resp)
+	if !isSupportedEncoding(originEncoding) {
+		return false
+	}
+
+	// Peek far enough for a <meta charset>, keeping the origin's bytes in
+	// case the page has to be buffered after all
+	origin := &originReader{body: resp.Body, record: getBuffer()}
+	decoded, err := newDecoder(originEncoding, origin)
+	var prefix []byte
+	var format bodyFormat
+	ok := false
+	if err == nil {
+		prefix = make([]byte, metaPrescanBytes)
+		n, err := io.ReadFull(decoded, prefix)
+		prefix = prefix[:n]
+		format.charset, ok = responseCharset(resp, prefix)
+		ok = ok && (err == nil || err == io.EOF || err == io.ErrUnexpectedEOF)
+	}
+	if !ok {
+		recorded := origin.record
+		resp.Body = &pooledBody{Reader: io.MultiReader(bytes.NewReader(recorded.Bytes()), resp.Body), buf: recorded, closer: resp.Body}
+		return false
+	}
+	putBuffer(origin.record)
+	origin.record = nil
+
+	var input io.Reader = io.MultiReader(bytes.NewReader(prefix), decoded)
+	if format.charset != nil {
+		input = format.charset.NewDecoder().Reader(input)
+	}
+
+	format.contentEncoding = originEncoding
+	if !acceptsEncoding(req, originEncoding) {
+		format.contentEncoding = encodingIdentity
+		sendIdentity(resp)
+	}
+	pipeReader, pipeWriter := io.Pipe()
+	output, err := newStreamOutput(pipeWriter, &format)
+	if err != nil {
+		// The encoder is known to be supported, so this never happens
+		return false
+	}
+	origin.flush = output.Flush
+
+	// Leave experiments an earlier pass already applied, which it marked
+	// at the start of the page, and mark the rest
+	if doc, err := transform.ParseDocument(prefix); err == nil {
+		m.skipApplied(req, results, transform.AppliedExperiments(doc))
+	}
+	opts := m.applyOptions(resp, req)
+	specs := make([][]transform.Operation, len(results), len(results)+1)
+	for i, result := range results {
+		if !result.applied {
+			specs[i] = result.operations
+		}
+	}
+	if ids := appliedIDs(results); len(ids) > 0 {
+		specs = append(specs, []transform.Operation{transform.MarkApplied(ids)})
+	}
+
+	if resp.Trailer == nil {
+		resp.Trailer = make(http.Header)
+	}
+	for _, name := range operationTrailers {
+		resp.Trailer[http.CanonicalHeaderKey(name)] = nil
+	}
+	trailer := resp.Trailer
+
+	body := &streamedBody{pipe: pipeReader, origin: resp.Body, done: make(chan struct{})}
+	body.run = func() {
+		opResults, err := transform.StreamTransformations(output, input, specs, opts, m.config(req).MaxTransformBytes)
+		if err == nil {
+			err = output.Close()
+		}
+		if err != nil {
+			// A closed pipe means the client went away
+			if m.config(req).EnableLogging && !errors.Is(err, io.ErrClosedPipe) {
+				slog.ErrorContext(req.Context(), "Error streaming transformed response", "request_path", req.URL.Path, "error", err)
+			}
+			pipeWriter.CloseWithError(err)
+			return
+		}
+
+		for i, result := range results {
+			result.opResults = opResults[i]
+		}
+		m.reportOperations(trailer, req, results, startTime)
+		pipeWriter.Close()
+	}
+
+	resp.Body = body
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	m.dropValidators(resp, req)
+	return true
+}
+
+// originReader reads the origin body of a streamed page, first sending on
+// whatever has been transformed so the client isn't kept waiting on the
+// origin
+type originReader struct {
+	body   io.Reader
+	record *bytes.Buffer // Keeps what is read while peeking; nil after
+	flush  func() error
+}
+
+func (r *originReader) Read(p []byte) (int, error) {
+	if r.flush != nil {
+		if err := r.flush(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.body.Read(p)
+	if r.record != nil {
+		r.record.Write(p[:n])
+	}
+	return n, err
+}
+
+// streamOutput encodes transformed output for the client, like the origin's
+// body, as it is written
+type streamOutput struct {
+	buf     *bufio.Writer
+	charset io.WriteCloser // nil for UTF-8
+	encoder streamEncoder
+	pending bool // Written to since the last flush
+}
+
+// newStreamOutput returns a writer encoding to w in format
+func newStreamOutput(w io.Writer, format *bodyFormat) (*streamOutput, error) {
+	encoder, err := newEncoder(format.contentEncoding, w)
+	if err != nil {
+		return nil, err
+	}
+	out := &streamOutput{encoder: encoder}
+	var next io.Writer = encoder
+	if format.charset != nil {
+		// Characters the charset can't represent become HTML numeric references
+		out.charset = texttransform.NewWriter(encoder, encoding.HTMLEscapeUnsupported(format.charset.NewEncoder()))
+		next = out.charset
+	}
+	out.buf = bufio.NewWriterSize(next, streamWriteBuffer)
+	return out, nil
+}
+
+func (o *streamOutput) Write(p []byte) (int, error) {
+	o.pending = true
+	return o.buf.Write(p)
+}
+
+// Flush sends everything written so far to the client
+func (o *streamOutput) Flush() error {
+	if !o.pending {
+		return nil
+	}
+	o.pending = false
+	if err := o.buf.Flush(); err != nil {
+		return err
+	}
+	return o.encoder.Flush()
+}
+
+// Close flushes the output and ends the encoding
+func (o *streamOutput) Close() error {
+	if err := o.buf.Flush(); err != nil {
+		return err
+	}
+	if o.charset != nil {
+		if err := o.charset.Close(); err != nil {
+			return err
+		}
+	}
+	return o.encoder.Close()
+}
+
+// streamedBody is a response body transformed as the proxy reads it
+// The transform starts on the first Read, writing to a pipe from its own
+// goroutine. Close stops it and waits for it, so the trailers it sets are
+// complete by the time the proxy copies them.
+type streamedBody struct {
+	pipe    *io.PipeReader
+	origin  io.Closer
+	run     func()
+	started sync.Once
+	done    chan struct{}
+}
+
+func (b *streamedBody) Read(p []byte) (int, error) {
+	b.started.Do(func() {
+		go func() {
+			defer close(b.done)
+			b.run()
+		}()
+	})
+	return b.pipe.Read(p)
+}
+
+// Close stops the transform, closing the origin body
+// Closing more than once is harmless.
+func (b *streamedBody) Close() error {
+	b.started.Do(func() { close(b.done) })
+	b.pipe.Close()
+	err := b.origin.Close()
+	<-b.done
+	return err
+}
@@ -0,0 +1,349 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/experiflow/proxy/internal/config"
+	"github.com/experiflow/proxy/internal/transform"
+	"golang.org/x/text/encoding/charmap"
+)
+
+var streamSpecs = map[string][]transform.Operation{
+	"hero": {
+		{Type: transform.OpSetText, Selector: "h1", Value: "Streamed"},
+		{Type: transform.OpAddClass, Selector: "body", Value: "exp-hero"},
+		{Type: transform.OpSetText, Selector: ".missing", Value: "x"},
+	},
+	"footer": {
+		{Type: transform.OpAppend, Selector: "footer", Value: "<p>Added</p>"},
+		{Type: transform.OpRemove, Selector: ".promo"},
+	},
+}
+
+// streamTestPage is long enough that the origin sends it in several
+// chunks, with the elements operations target in different ones
+var streamTestPage = `<!DOCTYPE html><html><head><title>Page</title></head><body><h1>Title</h1>` +
+	strings.Repeat(`<p class="filler">Lorem ipsum dolor sit amet.</p>`, 400) +
+	`<div class="promo">Sale</div><footer><p>Footer</p></footer></body></html>`
+
+// originHandler serves page in chunks, gzipped for /gzip, with a
+// Content-Length for /fixed
+func originHandler(page string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("ETag", `"origin"`)
+		if r.URL.Path == "/fixed" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(page)))
+			io.WriteString(w, page)
+			return
+		}
+
+		var out io.Writer = w
+		var gz *gzip.Writer
+		if r.URL.Path == "/gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz = gzip.NewWriter(w)
+			out = gz
+		}
+		for rest := page; rest != ""; {
+			n := min(len(rest), 1000)
+			io.WriteString(out, rest[:n])
+			rest = rest[n:]
+			if gz != nil {
+				gz.Flush()
+			}
+			w.(http.Flusher).Flush()
+		}
+		if gz != nil {
+			gz.Close()
+		}
+	}
+}
+
+// fetch requests path from a test proxy, returning the response with its
+// body read and decompressed
+func fetch(t *testing.T, proxy string, path string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", proxy+path, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = gz
+	}
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	return resp, string(raw)
+}
+
+// rendered parses and renders a page, so pages serialized differently
+// compare equal
+func rendered(t *testing.T, page string) string {
+	t.Helper()
+	doc, err := transform.ParseDocument([]byte(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := transform.RenderHTML(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestStreamMatchesBufferedResponse(t *testing.T) {
+	api := newTestAPI(t, streamSpecs)
+	experiments := []string{"hero", "footer"}
+	buffered := newTestProxy(t, newTestMiddleware(t, api, experiments, nil), originHandler(streamTestPage))
+	streamed := newTestProxy(t, newTestMiddleware(t, api, experiments, func(cfg *config.Config) {
+		cfg.StreamHTML = true
+	}), originHandler(streamTestPage))
+
+	for _, path := range []string{"/fixed", "/chunked", "/gzip"} {
+		t.Run(path, func(t *testing.T) {
+			wantResp, want := fetch(t, buffered.URL, path, nil)
+			resp, got := fetch(t, streamed.URL, path, nil)
+
+			if rendered(t, got) != rendered(t, want) {
+				t.Errorf("streamed body differs from buffered\n streamed %s\n buffered %s", got, want)
+			}
+			if !strings.Contains(got, "<h1>Streamed</h1>") || !strings.Contains(got, `<meta name="ef-applied" content="hero,footer"`) {
+				t.Errorf("streamed body not transformed: %s", got[:200])
+			}
+			if resp.ContentLength != -1 || resp.Header.Get("ETag") != "" {
+				t.Errorf("streamed response has Content-Length %d, ETag %q", resp.ContentLength, resp.Header.Get("ETag"))
+			}
+			if path == "/gzip" && resp.Header.Get("Content-Encoding") != "gzip" {
+				t.Errorf("Content-Encoding = %q, want gzip kept", resp.Header.Get("Content-Encoding"))
+			}
+
+			// The counts buffered responses send as headers come as trailers
+			for _, name := range operationTrailers {
+				if got, want := resp.Trailer.Get(name), wantResp.Header.Get(name); got != want {
+					t.Errorf("trailer %s = %q, buffered header %q", name, got, want)
+				}
+			}
+			if resp.Trailer.Get("X-EF-Ops") != "4/5" || resp.Trailer.Get("X-EF-Unmatched") != "1" {
+				t.Errorf("trailers = %v", resp.Trailer)
+			}
+			if resp.Header.Get("X-EF-Applied") != "hero,footer" {
+				t.Errorf("X-EF-Applied = %q", resp.Header.Get("X-EF-Applied"))
+			}
+		})
+	}
+}
+
+func TestStreamCharset(t *testing.T) {
+	api := newTestAPI(t, map[string][]transform.Operation{
+		"hero": {{Type: transform.OpSetText, Selector: "h1", Value: "Café"}},
+	})
+	m := newTestMiddleware(t, api, []string{"hero"}, func(cfg *config.Config) { cfg.StreamHTML = true })
+
+	t.Run("meta charset", func(t *testing.T) {
+		page, _ := charmap.Windows1252.NewEncoder().String(`<!DOCTYPE html><html><head><meta charset="windows-1252"><title>Crème</title></head><body><h1>x</h1></body></html>`)
+		proxy := newTestProxy(t, m, originHandler(page))
+		resp, body := fetch(t, proxy.URL, "/chunked", nil)
+		decoded, err := charmap.Windows1252.NewDecoder().String(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(decoded, "<title>Crème</title>") || !strings.Contains(decoded, "<h1>Café</h1>") {
+			t.Errorf("got %q", decoded)
+		}
+		if resp.Trailer.Get("X-EF-Ops") != "1/1" {
+			t.Errorf("not streamed: trailers %v, headers %v", resp.Trailer, resp.Header)
+		}
+	})
+
+	t.Run("unknown charset falls back to buffering", func(t *testing.T) {
+		page := `<!DOCTYPE html><html><head><meta charset="klingon"></head><body><h1>x</h1>` + strings.Repeat("<p>filler</p>", 200) + `</body></html>`
+		proxy := newTestProxy(t, m, originHandler(page))
+		resp, body := fetch(t, proxy.URL, "/chunked", nil)
+		if body != page {
+			t.Errorf("body changed: %q", body)
+		}
+		if got := resp.Header.Get("X-EF-Transform"); got != "skipped-charset" {
+			t.Errorf("X-EF-Transform = %q, want skipped-charset", got)
+		}
+	})
+
+	t.Run("page shorter than the prescan", func(t *testing.T) {
+		proxy := newTestProxy(t, m, originHandler(`<h1>x</h1>`))
+		_, body := fetch(t, proxy.URL, "/chunked", nil)
+		if body != `<h1>Café</h1>` {
+			t.Errorf("got %q", body)
+		}
+	})
+}
+
+func TestStreamFallsBackToBuffering(t *testing.T) {
+	api := newTestAPI(t, map[string][]transform.Operation{
+		"sibling": {{Type: transform.OpSetText, Selector: "h1 + p", Value: "Buffered"}},
+		"hero":    {{Type: transform.OpSetText, Selector: "h1", Value: "Hero"}},
+	})
+	page := `<h1>Title</h1><p>Text</p>`
+
+	tests := []struct {
+		name        string
+		experiments []string
+		header      http.Header
+		configure   func(*config.Config)
+	}{
+		{"unstreamable selector", []string{"sibling", "hero"}, nil, nil},
+		{"debug request", []string{"hero"}, http.Header{"X-Ef-Debug": {"secret"}}, func(cfg *config.Config) { cfg.DebugSecret = "secret" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMiddleware(t, api, tt.experiments, func(cfg *config.Config) {
+				cfg.StreamHTML = true
+				if tt.configure != nil {
+					tt.configure(cfg)
+				}
+			})
+			proxy := newTestProxy(t, m, originHandler(page))
+			resp, _ := fetch(t, proxy.URL, "/chunked", tt.header)
+			if resp.ContentLength <= 0 || resp.Header.Get("X-EF-Ops") == "" {
+				t.Errorf("not buffered: Content-Length %d, headers %v", resp.ContentLength, resp.Header)
+			}
+		})
+	}
+}
+
+// hangingOrigin is an origin body that never ends until closed
+type hangingOrigin struct {
+	*io.PipeReader
+	writer *io.PipeWriter
+}
+
+func newHangingOrigin(prefix string) *hangingOrigin {
+	r, w := io.Pipe()
+	go func() {
+		if _, err := io.WriteString(w, prefix); err != nil {
+			return
+		}
+		// Keep the origin open, writing filler until the body is closed
+		for {
+			if _, err := io.WriteString(w, "<p>more</p>"); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	return &hangingOrigin{PipeReader: r, writer: w}
+}
+
+func TestStreamedBodyClose(t *testing.T) {
+	api := newTestAPI(t, map[string][]transform.Operation{
+		"hero": {{Type: transform.OpSetText, Selector: "h1", Value: "Hero"}},
+	})
+	m := newTestMiddleware(t, api, []string{"hero"}, func(cfg *config.Config) { cfg.StreamHTML = true })
+
+	page := `<!DOCTYPE html><html><head><title>t</title></head><body><h1>x</h1>` + strings.Repeat("<p>start</p>", 200)
+	for _, readFirst := range []bool{true, false} {
+		origin := newHangingOrigin(page)
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"text/html"}}, Body: origin, Request: req}
+		if err := m.ModifyResponse(resp, req); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := resp.Body.(*streamedBody); !ok {
+			t.Fatalf("body is %T, want a streamed body", resp.Body)
+		}
+
+		if readFirst {
+			// The client reads the start of the page, then hangs up
+			buf := make([]byte, 512)
+			if _, err := io.ReadFull(resp.Body, buf); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Contains(buf, []byte("<h1>Hero</h1>")) {
+				t.Errorf("start of page not transformed: %s", buf)
+			}
+		}
+
+		closed := make(chan error, 1)
+		go func() { closed <- resp.Body.Close() }()
+		select {
+		case <-closed:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Close (read first: %v) didn't stop the transform", readFirst)
+		}
+		if _, err := io.WriteString(origin.writer, "x"); err == nil {
+			t.Errorf("origin body left open (read first: %v)", readFirst)
+		}
+		if err := resp.Body.Close(); err != nil {
+			t.Errorf("second Close: %v", err)
+		}
+	}
+}
+
+func TestStreamClientDisconnect(t *testing.T) {
+	api := newTestAPI(t, map[string][]transform.Operation{
+		"hero": {{Type: transform.OpSetText, Selector: "h1", Value: "Hero"}},
+	})
+	m := newTestMiddleware(t, api, []string{"hero"}, func(cfg *config.Config) { cfg.StreamHTML = true })
+
+	originDone := make(chan struct{})
+	proxy := newTestProxy(t, m, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(originDone)
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, `<!DOCTYPE html><html><body><h1>x</h1>`)
+		for {
+			if _, err := io.WriteString(w, strings.Repeat("<p>more</p>", 100)); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", proxy.URL+"/", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf, []byte("<h1>Hero</h1>")) {
+		t.Errorf("start of page not transformed: %s", buf)
+	}
+	cancel()
+	resp.Body.Close()
+
+	select {
+	case <-originDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("origin request still running after the client disconnected")
+	}
+}
@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+)
+
+// matchesPath reports whether an experiment targets the request path
+// Experiments without path rules run everywhere
+func (m *ExperiFlowMiddleware) matchesPath(req *http.Request, experimentID string) bool {
+	patterns, ok := m.config(req).ExperimentPaths[experimentID]
+	if !ok {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if matchPathPattern(pattern, req.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPathPattern matches a path against a glob pattern (see path.Match)
+// A trailing "*" also matches deeper paths, so "/products/*" matches
+// "/products/shoes/42"
+func matchPathPattern(pattern, requestPath string) bool {
+	if requestPath == "" {
+		requestPath = "/"
+	}
+
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok && !strings.ContainsAny(prefix, "*?[\\") {
+		return strings.HasPrefix(requestPath, prefix)
+	}
+
+	matched, err := path.Match(pattern, requestPath)
+	return err == nil && matched
+}
+
+// inExclusionGroups reports whether the user was selected for an experiment
+// in every exclusion group that contains it
+// Experiments outside any group are always eligible.
+func (m *ExperiFlowMiddleware) inExclusionGroups(req *http.Request, experimentID string) bool {
+	userID := ""
+	for groupID, experimentIDs := range m.config(req).ExclusionGroups {
+		if !slices.Contains(experimentIDs, experimentID) {
+			continue
+		}
+		if userID == "" {
+			userID = m.userID(req)
+		}
+		if m.current(req).assigner.SelectExperiment(userID, groupID, experimentIDs) != experimentID {
+			return false
+		}
+	}
+	return true
+}
+
+// inHoldback reports whether the user is in the global holdback
+func (m *ExperiFlowMiddleware) inHoldback(req *http.Request) bool {
+	if m.config(req).HoldbackPercent <= 0 {
+		return false
+	}
+	return m.current(req).holdback.InHoldback(m.userID(req), m.config(req).HoldbackPercent)
+}
+
+// isSampled reports whether the user is in the sampled share of traffic
+func (m *ExperiFlowMiddleware) isSampled(req *http.Request) bool {
+	if m.config(req).SamplePercent >= 100 {
+		return true
+	}
+	return m.current(req).assigner.Sampled(m.userID(req), m.config(req).SamplePercent)
+}
+
+// isBot reports whether the request comes from a configured bot User-Agent
+func (m *ExperiFlowMiddleware) isBot(req *http.Request) bool {
+	bots := m.current(req).bots
+	return bots != nil && bots.MatchString(req.UserAgent())
+}
+
+// isBypassed reports whether the request carries the configured bypass secret
+func (m *ExperiFlowMiddleware) isBypassed(req *http.Request) bool {
+	secret := m.config(req).BypassSecret
+	if secret == "" {
+		return false
+	}
+	given := req.Header.Get("X-EF-Bypass")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(secret)) == 1
+}
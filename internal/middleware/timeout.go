@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/experiflow/proxy/internal/transform"
+)
+
+// timeoutPolicy controls what happens when a transform spec fetch times out
+// or the API is unavailable
+type timeoutPolicy int
+
+const (
+	timeoutFollowFailOpen timeoutPolicy = iota // Treat it like any other error
+	timeoutFailOpen                            // Skip the experiment
+	timeoutServeStale                          // Apply the last cached spec, if any
+	timeoutFailClosed                          // Fail the request
+)
+
+// parseTimeoutPolicy converts an ON_TIMEOUT config value to its timeoutPolicy
+func parseTimeoutPolicy(value string) (timeoutPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "":
+		return timeoutFollowFailOpen, nil
+	case "fail-open":
+		return timeoutFailOpen, nil
+	case "serve-stale":
+		return timeoutServeStale, nil
+	case "fail-closed":
+		return timeoutFailClosed, nil
+	}
+	return timeoutFollowFailOpen, fmt.Errorf("invalid timeout policy %q: must be fail-open, serve-stale, or fail-closed", value)
+}
+
+// specTimeoutError is a spec fetch timeout whose policy overrides FailOpen
+type specTimeoutError struct {
+	err      error
+	failOpen bool
+}
+
+func (e *specTimeoutError) Error() string { return e.err.Error() }
+func (e *specTimeoutError) Unwrap() error { return e.err }
+
+// specAfterError applies the timeout policy to a failed spec fetch
+// Under serve-stale, a fetch that timed out or wasn't sent because the API
+// is unavailable is answered with the last cached spec; otherwise the
+// returned error carries the policy's decision.
+func (m *ExperiFlowMiddleware) specAfterError(req *http.Request, experimentID, variantID string, err error) (*transform.TransformSpec, error) {
+	err = fmt.Errorf("fetch transform spec: %w", err)
+	if !isTimeout(err) && !apiUnavailable(err) {
+		return nil, err
+	}
+
+	switch m.current(req).onTimeout {
+	case timeoutFailOpen:
+		return nil, &specTimeoutError{err: err, failOpen: true}
+	case timeoutFailClosed:
+		return nil, &specTimeoutError{err: err, failOpen: false}
+	case timeoutServeStale:
+		spec, ok := m.client.StaleTransformSpec(experimentID, variantID)
+		if !ok {
+			return nil, err
+		}
+		if m.config(req).EnableLogging {
+			slog.WarnContext(req.Context(), "Transform spec fetch timed out or API unavailable - serving stale spec",
+				"experiment_id", experimentID, "request_path", req.URL.Path, "error", err)
+		}
+		return spec, nil
+	}
+	return nil, err
+}
+
+// failsOpen reports whether an experiment that failed with err should be
+// skipped, leaving the page untransformed, rather than fail the request
+func (m *ExperiFlowMiddleware) failsOpen(req *http.Request, err error) bool {
+	var timeout *specTimeoutError
+	if errors.As(err, &timeout) {
+		return timeout.failOpen
+	}
+	return m.config(req).FailOpen
+}
+
+// apiUnavailable reports whether err is a call the client didn't send
+// because the circuit breaker is open or the rate limit was reached
+func apiUnavailable(err error) bool {
+	return errors.Is(err, transform.ErrCircuitOpen) || errors.Is(err, transform.ErrRateLimited)
+}
+
+// isTimeout reports whether err is a deadline or network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
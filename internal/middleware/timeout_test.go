@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/experiflow/proxy/internal/config"
+	"github.com/experiflow/proxy/internal/transform"
+)
+
+func TestSpecAfterErrorPolicy(t *testing.T) {
+	errs := map[string]error{
+		"timeout":      context.DeadlineExceeded,
+		"circuit open": transform.ErrCircuitOpen,
+		"rate limited": fmt.Errorf("fetch transform spec: %w", transform.ErrRateLimited),
+		"other":        errors.New("API error 500"),
+	}
+	tests := []struct {
+		onTimeout string
+		failOpen  bool
+		want      map[string]bool // Whether each error fails open
+	}{
+		{"fail-open", false, map[string]bool{"timeout": true, "circuit open": true, "rate limited": true, "other": false}},
+		{"fail-closed", true, map[string]bool{"timeout": false, "circuit open": false, "rate limited": false, "other": true}},
+	}
+	for _, tt := range tests {
+		m := NewExperiFlowMiddleware(&config.Config{OnTimeout: tt.onTimeout, FailOpen: tt.failOpen}, nil)
+		defer m.Close()
+		req := httptest.NewRequest("GET", "/", nil)
+		for name, fetchErr := range errs {
+			spec, err := m.specAfterError(req, "exp", "v1", fetchErr)
+			if spec != nil || err == nil {
+				t.Fatalf("%s/%s: got spec %v, err %v; want an error", tt.onTimeout, name, spec, err)
+			}
+			if got := m.failsOpen(req, err); got != tt.want[name] {
+				t.Errorf("%s/%s: failsOpen = %v, want %v", tt.onTimeout, name, got, tt.want[name])
+			}
+		}
+	}
+}
+
+func TestServeStaleWhileCircuitOpen(t *testing.T) {
+	var calls atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) > 1 {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"ttl":1,"operations":[{"type":"setText","selector":"h1","value":"B"}]}`))
+	}))
+	defer api.Close()
+
+	m := NewExperiFlowMiddleware(&config.Config{
+		APIBaseURL:       api.URL,
+		APITimeout:       time.Second,
+		OnTimeout:        "serve-stale",
+		SpecCacheSize:    10,
+		SpecStaleGrace:   time.Hour,
+		BreakerThreshold: 1,
+		BreakerCooldown:  time.Minute,
+	}, nil)
+	defer m.Close()
+	ctx := context.Background()
+	if _, err := m.client.GetTransformSpec(ctx, "exp", "v1"); err != nil {
+		t.Fatalf("first fetch: %v", err)
+	}
+	time.Sleep(1100 * time.Millisecond) // Let the spec expire
+
+	// The failed refetch opens the breaker, so the next one isn't sent
+	if _, err := m.client.GetTransformSpec(ctx, "exp", "v1"); err == nil {
+		t.Fatal("refetch succeeded, want an API error")
+	}
+	_, err := m.client.GetTransformSpec(ctx, "exp", "v1")
+	if !errors.Is(err, transform.ErrCircuitOpen) {
+		t.Fatalf("got %v, want ErrCircuitOpen", err)
+	}
+
+	spec, err := m.specAfterError(httptest.NewRequest("GET", "/", nil), "exp", "v1", err)
+	if err != nil {
+		t.Fatalf("specAfterError: %v", err)
+	}
+	if len(spec.Operations) != 1 {
+		t.Errorf("stale spec has %d operations, want 1", len(spec.Operations))
+	}
+}
+
+func TestAPIUnavailable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{transform.ErrCircuitOpen, true},
+		{fmt.Errorf("fetch variants: %w", transform.ErrRateLimited), true},
+		{context.DeadlineExceeded, false},
+		{errors.New("API error 503"), false},
+	}
+	for _, tt := range tests {
+		if got := apiUnavailable(tt.err); got != tt.want {
+			t.Errorf("apiUnavailable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
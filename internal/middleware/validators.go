@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// etagMode controls how cache validators are handled on transformed responses
+type etagMode int
+
+const (
+	etagRewrite  etagMode = iota // Replace the ETag with a hash of the delivered body
+	etagStrip                    // Remove the ETag
+	etagPreserve                 // Keep the origin's validators
+)
+
+// parseETagMode converts an ETAG_MODE config value to its etagMode
+func parseETagMode(value string) (etagMode, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "rewrite", "":
+		return etagRewrite, nil
+	case "strip":
+		return etagStrip, nil
+	case "preserve":
+		return etagPreserve, nil
+	}
+	return etagRewrite, fmt.Errorf("invalid ETag mode %q: must be rewrite, strip, or preserve", value)
+}
+
+// updateValidators replaces the origin's cache validators on a transformed
+// response so conditional requests can't match the untransformed bytes
+// Last-Modified is dropped in both rewrite and strip modes, since the
+// origin's timestamp says nothing about the experiment specs applied.
+func (m *ExperiFlowMiddleware) updateValidators(resp *http.Response, req *http.Request, body []byte) {
+	if m.current(req).etagMode == etagPreserve {
+		return
+	}
+
+	resp.Header.Del("Last-Modified")
+	if m.current(req).etagMode == etagStrip || resp.Header.Get("ETag") == "" {
+		resp.Header.Del("ETag")
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	resp.Header.Set("ETag", `"ef-`+hex.EncodeToString(sum[:16])+`"`)
+}
+
+// dropValidators removes the origin's cache validators from a response
+// streamed to the client, whose body can't be hashed before it is sent
+func (m *ExperiFlowMiddleware) dropValidators(resp *http.Response, req *http.Request) {
+	if m.current(req).etagMode == etagPreserve {
+		return
+	}
+	resp.Header.Del("Last-Modified")
+	resp.Header.Del("ETag")
+}
@@ -0,0 +1,74 @@
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+)
+
+// Header carries the request ID to and from clients, the origin, and the
+// ExperiFlow API
+const Header = "X-Request-ID"
+
+// maxLength bounds incoming IDs, which end up in logs and headers
+const maxLength = 128
+
+type contextKey struct{}
+
+// New returns a random request ID
+func New() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// FromHeader returns an incoming request ID if it is safe to propagate,
+// otherwise a new one
+// IDs are limited to printable ASCII without spaces or quotes.
+func FromHeader(value string) string {
+	if value == "" || len(value) > maxLength {
+		return New()
+	}
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c <= ' ' || c > '~' || c == '"' || c == '\\' {
+			return New()
+		}
+	}
+	return value
+}
+
+// NewContext returns a context carrying id
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID carried by ctx, or ""
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// LogHandler adds a request_id attribute to records logged with a context
+// that carries one
+type LogHandler struct {
+	slog.Handler
+}
+
+// Handle adds the request ID, if any, and passes the record on
+func (h LogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := FromContext(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+// WithAttrs keeps request IDs on loggers derived with With
+func (h LogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return LogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup keeps request IDs on loggers derived with WithGroup
+func (h LogHandler) WithGroup(name string) slog.Handler {
+	return LogHandler{h.Handler.WithGroup(name)}
+}
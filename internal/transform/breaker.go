@@ -0,0 +1,95 @@
+package transform
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without contacting the API while the circuit
+// breaker is open after repeated failures
+var ErrCircuitOpen = errors.New("circuit breaker open: ExperiFlow API unavailable")
+
+// circuitBreaker stops calls to a failing API for a cooldown period
+// After threshold consecutive failures it opens; once the cooldown passes
+// it lets a single probe through (half-open) and closes again on success
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int // Zero disables the breaker
+	cooldown  time.Duration
+
+	failures int
+	openedAt time.Time
+	open     bool
+	probing  bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a call may proceed
+func (b *circuitBreaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return true
+	}
+	// Half-open: let one probe through once the cooldown has passed
+	if !b.probing && time.Since(b.openedAt) >= b.cooldown {
+		b.probing = true
+		return true
+	}
+	return false
+}
+
+// success records a call that reached the API
+func (b *circuitBreaker) success() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.open = false
+	b.probing = false
+}
+
+// failure records a failed call, opening the breaker at the threshold
+// A failed half-open probe reopens it for another cooldown
+func (b *circuitBreaker) failure() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.probing || b.failures >= b.threshold {
+		b.open = true
+		b.probing = false
+		b.openedAt = time.Now()
+	}
+}
+
+// abandon records a call given up by its caller, which says nothing about
+// the API's health
+// A half-open probe is released so the next call can probe instead.
+func (b *circuitBreaker) abandon() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
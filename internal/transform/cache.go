@@ -0,0 +1,113 @@
+package transform
+
+import (
+	"sync"
+	"time"
+)
+
+// ttlCache is a bounded, concurrency-safe cache whose entries expire
+// Expired entries stay available to GetStale for the cache's grace period.
+type ttlCache[V any] struct {
+	mu         sync.Mutex
+	entries    map[string]cacheEntry[V]
+	maxEntries int
+	grace      time.Duration
+}
+
+type cacheEntry[V any] struct {
+	value     V
+	expiresAt time.Time
+}
+
+// newTTLCache creates a cache holding at most maxEntries entries
+func newTTLCache[V any](maxEntries int) *ttlCache[V] {
+	return &ttlCache[V]{
+		entries:    make(map[string]cacheEntry[V]),
+		maxEntries: maxEntries,
+	}
+}
+
+// withGrace keeps expired entries for grace, and returns the cache
+func (c *ttlCache[V]) withGrace(grace time.Duration) *ttlCache[V] {
+	c.grace = grace
+	return c
+}
+
+// Get returns the cached value for key if it has not expired
+func (c *ttlCache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// GetStale returns the cached value for key even if it has expired, as
+// long as it expired less than the grace period ago
+func (c *ttlCache[V]) GetStale(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expiresAt.Add(c.grace)) {
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// Set stores value under key for ttl
+// When the cache is full, entries past their grace period are dropped
+// first, then the entry closest to expiry is evicted
+func (c *ttlCache[V]) Set(key string, value V, ttl time.Duration) {
+	if ttl <= 0 || c.maxEntries <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.maxEntries {
+		c.evict(now)
+	}
+	c.entries[key] = cacheEntry[V]{value: value, expiresAt: now.Add(ttl)}
+}
+
+// DeleteFunc removes every entry whose key matches and returns how many
+// were removed
+func (c *ttlCache[V]) DeleteFunc(match func(key string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for key := range c.entries {
+		if match(key) {
+			delete(c.entries, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// evict makes room for one entry; the caller must hold c.mu
+func (c *ttlCache[V]) evict(now time.Time) {
+	var oldestKey string
+	var oldest time.Time
+	for key, entry := range c.entries {
+		if now.After(entry.expiresAt.Add(c.grace)) {
+			delete(c.entries, key)
+			continue
+		}
+		if oldestKey == "" || entry.expiresAt.Before(oldest) {
+			oldestKey, oldest = key, entry.expiresAt
+		}
+	}
+	if len(c.entries) >= c.maxEntries && oldestKey != "" {
+		delete(c.entries, oldestKey)
+	}
+}
@@ -4,42 +4,202 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
+	"strings"
 	"time"
+
+	"github.com/experiflow/proxy/internal/requestid"
 )
 
+// ErrBundleUnsupported is returned when the API has no assignment bundle
+// endpoint for an experiment; fall back to GetVariants and GetTransformSpec
+var ErrBundleUnsupported = errors.New("assignment bundle endpoint not available")
+
+// bundleRetryInterval is how long a 404 from the bundle endpoint is
+// remembered before it is tried again
+const bundleRetryInterval = 5 * time.Minute
+
+// variantsCacheSize bounds the number of experiments whose variants are cached
+const variantsCacheSize = 1000
+
+// noBundleCacheSize bounds the number of experiments remembered as having
+// no bundle endpoint, independently of SPEC_CACHE_SIZE
+const noBundleCacheSize = 1000
+
 // Client handles communication with the ExperiFlow API
 type Client struct {
 	baseURL    string
 	edgeToken  string
 	httpClient *http.Client
 	timeout    time.Duration
+	specs      *ttlCache[*TransformSpec] // Keyed by specCacheKey or sharedSpecKey
+	specKeys   *ttlCache[specRef]        // Where each variant's spec is in specs
+	noBundle   *ttlCache[bool]           // Experiments whose bundle endpoint returned 404
+	variants   *ttlCache[[]Variant]
+	seen       *ttlCache[bool] // Bundle variants already passed to onVariants
+
+	variantsTTL         time.Duration
+	variantsNegativeTTL time.Duration
+	onVariants          func(ctx context.Context, experimentID string, variants []Variant)
+
+	retries      int
+	retryBackoff time.Duration
+	breaker      *circuitBreaker
+	limiter      *rateLimiter
+}
+
+// ClientOptions holds optional tuning for the API client
+type ClientOptions struct {
+	// SpecCacheSize bounds the number of cached transform specs
+	// Zero disables spec caching
+	SpecCacheSize int
+
+	// SpecStaleGrace is how long expired specs are kept for
+	// StaleTransformSpec
+	SpecStaleGrace time.Duration
+
+	// VariantsTTL is how long an experiment's variant list is cached, and
+	// VariantsNegativeTTL how long an empty list is. Zero disables each.
+	VariantsTTL         time.Duration
+	VariantsNegativeTTL time.Duration
+
+	// OnVariants is called with each variant list fetched from the API, and
+	// with each variant an assignment bundle returns, when it is cached
+	// Lists served from the cache aren't passed again, so checks run once
+	// per fetch rather than once per assignment.
+	OnVariants func(ctx context.Context, experimentID string, variants []Variant)
+
+	// Retries is how many times connection errors and 5xx responses are
+	// retried, with exponential backoff starting at RetryBackoff
+	Retries      int
+	RetryBackoff time.Duration
+
+	// BreakerThreshold consecutive failures open the circuit breaker for
+	// BreakerCooldown, failing calls immediately. Zero disables it.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// RateLimit caps API requests per second, allowing bursts of RateBurst.
+	// Requests over it wait up to RateLimitWait for their turn, then fail
+	// with ErrRateLimited. Zero disables the limit.
+	RateLimit     float64
+	RateBurst     int
+	RateLimitWait time.Duration
+
+	// Connection pool tuning for the API transport; zero keeps the
+	// net/http defaults
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
 }
 
 // NewClient creates a new ExperiFlow API client
-func NewClient(baseURL, edgeToken string, timeout time.Duration) *Client {
+// Each call is bounded by both the client timeout and its context deadline.
+// A file:// base URL reads responses from a directory of JSON files
+// instead; see fileTransport.
+func NewClient(baseURL, edgeToken string, timeout time.Duration, opts ClientOptions) *Client {
+	var transport http.RoundTripper = newTransport(opts)
+	if strings.HasPrefix(baseURL, fileScheme) {
+		transport = newFileTransport(baseURL)
+	}
 	return &Client{
 		baseURL:   baseURL,
 		edgeToken: edgeToken,
 		httpClient: &http.Client{
-			Timeout: timeout,
+			Timeout:   timeout,
+			Transport: transport,
 		},
-		timeout: timeout,
+		timeout:      timeout,
+		specs:        newTTLCache[*TransformSpec](opts.SpecCacheSize).withGrace(opts.SpecStaleGrace),
+		specKeys:     newTTLCache[specRef](opts.SpecCacheSize).withGrace(opts.SpecStaleGrace),
+		noBundle:     newTTLCache[bool](noBundleCacheSize),
+		variants:     newTTLCache[[]Variant](variantsCacheSize),
+		seen:         newTTLCache[bool](variantsCacheSize),
+		retries:      opts.Retries,
+		retryBackoff: opts.RetryBackoff,
+		breaker:      newCircuitBreaker(opts.BreakerThreshold, opts.BreakerCooldown),
+		limiter:      newRateLimiter(opts.RateLimit, opts.RateBurst, opts.RateLimitWait),
+
+		variantsTTL:         opts.VariantsTTL,
+		variantsNegativeTTL: opts.VariantsNegativeTTL,
+		onVariants:          opts.OnVariants,
 	}
 }
 
+// newTransport builds a keep-alive transport with a pool sized for
+// repeated calls to the single API host
+func newTransport(opts ClientOptions) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableKeepAlives = false
+	if opts.MaxIdleConns > 0 {
+		transport.MaxIdleConns = opts.MaxIdleConns
+	}
+	if opts.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	}
+	if opts.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = opts.IdleConnTimeout
+	}
+	return transport
+}
+
+// Close releases idle connections to the API
+func (c *Client) Close() {
+	c.httpClient.CloseIdleConnections()
+}
+
+// FlushCaches drops cached specs, variant lists, and bundle endpoint
+// misses, for one experiment or for all when experimentID is empty
+// Returns the number of entries removed.
+func (c *Client) FlushCaches(experimentID string) int {
+	matchExperiment := func(key string) bool {
+		return experimentID == "" || key == experimentID
+	}
+	matchSpec := func(key string) bool {
+		return experimentID == "" || strings.HasPrefix(key, experimentID+":")
+	}
+	c.seen.DeleteFunc(matchSpec)
+	c.specKeys.DeleteFunc(matchSpec)
+	return c.specs.DeleteFunc(matchSpec) +
+		c.variants.DeleteFunc(matchExperiment) +
+		c.noBundle.DeleteFunc(matchExperiment)
+}
+
 // GetVariants fetches all variants for an experiment
+// Lists are cached per experiment; empty lists, typically for experiments
+// that don't exist, are cached for the shorter negative TTL.
 func (c *Client) GetVariants(ctx context.Context, experimentID string) ([]Variant, error) {
-	url := fmt.Sprintf("%s/behavior/experiments/%s/public/variants", c.baseURL, experimentID)
+	if variants, ok := c.variants.Get(experimentID); ok {
+		return append([]Variant(nil), variants...), nil
+	}
 
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	variants, err := c.fetchVariants(ctx, experimentID)
 	if err != nil {
-		return nil, fmt.Errorf("create request: %w", err)
+		return nil, err
 	}
 
-	resp, err := c.httpClient.Do(req)
+	ttl := c.variantsTTL
+	if len(variants) == 0 {
+		ttl = c.variantsNegativeTTL
+	}
+	c.variants.Set(experimentID, variants, ttl)
+	if c.onVariants != nil {
+		c.onVariants(ctx, experimentID, append([]Variant(nil), variants...))
+	}
+	return append([]Variant(nil), variants...), nil
+}
+
+// fetchVariants requests an experiment's variants from the API
+func (c *Client) fetchVariants(ctx context.Context, experimentID string) ([]Variant, error) {
+	url := fmt.Sprintf("%s/behavior/experiments/%s/public/variants", c.baseURL, experimentID)
+
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", url, nil)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("fetch variants: %w", err)
 	}
@@ -58,29 +218,221 @@ func (c *Client) GetVariants(ctx context.Context, experimentID string) ([]Varian
 	return variants, nil
 }
 
+// GetActiveExperiments fetches the IDs of experiments that should currently run
+func (c *Client) GetActiveExperiments(ctx context.Context) ([]string, error) {
+	url := fmt.Sprintf("%s/v1/experiments/active", c.baseURL)
+
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.edgeToken != "" {
+			req.Header.Set("Authorization", "Bearer "+c.edgeToken)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetch active experiments: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("API error %d: %s", resp.StatusCode, string(body))
+	}
+
+	var active ActiveExperimentsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&active); err != nil {
+		return nil, fmt.Errorf("decode active experiments: %w", err)
+	}
+
+	return active.ExperimentIDs, nil
+}
+
+// Ping checks that the API is reachable and accepts the edge token
+// It bypasses the circuit breaker and retries so that it reports the API's
+// current state.
+func (c *Client) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/v1/experiments/active", nil)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	if c.edgeToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.edgeToken)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("API error %d", resp.StatusCode)
+	}
+	return nil
+}
+
 // GetTransformSpec fetches the transform specification for a variant
+// Specs are cached in-process for the TTL (in seconds) the API returns
 func (c *Client) GetTransformSpec(ctx context.Context, experimentID, variantID string) (*TransformSpec, error) {
-	url := fmt.Sprintf("%s/v1/experiments/%s/transform-spec", c.baseURL, experimentID)
+	if spec, ok := c.cachedSpec(experimentID, variantID, false); ok {
+		return spec, nil
+	}
 
-	reqBody := map[string]string{
-		"variant_id": variantID,
+	spec, err := c.fetchTransformSpec(ctx, experimentID, variantID)
+	if err != nil {
+		return nil, err
 	}
-	jsonBody, err := json.Marshal(reqBody)
+
+	c.cacheSpec(experimentID, variantID, spec)
+	return spec.clone(), nil
+}
+
+// StaleTransformSpec returns the last spec fetched for a variant, even
+// past its TTL, as long as it expired within the stale grace period
+// It never calls the API.
+func (c *Client) StaleTransformSpec(experimentID, variantID string) (*TransformSpec, bool) {
+	return c.cachedSpec(experimentID, variantID, true)
+}
+
+// cachedSpec returns a copy of a variant's cached spec, including expired
+// ones within the grace period when stale is set
+// A spec shared through a CacheKey is given the requested variant's own
+// VariantID and VariantKey rather than those of the variant that stored it.
+func (c *Client) cachedSpec(experimentID, variantID string, stale bool) (*TransformSpec, bool) {
+	getRef, getSpec := c.specKeys.Get, c.specs.Get
+	if stale {
+		getRef, getSpec = c.specKeys.GetStale, c.specs.GetStale
+	}
+
+	key := specCacheKey(experimentID, variantID)
+	ref, hasRef := getRef(key)
+	if hasRef {
+		key = ref.key
+	}
+	spec, ok := getSpec(key)
+	if !ok {
+		return nil, false
+	}
+	spec = spec.clone()
+	if hasRef {
+		spec.VariantID, spec.VariantKey = ref.variantID, ref.variantKey
+	}
+	return spec, true
+}
+
+// specRef locates a variant's spec in the spec cache, along with the
+// variant identity the API returned for it
+type specRef struct {
+	key        string
+	variantID  string
+	variantKey string
+}
+
+// cacheSpec stores a variant's spec for its TTL
+// Variants of an experiment whose specs have the same CacheKey share one
+// entry, so a spec reused across variants is held once. Each variant's
+// VariantID and VariantKey are kept alongside in its specRef.
+func (c *Client) cacheSpec(experimentID, variantID string, spec *TransformSpec) {
+	ttl := time.Duration(spec.TTL) * time.Second
+	ref := specRef{key: specCacheKey(experimentID, variantID), variantID: spec.VariantID, variantKey: spec.VariantKey}
+	if spec.CacheKey != "" {
+		ref.key = sharedSpecKey(experimentID, spec.CacheKey)
+	}
+	c.specKeys.Set(specCacheKey(experimentID, variantID), ref, ttl)
+	c.specs.Set(ref.key, spec, ttl)
+}
+
+// GetAssignmentBundle asks the API to assign a variant for the user and
+// returns it together with its transform spec, saving a round trip
+// The spec is cached like one fetched by GetTransformSpec. Returns
+// ErrBundleUnsupported if the endpoint returns 404.
+func (c *Client) GetAssignmentBundle(ctx context.Context, experimentID, userID string, bucket float64) (*AssignmentBundleResponse, error) {
+	if _, ok := c.noBundle.Get(experimentID); ok {
+		return nil, ErrBundleUnsupported
+	}
+
+	url := fmt.Sprintf("%s/v1/experiments/%s/assignment-bundle", c.baseURL, experimentID)
+	jsonBody, err := json.Marshal(AssignmentBundleRequest{
+		ExperimentID: experimentID,
+		UserID:       userID,
+		Bucket:       bucket,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("marshal request: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(jsonBody))
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(jsonBody))
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		if c.edgeToken != "" {
+			req.Header.Set("Authorization", "Bearer "+c.edgeToken)
+		}
+		return req, nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("create request: %w", err)
+		return nil, fmt.Errorf("fetch assignment bundle: %w", err)
 	}
+	defer resp.Body.Close()
 
-	req.Header.Set("Content-Type", "application/json")
-	if c.edgeToken != "" {
-		req.Header.Set("Authorization", "Bearer "+c.edgeToken)
+	if resp.StatusCode == http.StatusNotFound {
+		c.noBundle.Set(experimentID, true, bundleRetryInterval)
+		return nil, ErrBundleUnsupported
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("API error %d: %s", resp.StatusCode, string(body))
 	}
 
-	resp, err := c.httpClient.Do(req)
+	var bundle AssignmentBundleResponse
+	if err := json.NewDecoder(resp.Body).Decode(&bundle); err != nil {
+		return nil, fmt.Errorf("decode assignment bundle: %w", err)
+	}
+	if bundle.Variant.ID == "" {
+		return nil, fmt.Errorf("assignment bundle has no variant")
+	}
+
+	key := specCacheKey(experimentID, bundle.Variant.ID)
+	c.cacheSpec(experimentID, bundle.Variant.ID, bundle.Spec.clone())
+	if _, ok := c.seen.Get(key); !ok && c.onVariants != nil {
+		c.seen.Set(key, true, c.variantsTTL)
+		c.onVariants(ctx, experimentID, []Variant{bundle.Variant})
+	}
+	return &bundle, nil
+}
+
+// fetchTransformSpec requests the transform specification from the API
+func (c *Client) fetchTransformSpec(ctx context.Context, experimentID, variantID string) (*TransformSpec, error) {
+	url := fmt.Sprintf("%s/v1/experiments/%s/transform-spec", c.baseURL, experimentID)
+
+	reqBody := map[string]string{
+		"variant_id": variantID,
+	}
+	jsonBody, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(jsonBody))
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		if c.edgeToken != "" {
+			req.Header.Set("Authorization", "Bearer "+c.edgeToken)
+		}
+		return req, nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("fetch transform spec: %w", err)
 	}
@@ -98,3 +450,93 @@ func (c *Client) GetTransformSpec(ctx context.Context, experimentID, variantID s
 
 	return &spec, nil
 }
+
+// do sends the request built by newRequest through the rate limiter and
+// circuit breaker
+// Calls fail immediately with ErrCircuitOpen while the breaker is open.
+// Calls over the rate limit fail with ErrRateLimited before reaching the
+// breaker, so shedding them neither counts as an API failure nor uses up a
+// half-open probe. Calls failing because their context was canceled or
+// ran out of time aren't API failures either.
+func (c *Client) do(ctx context.Context, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	if !c.breaker.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	resp, err := c.doWithRetry(ctx, newRequest)
+	switch {
+	case err != nil && ctx.Err() != nil:
+		c.breaker.abandon()
+	case err != nil || resp.StatusCode >= 500:
+		c.breaker.failure()
+	default:
+		c.breaker.success()
+	}
+	return resp, err
+}
+
+// doWithRetry sends the request built by newRequest, retrying connection
+// errors and 5xx responses with exponential backoff and jitter. Retries stop
+// once the next backoff would run past the context deadline; 4xx are never
+// retried. Retries count against the rate limit; one over it isn't sent,
+// and the failed attempt before it is returned.
+func (c *Client) doWithRetry(ctx context.Context, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, fmt.Errorf("create request: %w", err)
+		}
+		if id := requestid.FromContext(ctx); id != "" {
+			req.Header.Set(requestid.Header, id)
+		}
+
+		resp, err := c.httpClient.Do(req)
+		retryable := (err != nil && ctx.Err() == nil) || (err == nil && resp.StatusCode >= 500)
+		if !retryable || attempt >= c.retries {
+			return resp, err
+		}
+
+		delay := c.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return resp, err
+		}
+		select {
+		case <-ctx.Done():
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		if c.limiter.wait(ctx) != nil {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+// backoff returns the delay before the given retry attempt:
+// exponential growth from retryBackoff with up to 50% jitter
+func (c *Client) backoff(attempt int) time.Duration {
+	delay := c.retryBackoff << attempt
+	if delay <= 0 {
+		return 0
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// specCacheKey identifies a cached spec by the request that fetched it
+func specCacheKey(experimentID, variantID string) string {
+	return experimentID + ":" + variantID
+}
+
+// sharedSpecKey identifies a cached spec by its CacheKey, under the same
+// experiment prefix as specCacheKey so FlushCaches finds it
+func sharedSpecKey(experimentID, cacheKey string) string {
+	return experimentID + ":=" + cacheKey
+}
@@ -0,0 +1,244 @@
+package transform
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedCallsDontOpenBreaker(t *testing.T) {
+	var calls atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`[{"id":"v1","name":"control","is_control":true}]`))
+	}))
+	defer api.Close()
+
+	client := NewClient(api.URL, "", time.Second, ClientOptions{
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Minute,
+		RateLimit:        0.001,
+		RateBurst:        1,
+	})
+	defer client.Close()
+
+	if _, err := client.GetVariants(context.Background(), "exp"); err != nil {
+		t.Fatalf("first call: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		_, err := client.GetVariants(context.Background(), "exp")
+		if !errors.Is(err, ErrRateLimited) {
+			t.Fatalf("call %d: got %v, want ErrRateLimited", i, err)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("API received %d calls, want 1", calls.Load())
+	}
+	if !client.breaker.allow() {
+		t.Error("breaker opened after rate-limited calls")
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxWait time.Duration
+		timeout time.Duration
+		wantErr error
+	}{
+		{"no wait allowed", 0, time.Second, ErrRateLimited},
+		{"waits for token", time.Second, time.Second, nil},
+		{"deadline too soon", time.Second, 10 * time.Millisecond, ErrRateLimited},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := newRateLimiter(20, 1, tt.maxWait)
+			if err := limiter.wait(context.Background()); err != nil {
+				t.Fatalf("first wait: %v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			start := time.Now()
+			err := limiter.wait(ctx)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && time.Since(start) < 30*time.Millisecond {
+				t.Errorf("returned after %s, before a token refilled", time.Since(start))
+			}
+		})
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	limiter := newRateLimiter(0, 0, 0)
+	for i := 0; i < 100; i++ {
+		if err := limiter.wait(context.Background()); err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+	}
+}
+
+func TestOnVariantsCalledPerFetch(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/assignment-bundle") {
+			w.Write([]byte(`{"variant":{"id":"v2","name":"treatment"},"spec":{"operations":[]}}`))
+			return
+		}
+		w.Write([]byte(`[{"id":"v1","name":"control","is_control":true},{"id":"v2","name":"treatment"}]`))
+	}))
+	defer api.Close()
+
+	var lists [][]Variant
+	client := NewClient(api.URL, "", time.Second, ClientOptions{
+		VariantsTTL: time.Minute,
+		OnVariants: func(_ context.Context, _ string, variants []Variant) {
+			lists = append(lists, variants)
+		},
+	})
+	defer client.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if _, err := client.GetVariants(ctx, "exp"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.GetAssignmentBundle(ctx, "exp", "user", 0.5); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(lists) != 2 || len(lists[0]) != 2 || len(lists[1]) != 1 {
+		t.Fatalf("OnVariants got %v, want the list and the bundle variant once each", lists)
+	}
+
+	client.FlushCaches("exp")
+	if _, err := client.GetVariants(ctx, "exp"); err != nil {
+		t.Fatal(err)
+	}
+	if len(lists) != 3 {
+		t.Errorf("OnVariants called %d times, want 3 after refetching the flushed list", len(lists))
+	}
+}
+
+func TestNoBundleRememberedWithoutSpecCache(t *testing.T) {
+	var calls atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer api.Close()
+
+	client := NewClient(api.URL, "", time.Second, ClientOptions{SpecCacheSize: 0})
+	defer client.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := client.GetAssignmentBundle(context.Background(), "exp", "user", 0.5)
+		if !errors.Is(err, ErrBundleUnsupported) {
+			t.Fatalf("call %d: got %v, want ErrBundleUnsupported", i, err)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("bundle endpoint called %d times, want 1", calls.Load())
+	}
+}
+
+func TestCanceledCallsDontOpenBreaker(t *testing.T) {
+	var calls atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-r.Context().Done()
+	}))
+	defer api.Close()
+
+	client := NewClient(api.URL, "", time.Minute, ClientOptions{
+		BreakerThreshold: 1,
+		BreakerCooldown:  time.Minute,
+	})
+	defer client.Close()
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		_, err := client.GetVariants(ctx, "exp")
+		cancel()
+		if err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("call %d: got %v, want the context error", i, err)
+		}
+	}
+	if calls.Load() != 3 {
+		t.Errorf("API received %d calls, want 3", calls.Load())
+	}
+}
+
+func TestAbandonedProbeReleased(t *testing.T) {
+	breaker := newCircuitBreaker(1, 0)
+	breaker.failure()
+	if !breaker.allow() {
+		t.Fatal("no probe after the cooldown")
+	}
+	if breaker.allow() {
+		t.Fatal("second probe allowed while the first is in flight")
+	}
+	breaker.abandon()
+	if !breaker.allow() {
+		t.Error("no probe after the first was abandoned")
+	}
+}
+
+func TestSpecsShareCacheKey(t *testing.T) {
+	var calls atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		var req struct {
+			VariantID string `json:"variant_id"`
+		}
+		json.Unmarshal(body, &req)
+		cacheKey := "shared"
+		if req.VariantID == "v3" {
+			cacheKey = ""
+		}
+		w.Write([]byte(`{"ttl":60,"cache_key":"` + cacheKey + `","variant_id":"` + req.VariantID + `","variant_key":"key-` + req.VariantID + `","operations":[{"type":"setText","selector":"h1","value":"B"}]}`))
+	}))
+	defer api.Close()
+
+	client := NewClient(api.URL, "", time.Second, ClientOptions{SpecCacheSize: 10})
+	defer client.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		for _, variantID := range []string{"v1", "v2", "v3"} {
+			spec, err := client.GetTransformSpec(ctx, "exp", variantID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(spec.Operations) != 1 {
+				t.Fatalf("%s: got %d operations, want 1", variantID, len(spec.Operations))
+			}
+			if spec.VariantID != variantID || spec.VariantKey != "key-"+variantID {
+				t.Errorf("%s: got variant %s (%s)", variantID, spec.VariantID, spec.VariantKey)
+			}
+		}
+	}
+	if calls.Load() != 3 {
+		t.Errorf("API received %d calls, want one per variant", calls.Load())
+	}
+	if n := len(client.specs.entries); n != 2 {
+		t.Errorf("cache holds %d specs, want 2: the shared one and v3's", n)
+	}
+	if spec, ok := client.StaleTransformSpec("exp", "v1"); !ok {
+		t.Error("no stale spec for v1")
+	} else if spec.VariantID != "v1" || spec.VariantKey != "key-v1" {
+		t.Errorf("stale spec for v1 has variant %s (%s)", spec.VariantID, spec.VariantKey)
+	}
+	if removed := client.FlushCaches("exp"); removed != 2 {
+		t.Errorf("FlushCaches removed %d specs, want 2", removed)
+	}
+}
@@ -0,0 +1,60 @@
+package transform
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// textCondition tests a node's current text content
+type textCondition func(text string) bool
+
+// parseTextCondition parses a condition of the form "<test>:<value>"
+// test is equals, contains, or matches (a regular expression); prefix it
+// with "!" to negate. Text is compared with surrounding whitespace trimmed.
+func parseTextCondition(condition string) (textCondition, error) {
+	test, value, ok := strings.Cut(condition, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid condition %q: want <test>:<value>", condition)
+	}
+	negate := strings.HasPrefix(test, "!")
+	test = strings.TrimPrefix(test, "!")
+
+	var cond textCondition
+	switch test {
+	case "equals":
+		cond = func(text string) bool { return text == value }
+	case "contains":
+		cond = func(text string) bool { return strings.Contains(text, value) }
+	case "matches":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid condition pattern: %w", err)
+		}
+		cond = re.MatchString
+	default:
+		return nil, fmt.Errorf("unknown condition test %q: must be equals, contains, or matches", test)
+	}
+
+	return func(text string) bool {
+		return cond(strings.TrimSpace(text)) != negate
+	}, nil
+}
+
+// textContent returns the concatenated text of a node and its descendants
+func textContent(node *html.Node) string {
+	var b strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(node)
+	return b.String()
+}
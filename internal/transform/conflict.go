@@ -0,0 +1,90 @@
+package transform
+
+import (
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// write identifies one property of one node, such as its display style
+type write struct {
+	node     *html.Node
+	property string
+}
+
+// lastWrite is the operation that last set a property, and its value
+type lastWrite struct {
+	index int
+	value string
+}
+
+// writeLog records which operation in a spec last set each property of
+// each node, so operations setting one already set to something else can
+// be reported
+type writeLog map[write]lastWrite
+
+// record notes the operation at index setting its properties on a node
+// it changed, adding to conflicts the indexes of earlier operations that
+// set any of them to a different value
+func (w writeLog) record(node *html.Node, op Operation, index int, conflicts []int) []int {
+	if w == nil {
+		return conflicts
+	}
+	for _, set := range writtenProperties(op) {
+		key := write{node: node, property: set.property}
+		if prev, ok := w[key]; ok && prev.value != set.value && prev.index != index {
+			conflicts = addIndex(conflicts, prev.index)
+		}
+		w[key] = lastWrite{index: index, value: set.value}
+	}
+	return conflicts
+}
+
+// propertyWrite is a property an operation sets, and what it sets it to
+type propertyWrite struct {
+	property, value string
+}
+
+// writtenProperties returns the properties an operation sets on each node
+// it changes; structural operations, which move or remove nodes, set none
+func writtenProperties(op Operation) []propertyWrite {
+	switch op.Type {
+	case OpSetText, OpSetTextContent, OpSetTextIf:
+		return []propertyWrite{{"content", op.text()}}
+	case OpSetHTML:
+		return []propertyWrite{{"content", op.Value}}
+	case OpSetStyle:
+		return []propertyWrite{{"style:" + strings.ToLower(strings.TrimSpace(op.Property)), op.Value}}
+	case OpHide:
+		return []propertyWrite{{"style:display", "none"}}
+	case OpShow:
+		return []propertyWrite{{"style:display", ""}}
+	case OpSetAttr, OpSetAttrIfAbsent:
+		return []propertyWrite{{"attr:" + strings.ToLower(op.Property), op.Value}}
+	case OpSetData:
+		key, err := dataAttrKey(op.Property)
+		if err != nil {
+			return nil
+		}
+		return []propertyWrite{{"attr:" + key, op.Value}}
+	case OpSetJSONField:
+		return []propertyWrite{{"json:" + op.Property, op.Value}}
+	case OpAddClass, OpRemoveClass, OpToggleClass:
+		var writes []propertyWrite
+		for _, name := range strings.Fields(op.Value) {
+			writes = append(writes, propertyWrite{"class:" + name, op.Type})
+		}
+		return writes
+	}
+	return nil
+}
+
+// addIndex adds index to a sorted list of indexes, unless it's there
+func addIndex(indexes []int, index int) []int {
+	i := sort.SearchInts(indexes, index)
+	if i < len(indexes) && indexes[i] == index {
+		return indexes
+	}
+	return append(indexes[:i], append([]int{index}, indexes[i:]...)...)
+}
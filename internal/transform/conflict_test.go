@@ -0,0 +1,107 @@
+package transform
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConflicts(t *testing.T) {
+	tests := []struct {
+		name string
+		page string
+		ops  []Operation
+		want map[int][]int // Conflicts by operation index; others have none
+	}{
+		{
+			name: "text set twice",
+			page: `<h1>Title</h1>`,
+			ops: []Operation{
+				{Type: OpSetText, Selector: "h1", Value: "A"},
+				{Type: OpSetText, Selector: "h1", Value: "B"},
+			},
+			want: map[int][]int{1: {0}},
+		},
+		{
+			name: "same value twice",
+			page: `<h1>Title</h1>`,
+			ops: []Operation{
+				{Type: OpSetText, Selector: "h1", Value: "A"},
+				{Type: OpSetText, Selector: "h1", Value: "A"},
+			},
+		},
+		{
+			name: "condition left the node alone",
+			page: `<h1>Title</h1>`,
+			ops: []Operation{
+				{Type: OpSetText, Selector: "h1", Value: "A"},
+				{Type: OpSetTextIf, Selector: "h1", Property: "equals:Title", Value: "B"},
+				{Type: OpSetText, Selector: "h1", Value: "A"},
+			},
+		},
+		{
+			name: "condition held",
+			page: `<h1>Title</h1>`,
+			ops: []Operation{
+				{Type: OpSetText, Selector: "h1", Value: "A"},
+				{Type: OpSetTextIf, Selector: "h1", Property: "equals:A", Value: "B"},
+			},
+			want: map[int][]int{1: {0}},
+		},
+		{
+			name: "attribute already present",
+			page: `<a href="/old">Link</a>`,
+			ops: []Operation{
+				{Type: OpSetAttr, Selector: "a", Property: "title", Value: "x"},
+				{Type: OpSetAttrIfAbsent, Selector: "a", Property: "title", Value: "y"},
+				{Type: OpSetAttr, Selector: "a", Property: "title", Value: "x"},
+			},
+		},
+		{
+			name: "attribute absent",
+			page: `<a href="/old">Link</a>`,
+			ops: []Operation{
+				{Type: OpSetAttrIfAbsent, Selector: "a", Property: "title", Value: "y"},
+				{Type: OpSetAttr, Selector: "a", Property: "title", Value: "x"},
+			},
+			want: map[int][]int{1: {0}},
+		},
+		{
+			name: "only changed nodes count",
+			page: `<p>keep</p><p>swap</p>`,
+			ops: []Operation{
+				{Type: OpSetText, Selector: "p", Value: "A"},
+				{Type: OpSetTextIf, Selector: "p", Property: "equals:never", Value: "B"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, results, err := Apply(tt.page, tt.ops)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkConflicts(t, "buffered", results, tt.want)
+
+			if !CanStream(tt.ops) {
+				return
+			}
+			var out bytes.Buffer
+			streamed, err := StreamTransformations(&out, strings.NewReader(tt.page), [][]Operation{tt.ops}, ApplyOptions{}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkConflicts(t, "streamed", streamed[0], tt.want)
+		})
+	}
+}
+
+func checkConflicts(t *testing.T, path string, results []OpResult, want map[int][]int) {
+	t.Helper()
+	for _, res := range results {
+		if !reflect.DeepEqual(res.Conflicts, want[res.Index]) {
+			t.Errorf("%s: operation %d conflicts = %v, want %v", path, res.Index, res.Conflicts, want[res.Index])
+		}
+	}
+}
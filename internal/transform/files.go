@@ -0,0 +1,110 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fileScheme marks an API base URL as a directory of spec files, read in
+// place of the API for local development
+const fileScheme = "file://"
+
+// fileTransport answers API requests from JSON files laid out like the
+// API's responses:
+//
+//	<dir>/active.json                    {"experiment_ids": [...]}
+//	<dir>/<experiment>/variants.json     [{"id": ..., "name": ...}, ...]
+//	<dir>/<experiment>/<variant ID>.json a transform spec
+//
+// Missing files are 404s, as are assignment bundles, so the client falls
+// back to fetching variants and specs. Files are read on every request;
+// the client's caches apply as usual.
+type fileTransport struct {
+	base string // The directory as it appears in request URLs
+	dir  string
+}
+
+// newFileTransport returns a transport reading files under the directory
+// a file:// base URL names, such as file:///srv/specs or file://specs
+func newFileTransport(baseURL string) *fileTransport {
+	base := strings.TrimPrefix(baseURL, fileScheme)
+	return &fileTransport{base: base, dir: filepath.FromSlash(base)}
+}
+
+func (t *fileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+	file, err := t.file(req)
+	if err != nil {
+		return fileResponse(req, http.StatusBadRequest, []byte(err.Error())), nil
+	}
+	if file == "" {
+		return fileResponse(req, http.StatusNotFound, nil), nil
+	}
+
+	body, err := os.ReadFile(file)
+	switch {
+	case os.IsNotExist(err):
+		return fileResponse(req, http.StatusNotFound, []byte(err.Error())), nil
+	case err != nil:
+		return fileResponse(req, http.StatusInternalServerError, []byte(err.Error())), nil
+	}
+	return fileResponse(req, http.StatusOK, body), nil
+}
+
+// file returns the path of the file answering an API request, or "" for
+// requests with no file
+func (t *fileTransport) file(req *http.Request) (string, error) {
+	// Relative directories start in the URL's host
+	path := "/" + strings.Trim(strings.TrimPrefix(req.URL.Host+req.URL.Path, t.base), "/")
+	parts := strings.Split(path[1:], "/")
+	switch {
+	case path == "/v1/experiments/active":
+		return filepath.Join(t.dir, "active.json"), nil
+	case len(parts) == 5 && parts[0] == "behavior" && parts[3] == "public" && parts[4] == "variants":
+		return t.join(parts[2], "variants.json")
+	case len(parts) == 4 && parts[0] == "v1" && parts[3] == "transform-spec":
+		var body struct {
+			VariantID string `json:"variant_id"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return "", fmt.Errorf("decode request: %w", err)
+		}
+		return t.join(parts[2], body.VariantID+".json")
+	}
+	return "", nil
+}
+
+// join returns the path of a file in an experiment's directory
+// Experiment and variant IDs come from config and cookies, so names
+// that would leave the directory are rejected.
+func (t *fileTransport) join(experimentID, name string) (string, error) {
+	for _, part := range []string{experimentID, name} {
+		if !filepath.IsLocal(part) || strings.ContainsAny(part, `/\`) {
+			return "", fmt.Errorf("invalid file name %q", part)
+		}
+	}
+	return filepath.Join(t.dir, experimentID, name), nil
+}
+
+// fileResponse builds a JSON response to req
+func fileResponse(req *http.Request, status int, body []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,81 @@
+package transform
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// ErrProtectedHeader is reported for header operations on headers the
+// proxy manages, which experiments may not change
+var ErrProtectedHeader = errors.New("header is protected")
+
+// Header operation types
+const (
+	HeaderSet    = "set"    // Replace all values
+	HeaderAdd    = "add"    // Append a value
+	HeaderRemove = "remove" // Delete all values
+)
+
+// HeaderOperation changes a response header
+type HeaderOperation struct {
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+}
+
+// protectedHeaders describe the body's framing and encoding, or are
+// hop-by-hop, so changing them would corrupt the response
+var protectedHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Encoding":  true,
+	"Content-Length":    true,
+	"Content-Type":      true,
+	"Keep-Alive":        true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+	"X-Request-Id":      true,
+}
+
+// ApplyHeaderOperations applies header operations in order and returns an
+// error for each one that was rejected
+// Headers the proxy reports on (X-EF-*) can't be changed either.
+func ApplyHeaderOperations(header http.Header, ops []HeaderOperation) []error {
+	var errs []error
+	for i, op := range ops {
+		if err := applyHeaderOperation(header, op); err != nil {
+			errs = append(errs, fmt.Errorf("header operation %d (%s %q): %w", i, op.Type, op.Name, err))
+		}
+	}
+	return errs
+}
+
+// applyHeaderOperation applies a single header operation
+func applyHeaderOperation(header http.Header, op HeaderOperation) error {
+	if !httpguts.ValidHeaderFieldName(op.Name) {
+		return fmt.Errorf("invalid header name")
+	}
+	name := http.CanonicalHeaderKey(op.Name)
+	if protectedHeaders[name] || strings.HasPrefix(name, "X-Ef-") {
+		return ErrProtectedHeader
+	}
+	if op.Type != HeaderRemove && !httpguts.ValidHeaderFieldValue(op.Value) {
+		return fmt.Errorf("invalid header value")
+	}
+
+	switch op.Type {
+	case HeaderSet:
+		header.Set(name, op.Value)
+	case HeaderAdd:
+		header.Add(name, op.Value)
+	case HeaderRemove:
+		header.Del(name)
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownOperation, op.Type)
+	}
+	return nil
+}
@@ -2,53 +2,279 @@ package transform
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 
 	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
+// ErrNoMatch is reported for operations whose selector matched nothing,
+// the most common spec authoring mistake
+var ErrNoMatch = errors.New("no elements found for selector")
+
+// ErrTooManyOperations is returned for specs with more operations than
+// ApplyOptions.MaxOperations allows
+var ErrTooManyOperations = errors.New("too many operations in spec")
+
+// ErrTooManyMatches is reported for operations whose selector matched more
+// nodes than ApplyOptions.MaxMatchedNodes allows
+var ErrTooManyMatches = errors.New("selector matched too many nodes")
+
+// ErrUnknownOperation is reported for operation types this proxy doesn't
+// support, typically from a newer spec format
+var ErrUnknownOperation = errors.New("unknown operation type")
+
+// ErrInvalidJSON is reported for setJSONField operations whose script
+// doesn't hold valid JSON; the script is left untouched
+var ErrInvalidJSON = errors.New("script content is not valid JSON")
+
+// ApplyOptions controls how operations are applied
+type ApplyOptions struct {
+	// AllowUnsafeHTML skips sanitization of injected HTML fragments
+	// Only enable this when the transform spec source is fully trusted
+	AllowUnsafeHTML bool
+
+	// ScriptNonce and StyleNonce are stamped onto injected <script> and
+	// <style> elements so they pass the page's Content-Security-Policy
+	ScriptNonce string
+	StyleNonce  string
+
+	// MaxOperations and MaxMatchedNodes bound the work done per spec and
+	// per operation; zero means no limit
+	MaxOperations   int
+	MaxMatchedNodes int
+}
+
+// Apply parses an HTML document or fragment, applies operations to it with
+// default options, and returns the rendered result with each operation's
+// outcome, for checking specs against captured pages
+func Apply(htmlInput string, operations []Operation) (string, []OpResult, error) {
+	doc, err := ParseDocument([]byte(htmlInput))
+	if err != nil {
+		return "", nil, fmt.Errorf("parse HTML: %w", err)
+	}
+
+	results, err := ApplyTransformations(doc, operations, ApplyOptions{})
+	if err != nil {
+		return "", nil, err
+	}
+
+	output, err := RenderHTML(doc)
+	if err != nil {
+		return "", nil, fmt.Errorf("render HTML: %w", err)
+	}
+	return output, results, nil
+}
+
 // ApplyTransformations applies a list of operations to an HTML document
-func ApplyTransformations(doc *html.Node, operations []Operation) error {
-	for _, op := range operations {
-		if err := applyOperation(doc, op); err != nil {
-			// Log error but continue with other operations
-			fmt.Printf("Warning: failed to apply operation %v: %v\n", op, err)
-		}
+// Operations run in ascending Priority order; ties keep their spec order.
+// When several set the same property of a node, the last one applied wins
+// and the conflict is reported in its result.
+// Cleanup operations run after all others, so they see the final tree.
+// Failed operations don't stop the others; each outcome is reported in
+// the returned results, in the order the operations were applied. Specs
+// over opts.MaxOperations are rejected before any operation is applied.
+func ApplyTransformations(doc *html.Node, operations []Operation, opts ApplyOptions) ([]OpResult, error) {
+	if opts.MaxOperations > 0 && len(operations) > opts.MaxOperations {
+		return nil, fmt.Errorf("%w: %d (limit %d)", ErrTooManyOperations, len(operations), opts.MaxOperations)
 	}
-	return nil
+
+	results := make([]OpResult, 0, len(operations))
+	scopes, writes := scopeCache{}, writeLog{}
+	for _, i := range applicationOrder(operations) {
+		op := operations[i]
+		matched, skipped, conflicts, err := applyOperation(doc, op, i, opts, scopes, writes)
+		results = append(results, OpResult{
+			Index:     i,
+			Type:      op.Type,
+			Selector:  op.Selector,
+			Matched:   matched,
+			Skipped:   skipped,
+			Err:       err,
+			Conflicts: conflicts,
+		})
+	}
+	return results, nil
 }
 
-// applyOperation applies a single operation to the HTML document
-func applyOperation(doc *html.Node, op Operation) error {
+// applicationOrder returns operation indexes sorted by ascending Priority,
+// keeping spec order for ties, with cleanup operations last
+func applicationOrder(operations []Operation) []int {
+	order := make([]int, len(operations))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		opA, opB := operations[order[a]], operations[order[b]]
+		if isCleanup(opA.Type) != isCleanup(opB.Type) {
+			return !isCleanup(opA.Type)
+		}
+		return opA.Priority < opB.Priority
+	})
+	return order
+}
+
+// isCleanup reports whether an operation tidies up after the others
+func isCleanup(opType string) bool {
+	return opType == OpRemoveIfEmpty
+}
+
+// applyOperation applies a single operation, at index in its spec, to the
+// HTML document
+// Returns the number of nodes the selector matched, how many of them were
+// skipped, beyond the operation's limit or because its condition didn't
+// hold, and the earlier operations whose properties it set differently.
+// writes may be nil to skip looking for conflicts.
+func applyOperation(doc *html.Node, op Operation, index int, opts ApplyOptions, scopes scopeCache, writes writeLog) (int, int, []int, error) {
+	if !knownOperations[op.Type] {
+		return 0, 0, nil, fmt.Errorf("%w: %s", ErrUnknownOperation, op.Type)
+	}
+
 	// Find the target element(s)
-	nodes := findNodesBySelector(doc, op.Selector)
+	nodes := scopes.find(doc, op)
 	if len(nodes) == 0 {
-		return fmt.Errorf("no elements found for selector: %s", op.Selector)
+		return 0, 0, nil, fmt.Errorf("%w: %s", ErrNoMatch, targetLabel(op))
+	}
+	matched := len(nodes)
+
+	// Nodes past the limit count as skipped, and don't count against
+	// MaxMatchedNodes since they are left alone
+	nodes = limitNodes(nodes, op.Limit)
+	if opts.MaxMatchedNodes > 0 && len(nodes) > opts.MaxMatchedNodes {
+		return matched, 0, nil, fmt.Errorf("%w: %d (limit %d)", ErrTooManyMatches, len(nodes), opts.MaxMatchedNodes)
+	}
+
+	// Moves relocate all matched nodes together so they keep their order
+	if op.Type == OpMove {
+		return matched, matched - len(nodes), nil, moveNodes(doc, nodes, op.Value, op.Property)
+	}
+
+	skipped, conflicts, err := applyToNodes(nodes, op, index, opts, writes)
+	return matched, matched - len(nodes) + skipped, conflicts, err
+}
+
+// applyToNodes applies an operation other than move, at index in its spec,
+// to each of nodes, in order, stopping at the first error
+// Returns how many nodes a condition left alone, and the earlier operations
+// in writes whose properties it set differently on the nodes it changed.
+func applyToNodes(nodes []*html.Node, op Operation, index int, opts ApplyOptions, writes writeLog) (int, []int, error) {
+	var condition textCondition
+	if op.Type == OpSetTextIf {
+		var err error
+		if condition, err = parseTextCondition(op.Property); err != nil {
+			return 0, nil, err
+		}
 	}
 
+	skipped := 0
+	var conflicts []int
 	for _, node := range nodes {
+		wasSkipped := skipped
 		switch op.Type {
 		case OpSetText:
-			setText(node, op.Value)
+			setText(node, op.text())
+		case OpSetTextContent:
+			setTextContent(node, op.text())
 		case OpSetStyle:
 			setStyle(node, op.Property, op.Value)
 		case OpSetAttr:
-			setAttr(node, op.Property, op.Value)
+			setAttrValue(node, op.Property, op.Value)
+		case OpSetAttrIfAbsent:
+			if hasAttr(node, op.Property) {
+				skipped++
+			} else {
+				setAttrValue(node, op.Property, op.Value)
+			}
 		case OpSetHTML:
-			setHTML(node, op.Value)
+			setHTML(node, op.Value, opts)
 		case OpRemove:
 			removeNode(node)
 		case OpHide:
 			setStyle(node, "display", "none")
 		case OpShow:
 			setStyle(node, "display", "")
+		case OpAddClass:
+			addClass(node, op.Value)
+		case OpRemoveClass:
+			removeClass(node, op.Value)
+		case OpToggleClass:
+			toggleClass(node, op.Value)
+		case OpAppend:
+			if err := appendHTML(node, op.Value, opts); err != nil {
+				return skipped, conflicts, err
+			}
+		case OpPrepend:
+			if err := prependHTML(node, op.Value, opts); err != nil {
+				return skipped, conflicts, err
+			}
+		case OpInsertBefore:
+			if err := insertHTML(node, node, op.Value, opts); err != nil {
+				return skipped, conflicts, err
+			}
+		case OpInsertAfter:
+			if err := insertHTML(node, node.NextSibling, op.Value, opts); err != nil {
+				return skipped, conflicts, err
+			}
+		case OpReplaceWith:
+			if err := replaceWithHTML(node, op.Value, opts); err != nil {
+				return skipped, conflicts, err
+			}
+		case OpWrap:
+			if err := wrapNode(node, op.Value, opts); err != nil {
+				return skipped, conflicts, err
+			}
+		case OpUnwrap:
+			unwrapNode(node)
+		case OpRemoveIfEmpty:
+			if isEmpty(node) {
+				removeNode(node)
+			}
+		case OpSetTextIf:
+			if condition(textContent(node)) {
+				setText(node, op.text())
+			} else {
+				skipped++
+			}
+		case OpSetData:
+			if err := setData(node, op.Property, op.Value); err != nil {
+				return skipped, conflicts, err
+			}
+		case OpSetJSONField:
+			if err := setJSONField(node, op.Property, op.Value); err != nil {
+				return skipped, conflicts, err
+			}
 		default:
-			return fmt.Errorf("unknown operation type: %s", op.Type)
+			return skipped, conflicts, fmt.Errorf("%w: %s", ErrUnknownOperation, op.Type)
+		}
+
+		// Nodes a condition left alone weren't written
+		if skipped == wasSkipped {
+			conflicts = writes.record(node, op, index, conflicts)
 		}
 	}
 
-	return nil
+	return skipped, conflicts, nil
+}
+
+// limitNodes returns the first limit nodes, or all of them when limit is 0
+func limitNodes(nodes []*html.Node, limit int) []*html.Node {
+	if limit > 0 && len(nodes) > limit {
+		return nodes[:limit]
+	}
+	return nodes
+}
+
+// editsAttributes reports whether an operation type works on an element's
+// attributes, which the document node doesn't have
+func editsAttributes(opType string) bool {
+	switch opType {
+	case OpSetStyle, OpSetAttr, OpSetAttrIfAbsent, OpHide, OpShow, OpAddClass, OpRemoveClass, OpToggleClass, OpSetData:
+		return true
+	}
+	return false
 }
 
 // setText replaces the text content of a node
@@ -67,6 +293,33 @@ func setText(node *html.Node, text string) {
 	})
 }
 
+// setTextContent replaces a node's own text while keeping its element
+// children, e.g. the icon in <button><svg/>Buy now</button>
+// The text goes into the first direct text child that isn't just
+// whitespace, and the node's other such text children are removed.
+// Whitespace-only text and text inside child elements are left alone. If
+// the node has no text of its own, the text is appended.
+func setTextContent(node *html.Node, text string) {
+	var target *html.Node
+	for child := node.FirstChild; child != nil; {
+		next := child.NextSibling
+		if child.Type == html.TextNode && strings.TrimSpace(child.Data) != "" {
+			if target == nil {
+				target = child
+			} else {
+				node.RemoveChild(child)
+			}
+		}
+		child = next
+	}
+
+	if target == nil {
+		node.AppendChild(&html.Node{Type: html.TextNode, Data: text})
+		return
+	}
+	target.Data = text
+}
+
 // setStyle sets or updates a CSS property in the style attribute
 func setStyle(node *html.Node, property, value string) {
 	if node.Type != html.ElementNode {
@@ -82,37 +335,38 @@ func setStyle(node *html.Node, property, value string) {
 		}
 	}
 
-	// Parse existing styles
-	styles := make(map[string]string)
+	// Parse existing styles, keeping declaration order
+	var styles []styleDeclaration
 	if styleAttr != nil {
-		for _, part := range strings.Split(styleAttr.Val, ";") {
-			part = strings.TrimSpace(part)
-			if part == "" {
-				continue
-			}
-			kv := strings.SplitN(part, ":", 2)
-			if len(kv) == 2 {
-				styles[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
-			}
-		}
+		styles = parseStyle(styleAttr.Val)
 	}
 
-	// Update style
-	if value == "" {
-		delete(styles, property)
-	} else {
-		styles[property] = value
+	// Update style in place, append new properties at the end
+	index := -1
+	for i, decl := range styles {
+		if decl.property == property {
+			index = i
+			break
+		}
+	}
+	switch {
+	case value == "" && index >= 0:
+		styles = append(styles[:index], styles[index+1:]...)
+	case value != "" && index >= 0:
+		styles[index].value = value
+	case value != "":
+		styles = append(styles, styleDeclaration{property: property, value: value})
 	}
 
 	// Rebuild style string
 	var styleStr strings.Builder
-	for k, v := range styles {
+	for _, decl := range styles {
 		if styleStr.Len() > 0 {
 			styleStr.WriteString("; ")
 		}
-		styleStr.WriteString(k)
+		styleStr.WriteString(decl.property)
 		styleStr.WriteString(": ")
-		styleStr.WriteString(v)
+		styleStr.WriteString(decl.value)
 	}
 
 	// Update or create style attribute
@@ -126,6 +380,55 @@ func setStyle(node *html.Node, property, value string) {
 	}
 }
 
+// styleDeclaration is a single property: value pair from a style attribute
+type styleDeclaration struct {
+	property string
+	value    string
+}
+
+// parseStyle splits a style attribute into declarations in source order
+// A property declared more than once keeps its first slot and last value
+func parseStyle(style string) []styleDeclaration {
+	var styles []styleDeclaration
+	for _, part := range strings.Split(style, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		decl := styleDeclaration{
+			property: strings.TrimSpace(kv[0]),
+			value:    strings.TrimSpace(kv[1]),
+		}
+		replaced := false
+		for i := range styles {
+			if styles[i].property == decl.property {
+				styles[i].value = decl.value
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			styles = append(styles, decl)
+		}
+	}
+	return styles
+}
+
+// setAttrValue sets an attribute for setAttr, giving boolean attributes
+// on/off semantics
+func setAttrValue(node *html.Node, key, value string) {
+	if booleanAttributes[strings.ToLower(key)] {
+		setBooleanAttr(node, key, value)
+	} else {
+		setAttr(node, key, value)
+	}
+}
+
 // setAttr sets an HTML attribute
 func setAttr(node *html.Node, key, value string) {
 	if node.Type != html.ElementNode {
@@ -150,8 +453,131 @@ func setAttr(node *html.Node, key, value string) {
 	}
 }
 
+// setBooleanAttr turns a boolean attribute on or off
+// Empty, "false", and "0" remove it; "true" or the attribute's own name
+// set it without a value; anything else (e.g. hidden="until-found") is
+// kept as given.
+func setBooleanAttr(node *html.Node, key, value string) {
+	key = strings.ToLower(key)
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "false", "0":
+		removeAttr(node, key)
+	case "true", key:
+		setAttr(node, key, "")
+	default:
+		setAttr(node, key, value)
+	}
+}
+
+// setData sets a data-* attribute, normalizing the key
+func setData(node *html.Node, key, value string) error {
+	attrKey, err := dataAttrKey(key)
+	if err != nil {
+		return err
+	}
+	setAttr(node, attrKey, value)
+	return nil
+}
+
+// dataAttrKey normalizes a data attribute name to "data-<name>"
+// Accepts "variant", "data-variant", or dataset-style "variantName"
+// (which becomes data-variant-name). Whitespace becomes hyphens; other
+// characters outside [a-z0-9-_.] are rejected.
+func dataAttrKey(key string) (string, error) {
+	name := strings.TrimSpace(key)
+	if len(name) >= 5 && strings.EqualFold(name[:5], "data-") {
+		name = name[5:]
+	}
+
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			if i > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r + ('a' - 'A'))
+		case r == ' ' || r == '\t':
+			b.WriteByte('-')
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			b.WriteRune(r)
+		default:
+			return "", fmt.Errorf("invalid character %q in data attribute name: %s", r, key)
+		}
+	}
+
+	normalized := b.String()
+	if normalized == "" {
+		return "", fmt.Errorf("empty data attribute name")
+	}
+	if strings.HasPrefix(normalized, "xml") {
+		return "", fmt.Errorf("data attribute name must not start with xml: %s", key)
+	}
+	return "data-" + normalized, nil
+}
+
+// addClass adds class names to a node, keeping existing classes in order
+func addClass(node *html.Node, value string) {
+	updateClasses(node, func(classes []string) []string {
+		for _, name := range strings.Fields(value) {
+			if indexOf(classes, name) < 0 {
+				classes = append(classes, name)
+			}
+		}
+		return classes
+	})
+}
+
+// removeClass removes class names from a node
+func removeClass(node *html.Node, value string) {
+	updateClasses(node, func(classes []string) []string {
+		for _, name := range strings.Fields(value) {
+			if i := indexOf(classes, name); i >= 0 {
+				classes = append(classes[:i], classes[i+1:]...)
+			}
+		}
+		return classes
+	})
+}
+
+// toggleClass adds class names that are missing and removes those present
+func toggleClass(node *html.Node, value string) {
+	updateClasses(node, func(classes []string) []string {
+		for _, name := range strings.Fields(value) {
+			if i := indexOf(classes, name); i >= 0 {
+				classes = append(classes[:i], classes[i+1:]...)
+			} else {
+				classes = append(classes, name)
+			}
+		}
+		return classes
+	})
+}
+
+// updateClasses parses the class attribute into unique tokens, applies fn,
+// and writes the result back. An empty result removes the attribute.
+func updateClasses(node *html.Node, fn func([]string) []string) {
+	if node.Type != html.ElementNode {
+		return
+	}
+
+	var classes []string
+	for _, name := range strings.Fields(getAttr(node, "class")) {
+		if indexOf(classes, name) < 0 {
+			classes = append(classes, name)
+		}
+	}
+
+	classes = fn(classes)
+	if len(classes) == 0 {
+		removeAttr(node, "class")
+		return
+	}
+	setAttr(node, "class", strings.Join(classes, " "))
+}
+
 // setHTML replaces the inner HTML of a node
-func setHTML(node *html.Node, htmlContent string) {
+func setHTML(node *html.Node, htmlContent string, opts ApplyOptions) {
 	// Remove all children
 	for child := node.FirstChild; child != nil; {
 		next := child.NextSibling
@@ -160,11 +586,7 @@ func setHTML(node *html.Node, htmlContent string) {
 	}
 
 	// Parse new HTML content
-	nodes, err := html.ParseFragment(strings.NewReader(htmlContent), &html.Node{
-		Type:     html.ElementNode,
-		Data:     "div",
-		DataAtom: 0,
-	})
+	nodes, err := parseFragment(htmlContent, opts)
 	if err != nil {
 		return
 	}
@@ -175,73 +597,240 @@ func setHTML(node *html.Node, htmlContent string) {
 	}
 }
 
-// removeNode removes a node from the tree
-func removeNode(node *html.Node) {
-	if node.Parent != nil {
-		node.Parent.RemoveChild(node)
+// appendHTML inserts an HTML fragment after a node's existing children
+func appendHTML(node *html.Node, htmlContent string, opts ApplyOptions) error {
+	nodes, err := parseFragment(htmlContent, opts)
+	if err != nil {
+		return fmt.Errorf("parse fragment: %w", err)
+	}
+
+	for _, child := range nodes {
+		node.AppendChild(child)
+	}
+	return nil
+}
+
+// prependHTML inserts an HTML fragment before a node's existing children
+func prependHTML(node *html.Node, htmlContent string, opts ApplyOptions) error {
+	nodes, err := parseFragment(htmlContent, opts)
+	if err != nil {
+		return fmt.Errorf("parse fragment: %w", err)
 	}
+
+	// Insert in order before the original first child
+	first := node.FirstChild
+	for _, child := range nodes {
+		node.InsertBefore(child, first)
+	}
+	return nil
 }
 
-// findNodesBySelector finds nodes matching a simple CSS selector
-// Supports: .class, #id, element, [attr], [attr=value]
-func findNodesBySelector(doc *html.Node, selector string) []*html.Node {
-	var results []*html.Node
+// insertHTML inserts an HTML fragment as siblings of node, before ref
+// (nil ref appends after the last sibling). Nodes without a parent,
+// such as the document root, are skipped.
+func insertHTML(node, ref *html.Node, htmlContent string, opts ApplyOptions) error {
+	parent := node.Parent
+	if parent == nil {
+		return nil
+	}
+
+	nodes, err := parseFragment(htmlContent, opts)
+	if err != nil {
+		return fmt.Errorf("parse fragment: %w", err)
+	}
+
+	for _, sibling := range nodes {
+		parent.InsertBefore(sibling, ref)
+	}
+	return nil
+}
+
+// replaceWithHTML replaces a node with the nodes of an HTML fragment,
+// keeping their position among the node's siblings. Nodes without a
+// parent are skipped.
+func replaceWithHTML(node *html.Node, htmlContent string, opts ApplyOptions) error {
+	if node.Parent == nil {
+		return nil
+	}
+
+	if err := insertHTML(node, node, htmlContent, opts); err != nil {
+		return err
+	}
+	node.Parent.RemoveChild(node)
+	return nil
+}
 
-	selector = strings.TrimSpace(selector)
+// wrapNode puts a node inside a wrapper element parsed from a
+// single-element fragment, in the node's place among its siblings
+// The node becomes the last child of the wrapper's innermost first
+// element, so "<a href=x><span></span></a>" wraps it in the span.
+// Nodes without a parent are skipped.
+func wrapNode(node *html.Node, htmlContent string, opts ApplyOptions) error {
+	parent := node.Parent
+	if parent == nil {
+		return nil
+	}
 
-	// Determine selector type
-	var matchFunc func(*html.Node) bool
+	nodes, err := parseFragment(htmlContent, opts)
+	if err != nil {
+		return fmt.Errorf("parse fragment: %w", err)
+	}
 
-	if strings.HasPrefix(selector, ".") {
-		// Class selector
-		className := selector[1:]
-		matchFunc = func(n *html.Node) bool {
-			return hasClass(n, className)
+	var wrapper *html.Node
+	for _, n := range nodes {
+		switch {
+		case n.Type == html.ElementNode && wrapper == nil:
+			wrapper = n
+		case n.Type == html.TextNode && strings.TrimSpace(n.Data) == "":
+			// Ignore whitespace around the wrapper
+		default:
+			return fmt.Errorf("wrap requires a single element, got %q", htmlContent)
 		}
-	} else if strings.HasPrefix(selector, "#") {
-		// ID selector
-		id := selector[1:]
-		matchFunc = func(n *html.Node) bool {
-			return getAttr(n, "id") == id
+	}
+	if wrapper == nil {
+		return fmt.Errorf("wrap requires a single element, got %q", htmlContent)
+	}
+
+	target := wrapper
+	for child := firstElementChild(target); child != nil; child = firstElementChild(target) {
+		target = child
+	}
+
+	parent.InsertBefore(wrapper, node)
+	parent.RemoveChild(node)
+	target.AppendChild(node)
+	return nil
+}
+
+// unwrapNode replaces a node with its children, keeping their order
+// Nodes without a parent are skipped.
+func unwrapNode(node *html.Node) {
+	parent := node.Parent
+	if parent == nil {
+		return
+	}
+
+	for child := node.FirstChild; child != nil; child = node.FirstChild {
+		node.RemoveChild(child)
+		parent.InsertBefore(child, node)
+	}
+	parent.RemoveChild(node)
+}
+
+// moveNodes detaches nodes and reinserts them, in order, relative to the
+// first element matching destSelector
+// position is "before", "after", "prepend", or "append" (the default).
+// Nothing moves if the destination is one of the nodes or inside one.
+func moveNodes(doc *html.Node, nodes []*html.Node, destSelector, position string) error {
+	dests := findNodesBySelector(doc, destSelector)
+	if len(dests) == 0 {
+		return fmt.Errorf("%w: %s", ErrNoMatch, destSelector)
+	}
+	dest := dests[0]
+
+	var parent, ref *html.Node
+	switch position {
+	case "before":
+		parent, ref = dest.Parent, dest
+	case "after":
+		parent, ref = dest.Parent, dest.NextSibling
+	case "prepend":
+		parent, ref = dest, dest.FirstChild
+	case "append", "":
+		parent, ref = dest, nil
+	default:
+		return fmt.Errorf("unknown move position: %s", position)
+	}
+	if parent == nil {
+		return fmt.Errorf("move destination has no parent: %s", destSelector)
+	}
+
+	for _, node := range nodes {
+		if contains(node, dest) {
+			return fmt.Errorf("cannot move a node into itself: %s", destSelector)
 		}
-	} else if strings.HasPrefix(selector, "[") && strings.HasSuffix(selector, "]") {
-		// Attribute selector
-		attrStr := selector[1 : len(selector)-1]
-		parts := strings.SplitN(attrStr, "=", 2)
-		attrKey := strings.TrimSpace(parts[0])
+	}
 
-		if len(parts) == 1 {
-			// [attr] - has attribute
-			matchFunc = func(n *html.Node) bool {
-				return hasAttr(n, attrKey)
-			}
-		} else {
-			// [attr=value]
-			attrValue := strings.Trim(strings.TrimSpace(parts[1]), "\"'")
-			matchFunc = func(n *html.Node) bool {
-				return getAttr(n, attrKey) == attrValue
-			}
+	for _, node := range nodes {
+		if node == ref {
+			ref = node.NextSibling
 		}
-	} else {
-		// Element selector
-		matchFunc = func(n *html.Node) bool {
-			return n.Type == html.ElementNode && n.Data == selector
+		removeNode(node)
+		parent.InsertBefore(node, ref)
+	}
+	return nil
+}
+
+// contains reports whether descendant is node or inside it
+func contains(node, descendant *html.Node) bool {
+	for n := descendant; n != nil; n = n.Parent {
+		if n == node {
+			return true
 		}
 	}
+	return false
+}
 
-	// Walk the tree
-	var walk func(*html.Node)
-	walk = func(n *html.Node) {
-		if matchFunc(n) {
-			results = append(results, n)
+// parseFragment parses an HTML fragment for injection into the document,
+// sanitizing it unless unsafe HTML is allowed
+func parseFragment(htmlContent string, opts ApplyOptions) ([]*html.Node, error) {
+	nodes, err := html.ParseFragment(strings.NewReader(htmlContent), &html.Node{
+		Type:     html.ElementNode,
+		Data:     "div",
+		DataAtom: atom.Div,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !opts.AllowUnsafeHTML {
+		nodes = sanitizeNodes(nodes)
+	}
+	if opts.ScriptNonce != "" || opts.StyleNonce != "" {
+		for _, node := range nodes {
+			stampNonces(node, opts)
 		}
-		for child := n.FirstChild; child != nil; child = child.NextSibling {
-			walk(child)
+	}
+	return nodes, nil
+}
+
+// stampNonces sets the CSP nonce on every <script> and <style> element
+// in a subtree
+func stampNonces(node *html.Node, opts ApplyOptions) {
+	if node.Type == html.ElementNode {
+		switch {
+		case node.DataAtom == atom.Script && opts.ScriptNonce != "":
+			setAttr(node, "nonce", opts.ScriptNonce)
+		case node.DataAtom == atom.Style && opts.StyleNonce != "":
+			setAttr(node, "nonce", opts.StyleNonce)
 		}
 	}
-	walk(doc)
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		stampNonces(child, opts)
+	}
+}
+
+// removeNode removes a node from the tree
+func removeNode(node *html.Node) {
+	if node.Parent != nil {
+		node.Parent.RemoveChild(node)
+	}
+}
 
-	return results
+// isEmpty reports whether a node has no element children and no text
+// other than whitespace
+func isEmpty(node *html.Node) bool {
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		switch child.Type {
+		case html.ElementNode:
+			return false
+		case html.TextNode:
+			if strings.TrimSpace(child.Data) != "" {
+				return false
+			}
+		}
+	}
+	return true
 }
 
 // Helper functions
@@ -271,6 +860,24 @@ func getAttr(node *html.Node, key string) string {
 	return ""
 }
 
+func removeAttr(node *html.Node, key string) {
+	for i, attr := range node.Attr {
+		if attr.Key == key {
+			node.Attr = append(node.Attr[:i], node.Attr[i+1:]...)
+			return
+		}
+	}
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
 func hasAttr(node *html.Node, key string) bool {
 	if node.Type != html.ElementNode {
 		return false
@@ -283,6 +890,115 @@ func hasAttr(node *html.Node, key string) bool {
 	return false
 }
 
+// ParseDocument parses an HTML body for transformation
+// Full documents are parsed as such. Fragments, such as partials returned
+// to AJAX calls, are parsed in the context fragmentContext picks under a
+// bare document node so rendering doesn't wrap them in <html><head><body>.
+func ParseDocument(body []byte) (*html.Node, error) {
+	if !isFragment(body) {
+		return html.Parse(bytes.NewReader(body))
+	}
+
+	nodes, err := html.ParseFragment(bytes.NewReader(body), fragmentContext(body))
+	if err != nil {
+		return nil, err
+	}
+	doc := &html.Node{Type: html.DocumentNode}
+	for _, node := range nodes {
+		doc.AppendChild(node)
+	}
+	return doc, nil
+}
+
+// fragmentContexts maps the first tag of a fragment to the element it must
+// be parsed inside; the parser drops table and select parts found in a
+// <body>, so partials of table rows or options would lose their tags
+var fragmentContexts = map[atom.Atom]atom.Atom{
+	atom.Tr:       atom.Tbody,
+	atom.Td:       atom.Tr,
+	atom.Th:       atom.Tr,
+	atom.Thead:    atom.Table,
+	atom.Tbody:    atom.Table,
+	atom.Tfoot:    atom.Table,
+	atom.Caption:  atom.Table,
+	atom.Colgroup: atom.Table,
+	atom.Col:      atom.Colgroup,
+	atom.Option:   atom.Select,
+	atom.Optgroup: atom.Select,
+}
+
+// fragmentContext returns the element a fragment is parsed inside: the one
+// fragmentContexts gives for its first tag, or <body>
+func fragmentContext(body []byte) *html.Node {
+	context := atom.Body
+	if parent, ok := fragmentContexts[firstTag(body)]; ok {
+		context = parent
+	}
+	return &html.Node{Type: html.ElementNode, Data: context.String(), DataAtom: context}
+}
+
+// firstTag returns the atom of the first start tag in body, or 0 if text
+// or an end tag comes first
+func firstTag(body []byte) atom.Atom {
+	z := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch z.Next() {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			return atom.Lookup(name)
+		case html.TextToken:
+			if len(bytes.TrimSpace(z.Text())) > 0 {
+				return 0
+			}
+		case html.ErrorToken, html.EndTagToken:
+			return 0
+		}
+	}
+}
+
+// documentTags are the first tags that mark a full document written
+// without a doctype or <html>, since only a document has a head
+var documentTags = map[atom.Atom]bool{
+	atom.Html:  true,
+	atom.Head:  true,
+	atom.Body:  true,
+	atom.Title: true,
+	atom.Meta:  true,
+	atom.Link:  true,
+	atom.Base:  true,
+}
+
+// isFragment reports whether a body is a partial rather than a full
+// document, i.e. it doesn't start with a doctype, <html>, <head>, <body>,
+// or a head-only element once leading whitespace and comments are skipped
+func isFragment(body []byte) bool {
+	rest, ok := trimLeadingComments(body)
+	if !ok {
+		return true
+	}
+	if len(rest) >= len("<!doctype") && strings.EqualFold(string(rest[:len("<!doctype")]), "<!doctype") {
+		return false
+	}
+	return !documentTags[firstTag(rest)]
+}
+
+// trimLeadingComments strips a byte order mark, whitespace, and comments
+// from the start of body, reporting false if a comment is unterminated
+func trimLeadingComments(body []byte) ([]byte, bool) {
+	rest := bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))
+	for {
+		rest = bytes.TrimLeft(rest, " \t\r\n\f")
+		if !bytes.HasPrefix(rest, []byte("<!--")) {
+			return rest, true
+		}
+		end := bytes.Index(rest, []byte("-->"))
+		if end < 0 {
+			return nil, false
+		}
+		rest = rest[end+len("-->"):]
+	}
+}
+
 // RenderHTML renders an HTML node tree to a string
 func RenderHTML(doc *html.Node) (string, error) {
 	var buf bytes.Buffer
@@ -0,0 +1,736 @@
+package transform
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+// applyOne applies a single operation to page, failing the test if it
+// errors or changes nothing
+func applyOne(t *testing.T, page string, op Operation) string {
+	t.Helper()
+	out, results, err := Apply(page, []Operation{op})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Err != nil || !results[0].Changed() {
+		t.Fatalf("%s %q: matched %d, err %v", op.Type, op.Selector, results[0].Matched, results[0].Err)
+	}
+	return out
+}
+
+func TestDocumentElements(t *testing.T) {
+	tests := []struct {
+		name string
+		page string
+		op   Operation
+		want string
+	}{
+		{
+			name: "addClass on body",
+			page: `<html><body class="home"><p>x</p></body></html>`,
+			op:   Operation{Type: OpAddClass, Selector: "body", Value: "exp"},
+			want: `<body class="home exp">`,
+		},
+		{
+			name: "addClass on implied body",
+			page: `<!DOCTYPE html><p>x</p>`,
+			op:   Operation{Type: OpAddClass, Selector: "body", Value: "exp"},
+			want: `<body class="exp">`,
+		},
+		{
+			name: "addClass on :root",
+			page: `<!DOCTYPE html><html lang="en"><body></body></html>`,
+			op:   Operation{Type: OpAddClass, Selector: ":root", Value: "exp"},
+			want: `<html lang="en" class="exp">`,
+		},
+		{
+			name: "setAttr on implied html",
+			page: `<!DOCTYPE html><title>T</title><p>x</p>`,
+			op:   Operation{Type: OpSetAttr, Selector: "html", Property: "data-exp", Value: "1"},
+			want: `<html data-exp="1">`,
+		},
+		{
+			name: "setStyle on :root",
+			page: `<!DOCTYPE html><p>x</p>`,
+			op:   Operation{Type: OpSetStyle, Selector: ":root", Property: "color", Value: "red"},
+			want: `<html style="color: red">`,
+		},
+		{
+			name: "setAttr on implied head",
+			page: `<!DOCTYPE html><p>x</p>`,
+			op:   Operation{Type: OpSetAttr, Selector: "head", Property: "data-exp", Value: "1"},
+			want: `<head data-exp="1">`,
+		},
+		{
+			name: "addClass on body without doctype",
+			page: `<head><title>T</title></head><body class="home"><p>x</p></body>`,
+			op:   Operation{Type: OpAddClass, Selector: "body", Value: "exp"},
+			want: `<body class="home exp">`,
+		},
+		{
+			name: "marker in head without doctype",
+			page: `<meta charset="utf-8"><title>T</title><p>x</p>`,
+			op:   MarkApplied([]string{"exp"}),
+			want: `<head><meta name="ef-applied" content="exp"/><meta charset="utf-8"/><title>T</title></head>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if out := applyOne(t, tt.page, tt.op); !strings.Contains(out, tt.want) {
+				t.Errorf("got %s, want it to contain %s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestRootOnlyMatchesHTML(t *testing.T) {
+	_, results, err := Apply(`<!DOCTYPE html><div><html><p>x</p></html></div>`, []Operation{
+		{Type: OpAddClass, Selector: ":root", Value: "exp"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Matched != 1 {
+		t.Errorf(":root matched %d elements, want the document element only", results[0].Matched)
+	}
+
+	// Fragments have no document element
+	_, results, err = Apply(`<div>x</div>`, []Operation{{Type: OpAddClass, Selector: ":root", Value: "exp"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Matched != 0 {
+		t.Errorf(":root matched %d elements in a fragment, want none", results[0].Matched)
+	}
+}
+
+func TestInsertAroundChildren(t *testing.T) {
+	const list = `<ul><li>a</li><li>b</li><li>c</li></ul>`
+	tests := []struct {
+		name string
+		op   Operation
+		want string
+	}{
+		{
+			name: "before first child",
+			op:   Operation{Type: OpInsertBefore, Selector: "li:first-child", Value: `<li>new</li>`},
+			want: `<ul><li>new</li><li>a</li><li>b</li><li>c</li></ul>`,
+		},
+		{
+			name: "after first child",
+			op:   Operation{Type: OpInsertAfter, Selector: "li:first-child", Value: `<li>new</li>`},
+			want: `<ul><li>a</li><li>new</li><li>b</li><li>c</li></ul>`,
+		},
+		{
+			name: "before last child",
+			op:   Operation{Type: OpInsertBefore, Selector: "li:last-child", Value: `<li>new</li>`},
+			want: `<ul><li>a</li><li>b</li><li>new</li><li>c</li></ul>`,
+		},
+		{
+			name: "after last child",
+			op:   Operation{Type: OpInsertAfter, Selector: "li:last-child", Value: `<li>new</li>`},
+			want: `<ul><li>a</li><li>b</li><li>c</li><li>new</li></ul>`,
+		},
+		{
+			name: "several nodes keep their order",
+			op:   Operation{Type: OpInsertAfter, Selector: "li:last-child", Value: `<li>x</li>text<li>y</li>`},
+			want: `<ul><li>a</li><li>b</li><li>c</li><li>x</li>text<li>y</li></ul>`,
+		},
+		{
+			name: "after every child",
+			op:   Operation{Type: OpInsertAfter, Selector: "li", Value: `<li>-</li>`},
+			want: `<ul><li>a</li><li>-</li><li>b</li><li>-</li><li>c</li><li>-</li></ul>`,
+		},
+		{
+			name: "before the top-level element",
+			op:   Operation{Type: OpInsertBefore, Selector: "ul", Value: `<p>intro</p>`},
+			want: `<p>intro</p><ul><li>a</li><li>b</li><li>c</li></ul>`,
+		},
+		{
+			name: "after the top-level element",
+			op:   Operation{Type: OpInsertAfter, Selector: "ul", Value: `<p>outro</p>`},
+			want: `<ul><li>a</li><li>b</li><li>c</li></ul><p>outro</p>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if out := applyOne(t, list, tt.op); out != tt.want {
+				t.Errorf("got  %s\nwant %s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestInsertBetweenSiblingText(t *testing.T) {
+	out := applyOne(t, `<p>before<b>bold</b>after</p>`, Operation{Type: OpInsertAfter, Selector: "b", Value: `<i>new</i>`})
+	if want := `<p>before<b>bold</b><i>new</i>after</p>`; out != want {
+		t.Errorf("got  %s\nwant %s", out, want)
+	}
+}
+
+func TestInsertWithoutParent(t *testing.T) {
+	node := &html.Node{Type: html.ElementNode, Data: "div"}
+	if err := insertHTML(node, nil, `<p>x</p>`, ApplyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if node.Parent != nil || node.NextSibling != nil || node.FirstChild != nil {
+		t.Error("insert changed a node without a parent")
+	}
+}
+
+func TestApplicationOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  []Operation
+		want []int
+	}{
+		{"spec order", []Operation{{Type: OpSetText}, {Type: OpRemove}, {Type: OpAddClass}}, []int{0, 1, 2}},
+		{"ascending priority", []Operation{{Type: OpSetText, Priority: 10}, {Type: OpRemove, Priority: 1}, {Type: OpAddClass, Priority: 5}}, []int{1, 2, 0}},
+		{"ties keep spec order", []Operation{{Type: OpSetText, Priority: 2}, {Type: OpRemove, Priority: 1}, {Type: OpAddClass, Priority: 2}, {Type: OpHide, Priority: 1}}, []int{1, 3, 0, 2}},
+		{"negative priority first", []Operation{{Type: OpSetText}, {Type: OpRemove, Priority: -1}}, []int{1, 0}},
+		{"cleanup last despite priority", []Operation{{Type: OpRemoveIfEmpty, Priority: -5}, {Type: OpSetText, Priority: 10}, {Type: OpRemove}}, []int{2, 1, 0}},
+		{"cleanups ordered by priority", []Operation{{Type: OpRemoveIfEmpty, Priority: 2}, {Type: OpSetText}, {Type: OpRemoveIfEmpty, Priority: 1}}, []int{1, 2, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := applicationOrder(tt.ops); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoveAndSetTextPriority(t *testing.T) {
+	const page = `<div><p class="promo">Sale</p><p>Other</p></div>`
+	tests := []struct {
+		name        string
+		ops         []Operation
+		want        string
+		wantNoMatch int // Index of the operation that finds nothing, or -1
+		wantOrder   []int
+	}{
+		{
+			name: "removal first leaves nothing to set",
+			ops: []Operation{
+				{Type: OpSetText, Selector: ".promo", Value: "New", Priority: 10},
+				{Type: OpRemove, Selector: ".promo", Priority: 1},
+			},
+			want:        `<div><p>Other</p></div>`,
+			wantNoMatch: 0,
+			wantOrder:   []int{1, 0},
+		},
+		{
+			name: "text set first is removed with its element",
+			ops: []Operation{
+				{Type: OpSetText, Selector: ".promo", Value: "New", Priority: 1},
+				{Type: OpRemove, Selector: ".promo", Priority: 10},
+			},
+			want:        `<div><p>Other</p></div>`,
+			wantNoMatch: -1,
+			wantOrder:   []int{0, 1},
+		},
+		{
+			name: "equal priority keeps spec order",
+			ops: []Operation{
+				{Type: OpRemove, Selector: ".promo", Priority: 5},
+				{Type: OpSetText, Selector: "p", Value: "New", Priority: 5},
+			},
+			want:        `<div><p>New</p></div>`,
+			wantNoMatch: -1,
+			wantOrder:   []int{0, 1},
+		},
+		{
+			name: "cleanup sees the emptied element",
+			ops: []Operation{
+				{Type: OpRemoveIfEmpty, Selector: "p", Priority: -1},
+				{Type: OpSetText, Selector: ".promo", Value: " ", Priority: 1},
+			},
+			want:        `<div><p>Other</p></div>`,
+			wantNoMatch: -1,
+			wantOrder:   []int{1, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, results, err := Apply(page, tt.ops)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out != tt.want {
+				t.Errorf("got  %s\nwant %s", out, tt.want)
+			}
+			var log []int
+			for _, res := range results {
+				log = append(log, res.Index)
+				if noMatch := errors.Is(res.Err, ErrNoMatch); noMatch != (res.Index == tt.wantNoMatch) {
+					t.Errorf("operation %d: err %v", res.Index, res.Err)
+				} else if !noMatch && res.Err != nil {
+					t.Errorf("operation %d: %v", res.Index, res.Err)
+				}
+			}
+			if !slices.Equal(log, tt.wantOrder) {
+				t.Errorf("applied in order %v, want %v", log, tt.wantOrder)
+			}
+		})
+	}
+}
+
+func TestWrapNested(t *testing.T) {
+	tests := []struct {
+		name string
+		page string
+		op   Operation
+		want string
+	}{
+		{
+			name: "image in a link",
+			page: `<p>before<img src="a.png">after</p>`,
+			op:   Operation{Type: OpWrap, Selector: "img", Value: `<a href="/x"></a>`},
+			want: `<p>before<a href="/x"><img src="a.png"/></a>after</p>`,
+		},
+		{
+			name: "innermost first element of a nested wrapper",
+			page: `<div><span>a</span><b>b</b></div>`,
+			op:   Operation{Type: OpWrap, Selector: "b", Value: `<section><div class="w"><em></em></div><i>x</i></section>`},
+			want: `<div><span>a</span><section><div class="w"><em><b>b</b></em></div><i>x</i></section></div>`,
+		},
+		{
+			name: "after the wrapper's existing content",
+			page: `<p><b>b</b></p>`,
+			op:   Operation{Type: OpWrap, Selector: "b", Value: `<label>Name: </label>`},
+			want: `<p><label>Name: <b>b</b></label></p>`,
+		},
+		{
+			name: "element with nested children",
+			page: `<div><ul><li><a>1</a></li><li>2</li></ul></div>`,
+			op:   Operation{Type: OpWrap, Selector: "ul", Value: `<nav></nav>`},
+			want: `<div><nav><ul><li><a>1</a></li><li>2</li></ul></nav></div>`,
+		},
+		{
+			name: "nested matches each wrapped",
+			page: `<div class="x"><div class="x">i</div></div>`,
+			op:   Operation{Type: OpWrap, Selector: ".x", Value: `<section></section>`},
+			want: `<section><div class="x"><section><div class="x">i</div></section></div></section>`,
+		},
+		{
+			name: "whitespace around the wrapper",
+			page: `<p>a<b>b</b>c</p>`,
+			op:   Operation{Type: OpWrap, Selector: "b", Value: " <span></span>\n"},
+			want: `<p>a<span><b>b</b></span>c</p>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if out := applyOne(t, tt.page, tt.op); out != tt.want {
+				t.Errorf("got  %s\nwant %s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestWrapRejectsBadWrapper(t *testing.T) {
+	for _, wrapper := range []string{``, `text`, `<a></a><b></b>`, `<a></a>text`} {
+		_, results, err := Apply(`<p><b>b</b></p>`, []Operation{{Type: OpWrap, Selector: "b", Value: wrapper}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results[0].Err == nil {
+			t.Errorf("wrap with %q succeeded, want an error", wrapper)
+		}
+	}
+}
+
+func TestUnwrapNested(t *testing.T) {
+	tests := []struct {
+		name string
+		page string
+		op   Operation
+		want string
+	}{
+		{
+			name: "children keep their order",
+			page: `<p>a<span>b<i>c</i>d</span>e</p>`,
+			op:   Operation{Type: OpUnwrap, Selector: "span"},
+			want: `<p>ab<i>c</i>de</p>`,
+		},
+		{
+			name: "only the matched level",
+			page: `<div class="outer"><div class="inner"><p>x</p></div></div>`,
+			op:   Operation{Type: OpUnwrap, Selector: ".outer"},
+			want: `<div class="inner"><p>x</p></div>`,
+		},
+		{
+			name: "nested matches all unwrapped",
+			page: `<section><div class="w"><div class="w"><p>x</p></div><p>y</p></div></section>`,
+			op:   Operation{Type: OpUnwrap, Selector: ".w"},
+			want: `<section><p>x</p><p>y</p></section>`,
+		},
+		{
+			name: "empty element removed",
+			page: `<p>a<span></span>b</p>`,
+			op:   Operation{Type: OpUnwrap, Selector: "span"},
+			want: `<p>ab</p>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if out := applyOne(t, tt.page, tt.op); out != tt.want {
+				t.Errorf("got  %s\nwant %s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestWrapThenUnwrapRoundTrips(t *testing.T) {
+	const page = `<ul><li>1</li><li>2</li></ul>`
+	out, results, err := Apply(page, []Operation{
+		{Type: OpWrap, Selector: "li", Value: `<div class="tmp"></div>`},
+		{Type: OpUnwrap, Selector: ".tmp"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range results {
+		if res.Err != nil {
+			t.Errorf("operation %d: %v", res.Index, res.Err)
+		}
+	}
+	if out != page {
+		t.Errorf("got %s, want %s", out, page)
+	}
+}
+
+func TestWrapAndUnwrapWithoutParent(t *testing.T) {
+	node := &html.Node{Type: html.ElementNode, Data: "div"}
+	if err := wrapNode(node, `<section></section>`, ApplyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	unwrapNode(node)
+	if node.Parent != nil {
+		t.Error("node without a parent was given one")
+	}
+}
+
+func TestMovePositions(t *testing.T) {
+	const page = `<div><section id="reviews"><p>r</p></section><form><button>Buy</button><span>x</span></form></div>`
+	tests := []struct {
+		name     string
+		selector string
+		dest     string
+		position string
+		want     string
+	}{
+		{
+			name: "before", selector: "#reviews", dest: "button", position: "before",
+			want: `<div><form><section id="reviews"><p>r</p></section><button>Buy</button><span>x</span></form></div>`,
+		},
+		{
+			name: "after", selector: "#reviews", dest: "button", position: "after",
+			want: `<div><form><button>Buy</button><section id="reviews"><p>r</p></section><span>x</span></form></div>`,
+		},
+		{
+			name: "prepend", selector: "#reviews", dest: "form", position: "prepend",
+			want: `<div><form><section id="reviews"><p>r</p></section><button>Buy</button><span>x</span></form></div>`,
+		},
+		{
+			name: "append", selector: "#reviews", dest: "form", position: "append",
+			want: `<div><form><button>Buy</button><span>x</span><section id="reviews"><p>r</p></section></form></div>`,
+		},
+		{
+			name: "append by default", selector: "#reviews", dest: "form",
+			want: `<div><form><button>Buy</button><span>x</span><section id="reviews"><p>r</p></section></form></div>`,
+		},
+		{
+			name: "several nodes keep their order", selector: "button, span", dest: "#reviews", position: "before",
+			want: `<div><button>Buy</button><span>x</span><section id="reviews"><p>r</p></section><form></form></div>`,
+		},
+		{
+			name: "before the next sibling", selector: "button", dest: "span", position: "before",
+			want: page,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			op := Operation{Type: OpMove, Selector: tt.selector, Value: tt.dest, Property: tt.position}
+			out, results, err := Apply(page, []Operation{op})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if results[0].Err != nil {
+				t.Fatal(results[0].Err)
+			}
+			if out != tt.want {
+				t.Errorf("got  %s\nwant %s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoveErrors(t *testing.T) {
+	const page = `<div id="outer"><p id="inner">x</p></div><footer></footer>`
+	tests := []struct {
+		name     string
+		selector string
+		dest     string
+		position string
+	}{
+		{"into itself", "#outer", "#outer", "append"},
+		{"next to itself", "#inner", "#inner", "after"},
+		{"into a descendant", "#outer", "#inner", "prepend"},
+		{"missing destination", "#inner", ".missing", "append"},
+		{"unknown position", "#inner", "footer", "inside"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			op := Operation{Type: OpMove, Selector: tt.selector, Value: tt.dest, Property: tt.position}
+			out, results, err := Apply(page, []Operation{op})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if results[0].Err == nil {
+				t.Error("move succeeded, want an error")
+			}
+			if out != page {
+				t.Errorf("failed move changed the page: %s", out)
+			}
+		})
+	}
+}
+
+func TestIsFragment(t *testing.T) {
+	tests := []struct {
+		body string
+		want bool
+	}{
+		{`<div class="card">x</div>`, true},
+		{`  <li>1</li><li>2</li>`, true},
+		{`text only`, true},
+		{``, true},
+		{`<!-- partial --><div>x</div>`, true},
+		{`<!-- unterminated <html>`, true},
+		{`<span>T</span><head>`, true},
+		{`<head><title>T</title></head>`, false},
+		{`<body class="home"><p>x</p></body>`, false},
+		{`<title>T</title><p>x</p>`, false},
+		{`<meta charset="utf-8"><p>x</p>`, false},
+		{"<!-- x -->\n<LINK rel=stylesheet>", false},
+		{`<!DOCTYPE html><div>x</div>`, false},
+		{`<!doctype html>`, false},
+		{`<html><body>x</body></html>`, false},
+		{`<HTML lang="en">`, false},
+		{"\xef\xbb\xbf\n<!-- build 42 -->\n<!DOCTYPE html>", false},
+	}
+	for _, tt := range tests {
+		if got := isFragment([]byte(tt.body)); got != tt.want {
+			t.Errorf("isFragment(%q) = %v, want %v", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestFragmentRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		page string
+		ops  []Operation
+		want string
+	}{
+		{
+			name: "untouched",
+			page: `<div class="card"><h2>Title</h2><p>Body</p></div>`,
+			want: `<div class="card"><h2>Title</h2><p>Body</p></div>`,
+		},
+		{
+			name: "transformed",
+			page: `<div class="card"><h2>Title</h2><p>Body</p></div>`,
+			ops:  []Operation{{Type: OpSetText, Selector: "h2", Value: "New"}},
+			want: `<div class="card"><h2>New</h2><p>Body</p></div>`,
+		},
+		{
+			name: "several top-level nodes",
+			page: "<div>a</div>\n<div>b</div>\n",
+			ops:  []Operation{{Type: OpAddClass, Selector: "div", Value: "x"}},
+			want: "<div class=\"x\">a</div>\n<div class=\"x\">b</div>\n",
+		},
+		{
+			name: "table rows",
+			page: `<tr><td>1</td></tr>`,
+			ops:  []Operation{{Type: OpSetText, Selector: "td", Value: "2"}},
+			want: `<tr><td>2</td></tr>`,
+		},
+		{
+			name: "table cells",
+			page: " <td>1</td><th>2</th>",
+			ops:  []Operation{{Type: OpAddClass, Selector: "th", Value: "x"}},
+			want: ` <td>1</td><th class="x">2</th>`,
+		},
+		{
+			name: "options",
+			page: `<option value="1">One</option><option value="2">Two</option>`,
+			ops:  []Operation{{Type: OpSetAttr, Selector: "option", Property: "value", Value: "0", Limit: 1}},
+			want: `<option value="0">One</option><option value="2">Two</option>`,
+		},
+		{
+			name: "leading comment",
+			page: `<!-- partial --><div>x</div>`,
+			want: `<!-- partial --><div>x</div>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _, err := Apply(tt.page, tt.ops)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out != tt.want {
+				t.Errorf("got  %q\nwant %q", out, tt.want)
+			}
+			if strings.Contains(out, "<body") || strings.Contains(out, "<html") {
+				t.Errorf("fragment wrapped in a document: %s", out)
+			}
+
+			if !CanStream(tt.ops) {
+				return
+			}
+			var streamed bytes.Buffer
+			if _, err := StreamTransformations(&streamed, strings.NewReader(tt.page), [][]Operation{tt.ops}, ApplyOptions{}, 0); err != nil {
+				t.Fatal(err)
+			}
+			if streamed.String() != tt.want {
+				t.Errorf("streamed %q\nwant     %q", streamed.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestDocumentWithoutDoctype(t *testing.T) {
+	page := `<head><title>T</title><meta name="x"></head><body class="home"><p>x</p></body>`
+	ops := []Operation{{Type: OpAddClass, Selector: "p", Value: "y"}}
+	const want = `<html><head><title>T</title><meta name="x"/></head><body class="home"><p class="y">x</p></body></html>`
+	if out := applyOne(t, page, ops[0]); out != want {
+		t.Errorf("got  %s\nwant %s", out, want)
+	}
+
+	var streamed bytes.Buffer
+	if _, err := StreamTransformations(&streamed, strings.NewReader(page), [][]Operation{ops}, ApplyOptions{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(streamed.String(), `<body class="home"><p class="y">x</p>`) {
+		t.Errorf("streamed page lost its body: %s", streamed.String())
+	}
+}
+
+func TestParseDocumentFragment(t *testing.T) {
+	doc, err := ParseDocument([]byte(`<div id="a"><span>x</span></div>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Type != html.DocumentNode {
+		t.Fatalf("root is %v, want a document node", doc.Type)
+	}
+	first := doc.FirstChild
+	if first == nil || first.Data != "div" || first.NextSibling != nil {
+		t.Fatalf("fragment children not kept as they are: %+v", first)
+	}
+	if len(findNodesBySelector(doc, "body")) != 0 || len(findNodesBySelector(doc, ":root")) != 0 {
+		t.Error("fragment has implied document elements")
+	}
+}
+
+func TestSetTextContentMixed(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector string
+		page     string
+		want     string
+	}{
+		{
+			name:     "icon before label",
+			selector: "button",
+			page:     `<button><svg></svg>Buy now</button>`,
+			want:     `<button><svg></svg>New</button>`,
+		},
+		{
+			name:     "label before icon",
+			selector: "button",
+			page:     `<button>Buy now<i class="icon"></i></button>`,
+			want:     `<button>New<i class="icon"></i></button>`,
+		},
+		{
+			name:     "text on both sides",
+			selector: "a",
+			page:     `<a>Save <b>20%</b> today</a>`,
+			want:     `<a>New<b>20%</b></a>`,
+		},
+		{
+			name:     "whitespace kept for layout",
+			selector: "button",
+			page:     "<button>\n  <svg></svg>\n  Buy now\n</button>",
+			want:     "<button>\n  <svg></svg>New</button>",
+		},
+		{
+			name:     "nested text untouched",
+			selector: "label",
+			page:     `<label><span>Qty</span></label>`,
+			want:     `<label><span>Qty</span>New</label>`,
+		},
+		{
+			name:     "comment left alone",
+			selector: "p",
+			page:     `<p><!-- price -->$10</p>`,
+			want:     `<p><!-- price -->New</p>`,
+		},
+		{
+			name:     "empty element",
+			selector: "p",
+			page:     `<p></p>`,
+			want:     `<p>New</p>`,
+		},
+		{
+			name:     "text only",
+			selector: "p",
+			page:     `<p>Old</p>`,
+			want:     `<p>New</p>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := applyOne(t, tt.page, Operation{Type: OpSetTextContent, Selector: tt.selector, Value: "New"})
+			if out != tt.want {
+				t.Errorf("got  %q\nwant %q", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetTextContentEncoded(t *testing.T) {
+	out := applyOne(t, `<button><svg></svg>Buy</button>`, Operation{Type: OpSetTextContent, Selector: "button", Value: "Fish &amp; Chips", Encoded: true})
+	if want := `<button><svg></svg>Fish &amp; Chips</button>`; out != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+}
+
+func TestEmptyAttributeSelectorMatchesOnlyElements(t *testing.T) {
+	const page = `<!DOCTYPE html><html><body><!-- c --><p>Text</p><img alt=""><img src="x.png"></body></html>`
+	out, results, err := Apply(page, []Operation{
+		{Type: OpSetAttr, Selector: `[alt=""]`, Property: "data-exp", Value: "1"},
+		{Type: OpSetText, Selector: `[title=]`, Value: "X"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Matched != 1 || results[0].Err != nil {
+		t.Errorf(`[alt=""] matched %d nodes (err %v), want the img with an empty alt only`, results[0].Matched, results[0].Err)
+	}
+	if results[1].Matched != 0 {
+		t.Errorf(`[title=] matched %d nodes, want none`, results[1].Matched)
+	}
+	if want := `<!-- c --><p>Text</p><img alt="" data-exp="1"/><img src="x.png"/>`; !strings.Contains(out, want) {
+		t.Errorf("got %s, want it to contain %s", out, want)
+	}
+}
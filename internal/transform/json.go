@@ -0,0 +1,105 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// setJSONField sets the field at a dotted path, e.g. "offers.price" or
+// "@graph.0.name", in the JSON held by a script element such as a JSON-LD
+// block. Numeric segments index arrays; missing object fields are created.
+// A field that holds a string gets value verbatim; anything else gets value
+// parsed as JSON, or as a string when it isn't valid JSON.
+// The script is left untouched when its content isn't valid JSON or the
+// path can't be followed. Otherwise the JSON is re-serialized compactly,
+// with object keys sorted.
+func setJSONField(node *html.Node, path, value string) error {
+	if node.Type != html.ElementNode || node.DataAtom != atom.Script {
+		return fmt.Errorf("setJSONField needs a script element, got <%s>", node.Data)
+	}
+	if path == "" {
+		return fmt.Errorf("setJSONField needs a field path")
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(textContent(node)))
+	decoder.UseNumber()
+	var doc any
+	if err := decoder.Decode(&doc); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+	if decoder.More() {
+		return fmt.Errorf("%w: trailing data", ErrInvalidJSON)
+	}
+
+	doc, err := setJSONPath(doc, strings.Split(path, "."), value)
+	if err != nil {
+		return fmt.Errorf("setJSONField %q: %w", path, err)
+	}
+
+	// The encoder escapes <, > and &, so the value can't close the script
+	var out bytes.Buffer
+	if err := json.NewEncoder(&out).Encode(doc); err != nil {
+		return fmt.Errorf("encode JSON: %w", err)
+	}
+	setText(node, strings.TrimSuffix(out.String(), "\n"))
+	return nil
+}
+
+// setJSONPath sets the field at path within current and returns the
+// updated value
+func setJSONPath(current any, path []string, value string) (any, error) {
+	if len(path) == 0 {
+		return jsonFieldValue(current, value), nil
+	}
+
+	key := path[0]
+	switch container := current.(type) {
+	case map[string]any:
+		child, err := setJSONPath(container[key], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		container[key] = child
+		return container, nil
+	case []any:
+		index, err := strconv.Atoi(key)
+		if err != nil || index < 0 || index >= len(container) {
+			return nil, fmt.Errorf("no array element %q", key)
+		}
+		child, err := setJSONPath(container[index], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		container[index] = child
+		return container, nil
+	case nil:
+		// Create missing objects along the path
+		child, err := setJSONPath(nil, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{key: child}, nil
+	}
+	return nil, fmt.Errorf("field %q is not an object or array", key)
+}
+
+// jsonFieldValue converts value for the field it replaces, keeping string
+// fields strings
+func jsonFieldValue(existing any, value string) any {
+	if _, ok := existing.(string); ok {
+		return value
+	}
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	var parsed any
+	if err := decoder.Decode(&parsed); err != nil || decoder.More() {
+		return value
+	}
+	return parsed
+}
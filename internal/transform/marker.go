@@ -0,0 +1,38 @@
+package transform
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// appliedMarker names the <meta> element listing the experiments applied
+// to a page, so another pass through a proxy leaves them alone
+const appliedMarker = "ef-applied"
+
+// AppliedExperiments returns the experiments listed in a page's
+// <meta name="ef-applied"> markers
+func AppliedExperiments(doc *html.Node) []string {
+	var ids []string
+	for _, node := range findNodesBySelector(doc, `meta[name="`+appliedMarker+`"]`) {
+		for _, id := range strings.Split(getAttr(node, "content"), ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// MarkApplied returns an operation adding a marker listing experimentIDs
+// to the start of the page's <head>
+// Fragments have no head, so they aren't marked.
+func MarkApplied(experimentIDs []string) Operation {
+	return Operation{
+		Type:     OpPrepend,
+		Selector: "head",
+		Value:    fmt.Sprintf(`<meta name="%s" content="%s">`, appliedMarker, html.EscapeString(strings.Join(experimentIDs, ","))),
+		Limit:    1,
+	}
+}
@@ -1,5 +1,22 @@
 package transform
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// ErrUnsupportedVersion is reported for transform specs in a format this
+// proxy doesn't understand
+var ErrUnsupportedVersion = errors.New("unsupported transform spec version")
+
+// supportedSpecVersions lists the spec format major versions this proxy
+// can apply; minor versions only add optional fields
+var supportedSpecVersions = map[string]bool{"1": true}
+
 // Operation represents a single DOM transformation
 type Operation struct {
 	Type     string `json:"type"`
@@ -7,18 +24,106 @@ type Operation struct {
 	Value    string `json:"value"`
 	Property string `json:"property,omitempty"`
 	Priority int    `json:"priority"`
+	Limit    int    `json:"limit,omitempty"`   // Only the first Limit matched nodes, in document order; 0 is all
+	Scope    string `json:"scope,omitempty"`   // Only match inside elements matching this selector
+	Encoded  bool   `json:"encoded,omitempty"` // Text operations: Value is HTML-encoded, e.g. "Fish &amp; Chips"
+}
+
+// text returns the text a text operation sets
+// Encoded values have their character references decoded, so they show
+// as written in the page source rather than being encoded a second time.
+// Markup in them stays text either way.
+func (op Operation) text() string {
+	if op.Encoded {
+		return html.UnescapeString(op.Value)
+	}
+	return op.Value
+}
+
+// OpResult reports the outcome of applying a single operation
+type OpResult struct {
+	Index    int    // Position of the operation in the spec
+	Type     string // Operation type
+	Selector string // Operation selector
+	Matched  int    // Number of nodes the selector matched
+	Skipped  int    // Matched nodes left alone by a condition or the operation's Limit
+	Err      error  // Why the operation failed, nil on success
+
+	// Conflicts lists the earlier operations, by Index, that set a property
+	// this one then set to something else on the same node, such as two
+	// setStyle operations on one element's display
+	Conflicts []int
+}
+
+// Unknown reports whether the operation failed because its type isn't one
+// this proxy supports
+func (r OpResult) Unknown() bool {
+	return errors.Is(r.Err, ErrUnknownOperation)
+}
+
+// Unmatched reports whether the operation failed only because its selector
+// matched no elements
+func (r OpResult) Unmatched() bool {
+	return errors.Is(r.Err, ErrNoMatch)
+}
+
+// Changed reports whether the operation may have modified the document
+// Operations that fail part way count as changed, since earlier nodes
+// keep their changes.
+func (r OpResult) Changed() bool {
+	return r.Matched > r.Skipped && !errors.Is(r.Err, ErrTooManyMatches)
 }
 
 // TransformSpec represents the full transformation specification
 type TransformSpec struct {
-	Version          string      `json:"version"`
-	ExperimentID     string      `json:"experiment_id"`
-	VariantID        string      `json:"variant_id"`
-	VariantKey       string      `json:"variant_key"`
-	Operations       []Operation `json:"operations"`
-	TTL              int         `json:"ttl"`
-	CacheKey         string      `json:"cache_key"`
-	ExperimentVersion string     `json:"experiment_version,omitempty"`
+	Version           string            `json:"version"`
+	ExperimentID      string            `json:"experiment_id"`
+	VariantID         string            `json:"variant_id"`
+	VariantKey        string            `json:"variant_key"`
+	Operations        []Operation       `json:"operations"`
+	Headers           []HeaderOperation `json:"headers,omitempty"` // Applied to the response headers
+	Scope             string            `json:"scope,omitempty"`   // Default Scope for operations without one
+	TTL               int               `json:"ttl"`
+	CacheKey          string            `json:"cache_key"` // Specs of an experiment with the same key share a cache entry
+	ExperimentVersion string            `json:"experiment_version,omitempty"`
+}
+
+// CheckVersion returns ErrUnsupportedVersion unless the spec's major format
+// version is supported
+// Specs without a version predate versioning and are treated as version 1.
+func (s *TransformSpec) CheckVersion() error {
+	if s.Version == "" {
+		return nil
+	}
+	major, _, _ := strings.Cut(strings.TrimPrefix(s.Version, "v"), ".")
+	if !supportedSpecVersions[major] {
+		return fmt.Errorf("%w: %s", ErrUnsupportedVersion, s.Version)
+	}
+	return nil
+}
+
+// ScopedOperations returns the spec's operations, with the spec's Scope
+// filled in for those that don't set their own
+func (s *TransformSpec) ScopedOperations() []Operation {
+	if s.Scope == "" {
+		return s.Operations
+	}
+	operations := make([]Operation, len(s.Operations))
+	for i, op := range s.Operations {
+		if op.Scope == "" {
+			op.Scope = s.Scope
+		}
+		operations[i] = op
+	}
+	return operations
+}
+
+// clone returns a copy of the spec that callers may modify freely
+func (s *TransformSpec) clone() *TransformSpec {
+	c := *s
+	c.Operations = append([]Operation(nil), s.Operations...)
+	c.Headers = append([]HeaderOperation(nil), s.Headers...)
+	return &c
 }
 
 // Variant represents an experiment variant
@@ -27,6 +132,22 @@ type Variant struct {
 	Name              string  `json:"name"`
 	IsControl         bool    `json:"is_control"`
 	TrafficAllocation float64 `json:"traffic_allocation"`
+	Ramp              *Ramp   `json:"ramp,omitempty"` // Overrides TrafficAllocation while set
+}
+
+// Ramp grows a variant's share of traffic linearly from StartPercent at
+// StartTime to TargetPercent at EndTime, taking it from the top of the
+// bucket range so the other variants keep theirs
+type Ramp struct {
+	StartPercent  float64   `json:"start_percent"`
+	TargetPercent float64   `json:"target_percent"`
+	StartTime     time.Time `json:"start_time"`
+	EndTime       time.Time `json:"end_time"`
+}
+
+// ActiveExperimentsResponse lists the experiments the proxy should run
+type ActiveExperimentsResponse struct {
+	ExperimentIDs []string `json:"experiment_ids"`
 }
 
 // AssignmentRequest for variant assignment
@@ -41,6 +162,20 @@ type AssignmentResponse struct {
 	VariantKey string `json:"variant_key"`
 }
 
+// AssignmentBundleRequest asks the API to assign a variant and return its
+// transform spec in one round trip
+type AssignmentBundleRequest struct {
+	ExperimentID string  `json:"experiment_id"`
+	UserID       string  `json:"user_id"`
+	Bucket       float64 `json:"bucket"` // The proxy's HMAC bucket in [0, 1)
+}
+
+// AssignmentBundleResponse carries the assigned variant and its transform spec
+type AssignmentBundleResponse struct {
+	Variant Variant       `json:"variant"`
+	Spec    TransformSpec `json:"transform_spec"`
+}
+
 const (
 	// Operation types
 	OpSetText  = "setText"
@@ -50,4 +185,98 @@ const (
 	OpRemove   = "remove"
 	OpHide     = "hide"
 	OpShow     = "show"
+
+	// Text-only replacement that keeps element children
+	OpSetTextContent = "setTextContent"
+
+	// Class list operation types
+	OpAddClass    = "addClass"
+	OpRemoveClass = "removeClass"
+	OpToggleClass = "toggleClass"
+
+	// Child insertion operation types
+	OpAppend  = "append"
+	OpPrepend = "prepend"
+
+	// Sibling insertion operation types
+	OpInsertBefore = "insertBefore"
+	OpInsertAfter  = "insertAfter"
+	OpReplaceWith  = "replaceWith"
+
+	// Data attribute operation type
+	OpSetData = "setData"
+
+	// Structured data operation type; Property is the dotted path of the
+	// field to set in a JSON script block, e.g. "offers.price"
+	OpSetJSONField = "setJSONField"
+
+	// Conditional operation types; setTextIf's Property holds the condition
+	OpSetTextIf       = "setTextIf"
+	OpSetAttrIfAbsent = "setAttrIfAbsent" // Leaves existing values intact
+
+	// Restructuring operation types
+	OpWrap   = "wrap"
+	OpUnwrap = "unwrap"
+	OpMove   = "move" // Value is the destination selector, Property the position
+
+	// Cleanup operation type, applied after all other operations
+	OpRemoveIfEmpty = "removeIfEmpty"
 )
+
+// booleanAttributes are the HTML attributes whose presence alone turns them
+// on, so disabled="false" still disables an element
+var booleanAttributes = map[string]bool{
+	"allowfullscreen": true,
+	"async":           true,
+	"autofocus":       true,
+	"autoplay":        true,
+	"checked":         true,
+	"controls":        true,
+	"default":         true,
+	"defer":           true,
+	"disabled":        true,
+	"formnovalidate":  true,
+	"hidden":          true,
+	"inert":           true,
+	"ismap":           true,
+	"itemscope":       true,
+	"loop":            true,
+	"multiple":        true,
+	"muted":           true,
+	"nomodule":        true,
+	"novalidate":      true,
+	"open":            true,
+	"playsinline":     true,
+	"readonly":        true,
+	"required":        true,
+	"reversed":        true,
+	"selected":        true,
+}
+
+// knownOperations lists every operation type applyOperation handles
+var knownOperations = map[string]bool{
+	OpSetText:         true,
+	OpSetTextContent:  true,
+	OpSetStyle:        true,
+	OpSetAttr:         true,
+	OpSetHTML:         true,
+	OpRemove:          true,
+	OpHide:            true,
+	OpShow:            true,
+	OpAddClass:        true,
+	OpRemoveClass:     true,
+	OpToggleClass:     true,
+	OpAppend:          true,
+	OpPrepend:         true,
+	OpInsertBefore:    true,
+	OpInsertAfter:     true,
+	OpReplaceWith:     true,
+	OpSetData:         true,
+	OpSetJSONField:    true,
+	OpSetTextIf:       true,
+	OpSetAttrIfAbsent: true,
+	OpWrap:            true,
+	OpUnwrap:          true,
+	OpMove:            true,
+	OpRemoveIfEmpty:   true,
+}
@@ -0,0 +1,63 @@
+package transform
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestOperationText(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		encoded  bool
+		want     string // What text returns
+		rendered string // How setText renders it
+	}{
+		{"ampersand entity, plain", "Fish &amp; Chips", false, "Fish &amp; Chips", "Fish &amp;amp; Chips"},
+		{"ampersand entity, encoded", "Fish &amp; Chips", true, "Fish & Chips", "Fish &amp; Chips"},
+		{"escaped markup, plain", "&lt;b&gt;new&lt;/b&gt;", false, "&lt;b&gt;new&lt;/b&gt;", "&amp;lt;b&amp;gt;new&amp;lt;/b&amp;gt;"},
+		{"escaped markup, encoded", "&lt;b&gt;new&lt;/b&gt;", true, "<b>new</b>", "&lt;b&gt;new&lt;/b&gt;"},
+		{"bare ampersand, plain", "Fish & Chips", false, "Fish & Chips", "Fish &amp; Chips"},
+		{"bare ampersand, encoded", "Fish & Chips", true, "Fish & Chips", "Fish &amp; Chips"},
+		{"literal markup, plain", "<b>new</b>", false, "<b>new</b>", "&lt;b&gt;new&lt;/b&gt;"},
+		{"literal markup, encoded", "<b>new</b>", true, "<b>new</b>", "&lt;b&gt;new&lt;/b&gt;"},
+		{"numeric reference, encoded", "caf&#233; &#x2014;", true, "café —", "café —"},
+		{"unknown entity, encoded", "&bogus; &amp", true, "&bogus; &", "&amp;bogus; &amp;"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			op := Operation{Type: OpSetText, Selector: "h1", Value: tt.value, Encoded: tt.encoded}
+			if got := op.text(); got != tt.want {
+				t.Errorf("text() = %q, want %q", got, tt.want)
+			}
+
+			want := "<h1>" + tt.rendered + "</h1>"
+			out, _, err := Apply(`<h1>Old</h1>`, []Operation{op})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out != want {
+				t.Errorf("buffered %q, want %q", out, want)
+			}
+			var streamed bytes.Buffer
+			if _, err := StreamTransformations(&streamed, strings.NewReader(`<h1>Old</h1>`), [][]Operation{{op}}, ApplyOptions{}, 0); err != nil {
+				t.Fatal(err)
+			}
+			if streamed.String() != want {
+				t.Errorf("streamed %q, want %q", streamed.String(), want)
+			}
+		})
+	}
+}
+
+func TestOperationTextOnlyForText(t *testing.T) {
+	// Encoded only changes text operations; fragments are parsed as HTML
+	out, _, err := Apply(`<div></div>`, []Operation{{Type: OpAppend, Selector: "div", Value: "<b>a &amp; b</b>", Encoded: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `<div><b>a &amp; b</b></div>`; out != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+}
@@ -0,0 +1,119 @@
+package transform
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+// maxSnippetLength bounds the before/after HTML reported per node
+const maxSnippetLength = 200
+
+// OpPreview describes what a single operation changed
+type OpPreview struct {
+	Index    int          `json:"index"`
+	Type     string       `json:"type"`
+	Selector string       `json:"selector"`
+	Nodes    []NodeChange `json:"nodes"`
+	NoOp     bool         `json:"noop"`
+	Error    string       `json:"error,omitempty"`
+
+	// Conflicts lists earlier operations whose changes this one overrode
+	Conflicts []int `json:"conflicts,omitempty"`
+}
+
+// NodeChange holds a touched node's HTML before and after an operation
+type NodeChange struct {
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// PreviewTransformations applies operations like ApplyTransformations and
+// reports, per operation, the HTML of each touched node before and after
+// Callers should pass a document they don't intend to serve
+func PreviewTransformations(doc *html.Node, operations []Operation, opts ApplyOptions) []OpPreview {
+	previews := make([]OpPreview, 0, len(operations))
+	scopes, writes := scopeCache{}, writeLog{}
+	for _, i := range applicationOrder(operations) {
+		op := operations[i]
+
+		// Operations that insert or replace siblings are shown via the parent
+		var targets []*html.Node
+		for _, node := range limitNodes(scopes.find(doc, op), op.Limit) {
+			if affectsSiblings(op.Type) && node.Parent != nil {
+				node = node.Parent
+			}
+			targets = append(targets, node)
+		}
+
+		changes := make([]NodeChange, len(targets))
+		for j, node := range targets {
+			changes[j].Before = renderSnippet(node)
+		}
+
+		_, _, conflicts, err := applyOperation(doc, op, i, opts, scopes, writes)
+
+		noop := true
+		for j, node := range targets {
+			if isAttached(node) {
+				changes[j].After = renderSnippet(node)
+			}
+			if changes[j].After != changes[j].Before {
+				noop = false
+			}
+		}
+
+		preview := OpPreview{
+			Index:     i,
+			Type:      op.Type,
+			Selector:  op.Selector,
+			Nodes:     changes,
+			NoOp:      noop,
+			Conflicts: conflicts,
+		}
+		if err != nil {
+			preview.Error = err.Error()
+		}
+		previews = append(previews, preview)
+	}
+	return previews
+}
+
+// affectsSiblings reports whether an operation changes a node's siblings or
+// its place among them, rather than only the node itself
+func affectsSiblings(opType string) bool {
+	switch opType {
+	case OpInsertBefore, OpInsertAfter, OpReplaceWith, OpWrap, OpUnwrap, OpMove:
+		return true
+	}
+	return false
+}
+
+// isAttached reports whether a node is still part of a document tree
+func isAttached(node *html.Node) bool {
+	for n := node; n != nil; n = n.Parent {
+		if n.Type == html.DocumentNode {
+			return true
+		}
+	}
+	return false
+}
+
+// renderSnippet renders a node's outer HTML, truncated for reporting
+func renderSnippet(node *html.Node) string {
+	var b strings.Builder
+	if err := html.Render(&b, node); err != nil {
+		return ""
+	}
+
+	snippet := b.String()
+	if len(snippet) > maxSnippetLength {
+		cut := maxSnippetLength
+		for cut > 0 && !utf8.RuneStart(snippet[cut]) {
+			cut--
+		}
+		snippet = snippet[:cut] + "..."
+	}
+	return snippet
+}
@@ -0,0 +1,75 @@
+package transform
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned without contacting the API when the client
+// is over its rate limit and can't wait for its turn
+var ErrRateLimited = errors.New("rate limit reached: ExperiFlow API call skipped")
+
+// rateLimiter is a token bucket spacing out calls to the API
+// Tokens refill at rate per second up to burst. A call without a token
+// waits for the next one, up to maxWait and never past its context
+// deadline; calls that would wait longer fail at once.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // Zero disables the limiter
+	burst   float64
+	maxWait time.Duration
+
+	tokens float64 // Negative while calls wait for tokens they reserved
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int, maxWait time.Duration) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), maxWait: maxWait, tokens: float64(burst)}
+}
+
+// wait takes a token, waiting for one when the bucket is empty
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l.rate <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if !l.last.IsZero() {
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+
+	// Reserve the token, then wait until it has refilled
+	delay := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	if delay > 0 {
+		deadline, ok := ctx.Deadline()
+		if delay > l.maxWait || ok && time.Until(deadline) < delay {
+			l.mu.Unlock()
+			return ErrRateLimited
+		}
+	}
+	l.tokens--
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Give the reservation back for the next call
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,96 @@
+package transform
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// unsafeElements are dropped from injected fragments along with their content
+var unsafeElements = map[string]bool{
+	"script": true,
+	"style":  true,
+}
+
+// urlAttributes may carry javascript: URLs
+var urlAttributes = map[string]bool{
+	"href":       true,
+	"src":        true,
+	"action":     true,
+	"formaction": true,
+	"xlink:href": true,
+}
+
+// sanitizeNodes strips scripts, styles, event handlers, javascript: URLs,
+// and non-element/text nodes from a parsed fragment
+func sanitizeNodes(nodes []*html.Node) []*html.Node {
+	var result []*html.Node
+	for _, node := range nodes {
+		if isSafeNode(node) {
+			sanitizeNode(node)
+			result = append(result, node)
+		}
+	}
+	return result
+}
+
+// sanitizeNode cleans a node's attributes and children in place
+func sanitizeNode(node *html.Node) {
+	if node.Type != html.ElementNode {
+		return
+	}
+
+	attrs := node.Attr[:0]
+	for _, attr := range node.Attr {
+		if isSafeAttr(attr) {
+			attrs = append(attrs, attr)
+		}
+	}
+	node.Attr = attrs
+
+	for child := node.FirstChild; child != nil; {
+		next := child.NextSibling
+		if isSafeNode(child) {
+			sanitizeNode(child)
+		} else {
+			node.RemoveChild(child)
+		}
+		child = next
+	}
+}
+
+// isSafeNode reports whether a node may be kept in a sanitized fragment
+func isSafeNode(node *html.Node) bool {
+	switch node.Type {
+	case html.TextNode:
+		return true
+	case html.ElementNode:
+		return !unsafeElements[strings.ToLower(node.Data)]
+	}
+	return false
+}
+
+// isSafeAttr reports whether an attribute may be kept on a sanitized element
+func isSafeAttr(attr html.Attribute) bool {
+	key := strings.ToLower(attr.Key)
+	if strings.HasPrefix(key, "on") {
+		return false
+	}
+	if urlAttributes[key] && isJavaScriptURL(attr.Val) {
+		return false
+	}
+	return true
+}
+
+// isJavaScriptURL reports whether a URL uses the javascript: scheme,
+// ignoring case and the whitespace/control characters browsers skip
+func isJavaScriptURL(value string) bool {
+	var b strings.Builder
+	for _, r := range value {
+		if r <= ' ' {
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return strings.HasPrefix(strings.ToLower(b.String()), "javascript:")
+}
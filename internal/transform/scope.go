@@ -0,0 +1,75 @@
+package transform
+
+import (
+	"fmt"
+
+	"golang.org/x/net/html"
+)
+
+// scopeCache holds the containers each scope selector resolved to, so the
+// operations sharing a scope search the document for it only once
+type scopeCache map[string][]*html.Node
+
+// find returns the nodes an operation's selector matches, searching only
+// inside the containers its Scope matches when it has one
+func (c scopeCache) find(doc *html.Node, op Operation) []*html.Node {
+	if op.Scope == "" {
+		return findNodesBySelector(doc, op.Selector)
+	}
+	var nodes []*html.Node
+	for _, container := range c.containers(doc, op.Scope) {
+		for child := container.FirstChild; child != nil; child = child.NextSibling {
+			nodes = append(nodes, findNodesBySelector(child, op.Selector)...)
+		}
+	}
+	return nodes
+}
+
+// containers returns the outermost nodes a scope selector matched when the
+// first operation using it ran, less any since removed from the document
+func (c scopeCache) containers(doc *html.Node, scope string) []*html.Node {
+	cached, ok := c[scope]
+	if !ok {
+		for _, node := range findNodesBySelector(doc, scope) {
+			// Nested containers are searched through the one around them
+			if len(cached) == 0 || !contains(cached[len(cached)-1], node) {
+				cached = append(cached, node)
+			}
+		}
+		c[scope] = cached
+		return cached
+	}
+
+	kept := cached[:0]
+	for _, node := range cached {
+		if isAttached(node) {
+			kept = append(kept, node)
+		}
+	}
+	c[scope] = kept
+	return kept
+}
+
+// inScope reports whether a node is inside an element matching scope, for
+// matching one element at a time
+func inScope(node *html.Node, scope []func(*html.Node) bool) bool {
+	if scope == nil {
+		return true
+	}
+	for n := node.Parent; n != nil; n = n.Parent {
+		for _, match := range scope {
+			if match(n) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// targetLabel describes what an operation targets, for errors
+func targetLabel(op Operation) string {
+	if op.Scope == "" {
+		return op.Selector
+	}
+	return fmt.Sprintf("%s (within %s)", op.Selector, op.Scope)
+}
@@ -0,0 +1,559 @@
+package transform
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Combinators linking compound selectors
+const (
+	combDescendant      = ' '
+	combChild           = '>'
+	combAdjacentSibling = '+'
+	combGeneralSibling  = '~'
+)
+
+// Compiled selectors are kept for selectorCacheTTL, up to
+// selectorCacheSize distinct selector strings
+const (
+	selectorCacheSize = 4096
+	selectorCacheTTL  = time.Hour
+)
+
+// compiledSelectors caches compiled selector lists by selector string
+var compiledSelectors = newTTLCache[[]func(*html.Node) bool](selectorCacheSize)
+
+// selectorStep is one compound selector and the combinator that links it
+// to the step before it
+type selectorStep struct {
+	match      func(*html.Node) bool
+	combinator byte
+}
+
+// findNodesBySelector finds nodes matching a CSS selector
+// Supports: .class, #id, element, [attr], [attr=value] (also ^=, $=, *=,
+// ~= and |=), :root, :first-child, :last-child, :nth-child(an+b),
+// compounds such as div.card, and the descendant, child (>), adjacent (+)
+// and general (~) sibling combinators
+// Comma-separated selector lists match the union of their branches. Only
+// elements match, never the document, text, or comment nodes; :root is
+// the <html> element.
+func findNodesBySelector(doc *html.Node, selector string) []*html.Node {
+	var results []*html.Node
+
+	matchers := compileSelectorList(selector)
+	if len(matchers) == 0 {
+		return nil
+	}
+
+	// Walk the tree once so nodes matching several branches (or several
+	// ancestors) are only returned once, in document order
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			for _, match := range matchers {
+				if match(n) {
+					results = append(results, n)
+					break
+				}
+			}
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(doc)
+
+	return results
+}
+
+// compileSelectorList compiles each branch of a selector list, reusing
+// the compiled form when the same selector was seen recently
+// Match functions hold no state, so they are shared across goroutines.
+func compileSelectorList(selector string) []func(*html.Node) bool {
+	if matchers, ok := compiledSelectors.Get(selector); ok {
+		return matchers
+	}
+
+	var matchers []func(*html.Node) bool
+	for _, part := range splitSelectorList(selector) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		matchers = append(matchers, compileSelector(part))
+	}
+	compiledSelectors.Set(selector, matchers, selectorCacheTTL)
+	return matchers
+}
+
+// splitSelectorList splits a selector list on top-level commas,
+// ignoring commas inside brackets, parentheses, or quoted strings
+func splitSelectorList(selector string) []string {
+	var parts []string
+	start := 0
+	scanTopLevel(selector, func(i int, r rune) {
+		if r == ',' {
+			parts = append(parts, selector[start:i])
+			start = i + 1
+		}
+	})
+	return append(parts, selector[start:])
+}
+
+// scanTopLevel calls fn for every rune of s that is outside brackets,
+// parentheses, and quoted strings
+func scanTopLevel(s string, fn func(i int, r rune)) {
+	depth := 0
+	var quote rune
+
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '[' || r == '(':
+			depth++
+		case (r == ']' || r == ')') && depth > 0:
+			depth--
+		case depth == 0:
+			fn(i, r)
+		}
+	}
+}
+
+// compileSelector builds a match function for a single complex selector
+// such as ".card > .title". Matching runs right to left: the node must
+// match the rightmost compound, and its ancestors/siblings the rest.
+func compileSelector(selector string) func(*html.Node) bool {
+	steps, ok := parseComplexSelector(selector)
+	if !ok {
+		return func(*html.Node) bool { return false }
+	}
+	return func(n *html.Node) bool {
+		return matchSteps(n, steps)
+	}
+}
+
+// parseComplexSelector splits a selector into compound steps and combinators
+func parseComplexSelector(selector string) ([]selectorStep, bool) {
+	var steps []selectorStep
+	var pending byte // combinator seen since the last compound
+	start := -1
+	depth := 0
+	var quote byte
+
+	flush := func(end int) bool {
+		if start < 0 {
+			return true
+		}
+		match, ok := compileCompound(selector[start:end])
+		if !ok {
+			return false
+		}
+		steps = append(steps, selectorStep{match: match, combinator: pending})
+		pending = 0
+		start = -1
+		return true
+	}
+
+	for i := 0; i < len(selector); i++ {
+		c := selector[i]
+
+		// Brackets, parentheses and quotes belong to the current compound
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		if depth > 0 {
+			switch c {
+			case '"', '\'':
+				quote = c
+			case '[', '(':
+				depth++
+			case ']', ')':
+				depth--
+			}
+			continue
+		}
+
+		switch c {
+		case ' ', '\t', '\n', '\r', '\f':
+			if !flush(i) {
+				return nil, false
+			}
+			if pending == 0 && len(steps) > 0 {
+				pending = combDescendant
+			}
+		case combChild, combAdjacentSibling, combGeneralSibling:
+			if !flush(i) {
+				return nil, false
+			}
+			// A leading or doubled combinator is invalid
+			if len(steps) == 0 || (pending != 0 && pending != combDescendant) {
+				return nil, false
+			}
+			pending = c
+		default:
+			if c == '[' || c == '(' {
+				depth++
+			}
+			if start < 0 {
+				start = i
+			}
+		}
+	}
+	if !flush(len(selector)) {
+		return nil, false
+	}
+
+	// A dangling combinator is invalid
+	if len(steps) == 0 || (pending != 0 && pending != combDescendant) {
+		return nil, false
+	}
+	return steps, true
+}
+
+// matchSteps reports whether n matches the last step, with the remaining
+// steps satisfied by its ancestors or siblings
+func matchSteps(n *html.Node, steps []selectorStep) bool {
+	last := steps[len(steps)-1]
+	if !last.match(n) {
+		return false
+	}
+	if len(steps) == 1 {
+		return true
+	}
+
+	rest := steps[:len(steps)-1]
+	switch last.combinator {
+	case combChild:
+		return n.Parent != nil && matchSteps(n.Parent, rest)
+	case combAdjacentSibling:
+		prev := prevElementSibling(n)
+		return prev != nil && matchSteps(prev, rest)
+	case combGeneralSibling:
+		for prev := prevElementSibling(n); prev != nil; prev = prevElementSibling(prev) {
+			if matchSteps(prev, rest) {
+				return true
+			}
+		}
+	default:
+		for parent := n.Parent; parent != nil; parent = parent.Parent {
+			if matchSteps(parent, rest) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compoundDelimiters start a new simple selector within a compound
+const compoundDelimiters = ".#[:"
+
+// compileCompound builds a match function for a compound selector such as
+// li.item#main[data-x]:first-child
+func compileCompound(compound string) (func(*html.Node) bool, bool) {
+	var matchers []func(*html.Node) bool
+
+	// Leading element name (or universal selector)
+	i := 0
+	for i < len(compound) && !strings.ContainsRune(compoundDelimiters, rune(compound[i])) {
+		i++
+	}
+	if tag := compound[:i]; tag != "" && tag != "*" {
+		// HTML element names are case-insensitive; the parser lowercases them
+		matchers = append(matchers, func(n *html.Node) bool {
+			return n.Type == html.ElementNode && strings.EqualFold(n.Data, tag)
+		})
+	} else if tag == "*" {
+		matchers = append(matchers, func(n *html.Node) bool {
+			return n.Type == html.ElementNode
+		})
+	}
+
+	for i < len(compound) {
+		switch compound[i] {
+		case '.', '#':
+			end := i + 1
+			for end < len(compound) && !strings.ContainsRune(compoundDelimiters, rune(compound[end])) {
+				end++
+			}
+			name := compound[i+1 : end]
+			if name == "" {
+				return nil, false
+			}
+			if compound[i] == '.' {
+				// Class selector
+				matchers = append(matchers, func(n *html.Node) bool {
+					return hasClass(n, name)
+				})
+			} else {
+				// ID selector
+				matchers = append(matchers, func(n *html.Node) bool {
+					return getAttr(n, "id") == name
+				})
+			}
+			i = end
+		case '[':
+			end := closingBracket(compound, i)
+			if end < 0 {
+				return nil, false
+			}
+			matchers = append(matchers, compileAttrSelector(compound[i+1:end]))
+			i = end + 1
+		case ':':
+			end := i + 1
+			for end < len(compound) && !strings.ContainsRune(compoundDelimiters+"(", rune(compound[end])) {
+				end++
+			}
+			name := strings.ToLower(compound[i+1 : end])
+			arg := ""
+			if end < len(compound) && compound[end] == '(' {
+				closing := strings.IndexByte(compound[end:], ')')
+				if closing < 0 {
+					return nil, false
+				}
+				arg = compound[end+1 : end+closing]
+				end += closing + 1
+			}
+			match, ok := compilePseudo(name, arg)
+			if !ok {
+				return nil, false
+			}
+			matchers = append(matchers, match)
+			i = end
+		default:
+			return nil, false
+		}
+	}
+
+	if len(matchers) == 0 {
+		return nil, false
+	}
+	return func(n *html.Node) bool {
+		for _, match := range matchers {
+			if !match(n) {
+				return false
+			}
+		}
+		return true
+	}, true
+}
+
+// compilePseudo builds a match function for a supported pseudo-class
+func compilePseudo(name, arg string) (func(*html.Node) bool, bool) {
+	switch name {
+	case "first-child":
+		return func(n *html.Node) bool {
+			return n.Type == html.ElementNode && prevElementSibling(n) == nil
+		}, true
+	case "last-child":
+		return func(n *html.Node) bool {
+			return n.Type == html.ElementNode && nextElementSibling(n) == nil
+		}, true
+	case "root":
+		// The <html> element; fragments have no document element
+		return func(n *html.Node) bool {
+			return n.Type == html.ElementNode && n.DataAtom == atom.Html &&
+				n.Parent != nil && n.Parent.Type == html.DocumentNode
+		}, true
+	case "nth-child":
+		a, b, ok := parseNth(arg)
+		if !ok {
+			return nil, false
+		}
+		return func(n *html.Node) bool {
+			return n.Type == html.ElementNode && matchesNth(a, b, elementPosition(n))
+		}, true
+	}
+	return nil, false
+}
+
+// parseNth parses an an+b expression, including "odd" and "even"
+func parseNth(expr string) (int, int, bool) {
+	expr = strings.ToLower(strings.Join(strings.Fields(expr), ""))
+	switch expr {
+	case "odd":
+		return 2, 1, true
+	case "even":
+		return 2, 0, true
+	case "":
+		return 0, 0, false
+	}
+
+	aStr, bStr, hasN := strings.Cut(expr, "n")
+	if !hasN {
+		b, err := strconv.Atoi(expr)
+		return 0, b, err == nil
+	}
+
+	var a int
+	switch aStr {
+	case "", "+":
+		a = 1
+	case "-":
+		a = -1
+	default:
+		var err error
+		if a, err = strconv.Atoi(aStr); err != nil {
+			return 0, 0, false
+		}
+	}
+
+	b := 0
+	if bStr != "" {
+		// b must carry an explicit sign after the n term
+		if bStr[0] != '+' && bStr[0] != '-' {
+			return 0, 0, false
+		}
+		var err error
+		if b, err = strconv.Atoi(bStr); err != nil {
+			return 0, 0, false
+		}
+	}
+	return a, b, true
+}
+
+// matchesNth reports whether a 1-based position satisfies an+b for some n >= 0
+func matchesNth(a, b, position int) bool {
+	if a == 0 {
+		return position == b
+	}
+	diff := position - b
+	return diff%a == 0 && diff/a >= 0
+}
+
+// elementPosition returns a node's 1-based index among its element siblings
+// Text and comment nodes are not counted, matching browser behavior
+func elementPosition(n *html.Node) int {
+	position := 1
+	for prev := prevElementSibling(n); prev != nil; prev = prevElementSibling(prev) {
+		position++
+	}
+	return position
+}
+
+// compileAttrSelector builds a match function for the inside of an
+// attribute selector: attr, attr=value, or attr with one of the ^= (prefix),
+// $= (suffix), *= (substring), ~= (word), and |= (hyphen-prefix) operators
+func compileAttrSelector(attrStr string) func(*html.Node) bool {
+	parts := strings.SplitN(attrStr, "=", 2)
+	attrKey := strings.TrimSpace(parts[0])
+
+	if len(parts) == 1 {
+		// [attr] - has attribute
+		return func(n *html.Node) bool {
+			return hasAttr(n, attrKey)
+		}
+	}
+
+	attrValue := strings.Trim(strings.TrimSpace(parts[1]), "\"'")
+
+	// The operator is the punctuation just before "=", e.g. "^" in [href^=/p]
+	var operator byte
+	if trimmed := strings.TrimRight(attrKey, "^$*~!|%&+<>"); trimmed != attrKey {
+		operator = attrKey[len(attrKey)-1]
+		if len(attrKey)-len(trimmed) > 1 {
+			operator = '?'
+		}
+		attrKey = strings.TrimSpace(trimmed)
+	}
+
+	switch operator {
+	case 0:
+		// [attr=value] - an element without attr never equals "", as in CSS
+		return func(n *html.Node) bool {
+			return hasAttr(n, attrKey) && getAttr(n, attrKey) == attrValue
+		}
+	case '^':
+		// [attr^=value] - prefix
+		return func(n *html.Node) bool {
+			return attrValue != "" && strings.HasPrefix(getAttr(n, attrKey), attrValue)
+		}
+	case '$':
+		// [attr$=value] - suffix
+		return func(n *html.Node) bool {
+			return attrValue != "" && strings.HasSuffix(getAttr(n, attrKey), attrValue)
+		}
+	case '*':
+		// [attr*=value] - substring
+		return func(n *html.Node) bool {
+			return attrValue != "" && strings.Contains(getAttr(n, attrKey), attrValue)
+		}
+	case '~':
+		// [attr~=value] - whitespace-separated word
+		return func(n *html.Node) bool {
+			return indexOf(strings.Fields(getAttr(n, attrKey)), attrValue) >= 0
+		}
+	case '|':
+		// [attr|=value] - exact or hyphen-prefixed, e.g. en matches en-US
+		return func(n *html.Node) bool {
+			value := getAttr(n, attrKey)
+			return hasAttr(n, attrKey) && (value == attrValue || strings.HasPrefix(value, attrValue+"-"))
+		}
+	}
+
+	// Unrecognized operator - fall back to a has-attribute check
+	return func(n *html.Node) bool {
+		return hasAttr(n, attrKey)
+	}
+}
+
+// closingBracket returns the index of the ']' closing the '[' at start,
+// skipping quoted strings, or -1 if there is none
+func closingBracket(s string, start int) int {
+	var quote byte
+	for i := start + 1; i < len(s); i++ {
+		switch {
+		case quote != 0:
+			if s[i] == quote {
+				quote = 0
+			}
+		case s[i] == '"' || s[i] == '\'':
+			quote = s[i]
+		case s[i] == ']':
+			return i
+		}
+	}
+	return -1
+}
+
+// firstElementChild returns the first child that is an element
+func firstElementChild(n *html.Node) *html.Node {
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == html.ElementNode {
+			return child
+		}
+	}
+	return nil
+}
+
+// prevElementSibling returns the closest preceding element sibling
+func prevElementSibling(n *html.Node) *html.Node {
+	for prev := n.PrevSibling; prev != nil; prev = prev.PrevSibling {
+		if prev.Type == html.ElementNode {
+			return prev
+		}
+	}
+	return nil
+}
+
+// nextElementSibling returns the closest following element sibling
+func nextElementSibling(n *html.Node) *html.Node {
+	for next := n.NextSibling; next != nil; next = next.NextSibling {
+		if next.Type == html.ElementNode {
+			return next
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package transform
+
+import (
+	"strings"
+	"testing"
+)
+
+// matchIDs returns the ids of the elements in page matching selector
+func matchIDs(t *testing.T, page, selector string) string {
+	t.Helper()
+	doc, err := ParseDocument([]byte(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, node := range findNodesBySelector(doc, selector) {
+		ids = append(ids, getAttr(node, "id"))
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestHyphenPrefixAttributeSelector(t *testing.T) {
+	const page = `<p id="en" lang="en"></p>` +
+		`<p id="en-US" lang="en-US"></p>` +
+		`<p id="en-" lang="en-"></p>` +
+		`<p id="eng" lang="eng"></p>` +
+		`<p id="EN" lang="EN"></p>` +
+		`<p id="fr-en" lang="fr-en"></p>` +
+		`<p id="empty" lang=""></p>` +
+		`<p id="dash" lang="-x"></p>` +
+		`<p id="none"></p>`
+	tests := []struct {
+		selector string
+		want     string
+	}{
+		{`[lang|=en]`, "en,en-US,en-"},
+		{`[lang|="en"]`, "en,en-US,en-"},
+		{`[lang|='en']`, "en,en-US,en-"},
+		{`[ lang |= en ]`, "en,en-US,en-"},
+		{`[lang|=en-US]`, "en-US"},
+		{`[lang|=e]`, ""},
+		{`[lang|=EN]`, "EN"},
+		{`[lang|=fr]`, "fr-en"},
+		{`[lang|=""]`, "empty,dash"},
+		{`p[lang|=en]:first-child`, "en"},
+		{`[lang=en]`, "en"},
+		{`[lang^=en]`, "en,en-US,en-,eng"},
+	}
+	for _, tt := range tests {
+		if got := matchIDs(t, page, tt.selector); got != tt.want {
+			t.Errorf("%s matched [%s], want [%s]", tt.selector, got, tt.want)
+		}
+	}
+}
+
+func TestWordAttributeSelector(t *testing.T) {
+	const page = `<a id="one" class="btn"></a>` +
+		`<a id="several" class="btn btn-primary"></a>` +
+		`<a id="prefixed" class="btn-primary"></a>` +
+		`<a id="spaced" class="  big	btn "></a>` +
+		`<a id="none"></a>`
+	tests := []struct {
+		selector string
+		want     string
+	}{
+		{`[class~=btn]`, "one,several,spaced"},
+		{`[class~=btn-primary]`, "several,prefixed"},
+		{`[class~=bt]`, ""},
+		{`[class~=""]`, ""},
+		{`[class~="btn btn-primary"]`, ""},
+	}
+	for _, tt := range tests {
+		if got := matchIDs(t, page, tt.selector); got != tt.want {
+			t.Errorf("%s matched [%s], want [%s]", tt.selector, got, tt.want)
+		}
+	}
+}
+
+func TestExactAttributeSelector(t *testing.T) {
+	const page = `<img id="empty" alt="">` +
+		`<img id="missing">` +
+		`<img id="text" alt="Logo">`
+	tests := []struct {
+		selector string
+		want     string
+	}{
+		{`img[alt=""]`, "empty"},
+		{`[alt=Logo]`, "text"},
+		{`img[title=""]`, ""},
+	}
+	for _, tt := range tests {
+		if got := matchIDs(t, page, tt.selector); got != tt.want {
+			t.Errorf("%s matched [%s], want [%s]", tt.selector, got, tt.want)
+		}
+	}
+}
+
+func TestHyphenatedIdentifiers(t *testing.T) {
+	const page = `<div id="-lead" class="-promo"></div>` +
+		`<div id="double" class="--accent"></div>` +
+		`<div id="inner" class="card-body card"></div>` +
+		`<div id="tail" class="card-"></div>` +
+		`<div id="data" data-exp-id="7"></div>`
+	tests := []struct {
+		selector string
+		want     string
+	}{
+		{`.-promo`, "-lead"},
+		{`#-lead`, "-lead"},
+		{`.--accent`, "double"},
+		{`.card`, "inner"},
+		{`.card-body`, "inner"},
+		{`.card-`, "tail"},
+		{`div.card-body.card`, "inner"},
+		{`[data-exp-id]`, "data"},
+		{`[data-exp-id=7]`, "data"},
+		{`[data-exp-id|=7]`, "data"},
+	}
+	for _, tt := range tests {
+		if got := matchIDs(t, page, tt.selector); got != tt.want {
+			t.Errorf("%s matched [%s], want [%s]", tt.selector, got, tt.want)
+		}
+	}
+}
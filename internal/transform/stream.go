@@ -0,0 +1,941 @@
+package transform
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// ErrStreamBuffer is reported for operations on an element too large to
+// buffer while streaming; the element is passed through untouched
+var ErrStreamBuffer = errors.New("element too large to buffer while streaming")
+
+// streamPeekBytes is how much of a streamed page is first read to tell
+// documents from fragments; the peek grows past long leading comments
+const streamPeekBytes = 512
+
+// CanStream reports whether StreamTransformations can apply operations
+// Moves need the whole document, and selectors and scopes must be
+// decidable from an element and its ancestors, which rules out sibling
+// combinators and every pseudo-class other than :root.
+func CanStream(operations []Operation) bool {
+	for _, op := range operations {
+		if op.Type == OpMove || !streamableSelector(op.Selector) || !streamableSelector(op.Scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// streamableSelector reports whether a selector only looks at an element
+// and its ancestors
+func streamableSelector(selector string) bool {
+	ok := true
+	scanTopLevel(selector, func(i int, r rune) {
+		switch r {
+		case combAdjacentSibling, combGeneralSibling:
+			ok = false
+		case ':':
+			ok = ok && strings.HasPrefix(selector[i+1:], "root")
+		}
+	})
+	return ok
+}
+
+// StreamTransformations applies each spec's operations, in turn, to the HTML
+// read from r while writing the result to w, so the start of the page goes
+// out before the rest has arrived. Specs must pass CanStream.
+// Markup no operation touches is copied through byte for byte. Attribute
+// and style operations rewrite just the start tag, and append, prepend,
+// insertBefore and insertAfter write their fragments at the element's
+// edges. Other operations buffer the element until it ends, up to
+// maxBuffer bytes (0 is unlimited), and apply to it as a parsed tree.
+// Results match ApplyTransformations, except that an operation reaching
+// opts.MaxMatchedNodes fails with the nodes before the limit changed,
+// scopes are checked as each element arrives rather than resolved once,
+// and conflicts are only found between operations on the same parsed
+// node, so not between one that streams an element and one that buffers it.
+// Specs over opts.MaxOperations are rejected before anything is read.
+// Elements are matched against the tags as written, with the tags the
+// parser implies (html, head, body, tbody, and optional end tags), so
+// markup the parser restructures, such as misnested formatting tags or
+// content foster-parented out of a table, may match differently.
+func StreamTransformations(w io.Writer, r io.Reader, specs [][]Operation, opts ApplyOptions, maxBuffer int) ([][]OpResult, error) {
+	for _, operations := range specs {
+		if opts.MaxOperations > 0 && len(operations) > opts.MaxOperations {
+			return nil, fmt.Errorf("%w: %d (limit %d)", ErrTooManyOperations, len(operations), opts.MaxOperations)
+		}
+	}
+
+	s := &streamer{w: w, opts: opts, maxBuffer: maxBuffer, doc: &html.Node{Type: html.DocumentNode}}
+	for i, operations := range specs {
+		writes := writeLog{}
+		for _, index := range applicationOrder(operations) {
+			op := operations[index]
+			s.ops = append(s.ops, newStreamOp(op, i, index, writes))
+			s.buffers = s.buffers || needsBuffer(op.Type, true)
+		}
+	}
+
+	reader := bufio.NewReader(r)
+	s.fragment = peekFragment(reader)
+	s.headSeen, s.inBody = s.fragment, s.fragment
+
+	z := html.NewTokenizer(reader)
+	for s.err == nil {
+		z.AllowCDATA(s.top().Namespace != "")
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if err := z.Err(); err != io.EOF {
+				return nil, err
+			}
+			break
+		}
+		s.token(z, tt)
+	}
+	for len(s.stack) > 0 && s.err == nil {
+		s.pop(nil)
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	results := make([][]OpResult, len(specs))
+	for _, op := range s.ops {
+		results[op.spec] = append(results[op.spec], op.result())
+	}
+	return results, nil
+}
+
+// peekFragment reports whether the page is a fragment, as ParseDocument
+// decides, peeking past leading comments as far as the buffer allows
+func peekFragment(reader *bufio.Reader) bool {
+	for n := streamPeekBytes; ; n *= 2 {
+		prefix, err := reader.Peek(min(n, reader.Size()))
+		if _, ok := trimLeadingComments(prefix); ok || err != nil || n >= reader.Size() {
+			return isFragment(prefix)
+		}
+	}
+}
+
+// streamOp is an operation being streamed, with its running outcome
+type streamOp struct {
+	Operation
+	spec     int // Which spec it's from
+	index    int // Position in the spec
+	matchers []func(*html.Node) bool
+	scope    []func(*html.Node) bool // nil without a scope
+	writes   writeLog                // Shared by the spec's operations
+
+	matched, skipped, applied int
+	conflicts                 []int
+	err                       error
+}
+
+// newStreamOp compiles an operation's selector and scope
+func newStreamOp(op Operation, spec, index int, writes writeLog) *streamOp {
+	s := &streamOp{Operation: op, spec: spec, index: index, matchers: compileSelectorList(op.Selector), writes: writes}
+	if op.Scope != "" {
+		// A scope that compiles to nothing matches nothing
+		s.scope = append([]func(*html.Node) bool{}, compileSelectorList(op.Scope)...)
+	}
+	return s
+}
+
+// matches reports whether n matches the operation's selector, within its
+// scope
+func (op *streamOp) matches(n *html.Node) bool {
+	for _, match := range op.matchers {
+		if match(n) {
+			return inScope(n, op.scope)
+		}
+	}
+	return false
+}
+
+// active reports whether the operation still applies to new matches;
+// like ApplyTransformations, it stops at its first error
+func (op *streamOp) active() bool {
+	return op.err == nil && knownOperations[op.Type]
+}
+
+// admits reports whether the next match would be changed rather than
+// skipped or stopped by a limit
+func (op *streamOp) admits(opts ApplyOptions) bool {
+	return (op.Limit == 0 || op.applied < op.Limit) &&
+		(opts.MaxMatchedNodes == 0 || op.applied < opts.MaxMatchedNodes)
+}
+
+// take counts a match and reports whether the node should be changed
+func (op *streamOp) take(opts ApplyOptions) bool {
+	op.matched++
+	switch {
+	case op.Limit > 0 && op.applied >= op.Limit:
+		op.skipped++
+		return false
+	case opts.MaxMatchedNodes > 0 && op.applied >= opts.MaxMatchedNodes:
+		op.err = fmt.Errorf("%w: more than %d", ErrTooManyMatches, opts.MaxMatchedNodes)
+		return false
+	}
+	op.applied++
+	return true
+}
+
+// apply changes nodes, counting those a condition skipped
+func (op *streamOp) apply(nodes []*html.Node, opts ApplyOptions) {
+	if len(nodes) == 0 {
+		return
+	}
+	skipped, conflicts, err := applyToNodes(nodes, op.Operation, op.index, opts, op.writes)
+	for _, index := range conflicts {
+		op.conflicts = addIndex(op.conflicts, index)
+	}
+	op.skipped += skipped
+	if err != nil {
+		op.err = err
+	}
+}
+
+// fail records err unless the operation already failed
+func (op *streamOp) fail(err error) {
+	if op.err == nil {
+		op.err = err
+	}
+}
+
+// result reports the operation's outcome as ApplyTransformations would
+func (op *streamOp) result() OpResult {
+	res := OpResult{
+		Index:     op.index,
+		Type:      op.Type,
+		Selector:  op.Selector,
+		Matched:   op.matched,
+		Skipped:   op.skipped,
+		Err:       op.err,
+		Conflicts: op.conflicts,
+	}
+	switch {
+	case !knownOperations[op.Type]:
+		res.Err = fmt.Errorf("%w: %s", ErrUnknownOperation, op.Type)
+	case res.Err == nil && op.matched == 0:
+		res.Err = fmt.Errorf("%w: %s", ErrNoMatch, targetLabel(op.Operation))
+	}
+	return res
+}
+
+// needsBuffer reports whether an operation must see an element's whole
+// subtree, rather than its start tag or edges
+func needsBuffer(opType string, void bool) bool {
+	switch opType {
+	case OpInsertBefore, OpInsertAfter:
+		return false
+	case OpAppend, OpPrepend:
+		return void
+	}
+	return !editsAttributes(opType)
+}
+
+// streamFrame is an open element
+type streamFrame struct {
+	node      *html.Node // Linked to its parent, but never a child of it
+	synthetic bool       // Implied by the parser rather than written in the page
+
+	// states holds the element's attributes before each operation, and
+	// after the last, once any operation changed them; nil otherwise
+	states [][]html.Attribute
+
+	appends []int // Operations appending to the element, by position
+	afters  []int // Operations inserting after the element, by position
+}
+
+// streamCapture is an element being buffered for operations that need
+// its whole subtree
+type streamCapture struct {
+	root     *streamFrame
+	op       *streamOp // The first operation that needed it buffered
+	buf      bytes.Buffer
+	overflow bool // Went over maxBuffer; the rest passes through
+}
+
+// streamer carries the state of one StreamTransformations call
+type streamer struct {
+	w         io.Writer
+	ops       []*streamOp // Every spec's operations in application order
+	opts      ApplyOptions
+	maxBuffer int
+	buffers   bool // Some operation may need elements buffered
+
+	doc     *html.Node
+	stack   []*streamFrame
+	changed int // Frames in the stack whose attributes changed
+
+	fragment bool // The page is a fragment, parsed in a body context
+	headSeen bool
+	inBody   bool
+
+	capture *streamCapture
+	err     error // First write error
+}
+
+// token handles one token from the page
+func (s *streamer) token(z *html.Tokenizer, tt html.TokenType) {
+	switch tt {
+	case html.StartTagToken, html.SelfClosingTagToken:
+		// Reading the tag lowercases it in place, so copy it first
+		raw := append([]byte(nil), z.Raw()...)
+		if s.startTag(z.Token(), raw) {
+			z.NextIsNotRawText()
+		}
+	case html.EndTagToken:
+		raw := append([]byte(nil), z.Raw()...)
+		s.endTag(z.Token(), raw)
+	case html.TextToken:
+		if !s.inBody && len(bytes.Trim(z.Raw(), " \t\r\n\f")) > 0 {
+			s.impliedStart(0)
+		}
+		s.write(z.Raw())
+	default:
+		s.write(z.Raw())
+	}
+}
+
+// startTag opens the element of a start tag, reporting whether it is
+// foreign content, whose children aren't raw text
+func (s *streamer) startTag(tok html.Token, raw []byte) bool {
+	if s.impliedStart(tok.DataAtom) {
+		// The parser merges duplicate html and body tags into the first
+		s.write(raw)
+		return false
+	}
+
+	parent := s.top()
+	node := &html.Node{
+		Type:      html.ElementNode,
+		Data:      tok.Data,
+		DataAtom:  tok.DataAtom,
+		Attr:      tok.Attr,
+		Namespace: childNamespace(parent, tok.DataAtom),
+		Parent:    parent,
+	}
+	selfClosing := tok.Type == html.SelfClosingTagToken
+	void := voidElements[tok.DataAtom] || (selfClosing && node.Namespace != "")
+	s.open(&streamFrame{node: node}, raw, void, selfClosing)
+	return node.Namespace != ""
+}
+
+// endTag closes the element of an end tag and any left open inside it
+func (s *streamer) endTag(tok html.Token, raw []byte) {
+	i := s.openElement(tok.DataAtom, tok.Data)
+	if i < 0 {
+		// The parser ignores end tags without an open element
+		s.write(raw)
+		return
+	}
+	s.popTo(i + 1)
+	s.pop(raw)
+}
+
+// open handles an element's start tag
+func (s *streamer) open(f *streamFrame, raw []byte, void, selfClosing bool) {
+	if s.capture != nil {
+		s.write(raw)
+		if !void {
+			s.push(f)
+		}
+		return
+	}
+
+	if op := s.bufferingOp(f.node, void); op != nil {
+		if raw == nil {
+			raw = []byte(renderStartTag(f.node, false))
+		}
+		s.capture = &streamCapture{root: f, op: op}
+		s.write(raw)
+		if void {
+			s.finishCapture()
+		} else {
+			s.push(f)
+		}
+		return
+	}
+
+	before, prepends := s.matchStart(f)
+	s.insertFragments(before, f.node.Parent, false)
+	switch {
+	case f.states != nil:
+		s.write([]byte(renderStartTag(f.node, selfClosing)))
+	case !f.synthetic:
+		s.write(raw)
+	}
+	if void {
+		s.insertFragments(f.afters, f.node.Parent, true)
+		return
+	}
+	s.push(f)
+	s.insertFragments(prepends, f.node, true)
+}
+
+// pop closes the innermost open element, writing endTag (the raw end tag,
+// nil when implied) with any content appended or inserted after it
+func (s *streamer) pop(endTag []byte) {
+	f := s.stack[len(s.stack)-1]
+	if s.capture != nil && s.capture.root == f {
+		s.write(endTag)
+		s.drop()
+		s.finishCapture()
+		return
+	}
+
+	streaming := s.capture == nil
+	if streaming {
+		s.insertFragments(f.appends, f.node, false)
+	}
+	s.write(endTag)
+	if streaming {
+		s.insertFragments(f.afters, f.node.Parent, true)
+	}
+	s.drop()
+}
+
+// popTo closes every open element from index i up
+func (s *streamer) popTo(i int) {
+	for len(s.stack) > i && s.err == nil {
+		s.pop(nil)
+	}
+}
+
+// push adds an element to the open stack
+func (s *streamer) push(f *streamFrame) {
+	s.stack = append(s.stack, f)
+	if f.states != nil {
+		s.changed++
+	}
+}
+
+// drop removes the innermost element from the open stack
+func (s *streamer) drop() {
+	f := s.stack[len(s.stack)-1]
+	s.stack = s.stack[:len(s.stack)-1]
+	if f.states != nil {
+		s.changed--
+	}
+}
+
+// top returns the innermost open element, or the document node
+func (s *streamer) top() *html.Node {
+	if len(s.stack) == 0 {
+		return s.doc
+	}
+	return s.stack[len(s.stack)-1].node
+}
+
+// write sends page bytes to the output, or to the buffered element
+func (s *streamer) write(p []byte) {
+	if s.err != nil || len(p) == 0 {
+		return
+	}
+	c := s.capture
+	if c == nil || c.overflow {
+		_, s.err = s.w.Write(p)
+		return
+	}
+
+	c.buf.Write(p)
+	if s.maxBuffer > 0 && c.buf.Len() > s.maxBuffer {
+		c.overflow = true
+		c.op.fail(fmt.Errorf("%w: <%s>", ErrStreamBuffer, c.root.node.Data))
+		_, s.err = s.w.Write(c.buf.Bytes())
+		c.buf = bytes.Buffer{}
+	}
+}
+
+// rewind sets each open element's attributes to what the operation at
+// position k saw
+func (s *streamer) rewind(k int) {
+	if s.changed == 0 {
+		return
+	}
+	for _, f := range s.stack {
+		if f.states != nil {
+			f.node.Attr = f.states[k]
+		}
+	}
+}
+
+// restore puts back the open elements' final attributes
+func (s *streamer) restore() {
+	s.rewind(len(s.ops))
+}
+
+// bufferingOp returns the first operation that needs the element
+// buffered, or nil if it can stream
+// Attribute operations are tried on a copy, since they change what the
+// selectors of later operations match.
+func (s *streamer) bufferingOp(node *html.Node, void bool) *streamOp {
+	if !s.buffers {
+		return nil
+	}
+	defer s.restore()
+
+	probe := node
+	for k, op := range s.ops {
+		if !op.active() || !op.admits(s.opts) {
+			continue
+		}
+		s.rewind(k)
+		if !op.matches(probe) {
+			continue
+		}
+		switch {
+		case needsBuffer(op.Type, void):
+			return op
+		case editsAttributes(op.Type):
+			if probe == node {
+				clone := *node
+				clone.Attr = cloneAttrs(node.Attr)
+				probe = &clone
+			}
+			applyToNodes([]*html.Node{probe}, op.Operation, op.index, s.opts, nil)
+		}
+	}
+	return nil
+}
+
+// matchStart applies attribute operations to a streaming element and
+// collects its edge insertions, as positions in application order
+func (s *streamer) matchStart(f *streamFrame) (before, prepends []int) {
+	defer s.restore()
+
+	node := f.node
+	for k, op := range s.ops {
+		if f.states != nil {
+			f.states[k] = cloneAttrs(node.Attr)
+		}
+		if !op.active() {
+			continue
+		}
+		s.rewind(k)
+		if !op.matches(node) || !op.take(s.opts) {
+			continue
+		}
+
+		switch op.Type {
+		case OpInsertBefore:
+			before = append(before, k)
+		case OpPrepend:
+			prepends = append(prepends, k)
+		case OpAppend:
+			f.appends = append(f.appends, k)
+		case OpInsertAfter:
+			f.afters = append(f.afters, k)
+		default:
+			if f.states == nil {
+				f.states = make([][]html.Attribute, len(s.ops)+1)
+				original := cloneAttrs(node.Attr)
+				for i := 0; i <= k; i++ {
+					f.states[i] = original
+				}
+			}
+			op.apply([]*html.Node{node}, s.opts)
+		}
+	}
+	if f.states != nil {
+		f.states[len(s.ops)] = node.Attr
+	}
+	return before, prepends
+}
+
+// insertFragments writes the fragments of edge operations at positions
+// into parent, in the order repeated insertions at one spot produce: later
+// prepends and insertAfters land first
+func (s *streamer) insertFragments(positions []int, parent *html.Node, reverse bool) {
+	for i := range positions {
+		if reverse {
+			i = len(positions) - 1 - i
+		}
+		k := positions[i]
+		op := s.ops[k]
+
+		nodes, err := parseFragment(op.Value, s.opts)
+		if err != nil {
+			op.fail(fmt.Errorf("parse fragment: %w", err))
+			continue
+		}
+		for _, node := range nodes {
+			parent.AppendChild(node)
+		}
+		s.applyWithin(parent, k+1)
+		if err := s.writeChildren(parent); err != nil {
+			op.fail(fmt.Errorf("render fragment: %w", err))
+		}
+	}
+}
+
+// finishCapture applies every operation to the buffered element, parsed
+// in its parent's context, and writes the result
+// The page's bytes are written instead if the element can't be parsed or
+// rendered.
+func (s *streamer) finishCapture() {
+	c := s.capture
+	s.capture = nil
+	if c.overflow {
+		return
+	}
+
+	region := c.buf.Bytes()
+	parent := c.root.node.Parent
+	nodes, err := s.parseCaptured(region, c.root.node)
+	if err == nil {
+		for _, node := range nodes {
+			parent.AppendChild(node)
+		}
+		s.applyWithin(parent, 0)
+		err = s.writeChildren(parent)
+	}
+	if err != nil {
+		c.op.fail(fmt.Errorf("buffer <%s>: %w", c.root.node.Data, err))
+		s.write(region)
+	}
+}
+
+// parseCaptured parses a buffered element the way the parser would have
+// in its position
+func (s *streamer) parseCaptured(region []byte, root *html.Node) ([]*html.Node, error) {
+	parent := root.Parent
+	if parent.Type == html.DocumentNode {
+		if s.fragment {
+			return html.ParseFragment(bytes.NewReader(region), &html.Node{
+				Type:     html.ElementNode,
+				Data:     "body",
+				DataAtom: atom.Body,
+			})
+		}
+
+		// The root element holds the rest of the document
+		doc, err := html.Parse(bytes.NewReader(region))
+		if err != nil {
+			return nil, err
+		}
+		var nodes []*html.Node
+		for child := doc.FirstChild; child != nil; child = doc.FirstChild {
+			doc.RemoveChild(child)
+			nodes = append(nodes, child)
+		}
+		return nodes, nil
+	}
+
+	nodes, err := html.ParseFragment(bytes.NewReader(region), parent)
+	if err != nil {
+		return nil, err
+	}
+	if root.DataAtom != atom.Head && root.DataAtom != atom.Body {
+		return nodes, nil
+	}
+
+	// In an html context the parser adds whichever of head and body the
+	// region lacks
+	kept := nodes[:0]
+	for _, node := range nodes {
+		if node.DataAtom == root.DataAtom {
+			kept = append(kept, node)
+		}
+	}
+	return kept, nil
+}
+
+// applyWithin applies the operations from position from onwards to the
+// subtrees under parent, as ApplyTransformations would, with the open
+// elements rewound to what each operation saw
+func (s *streamer) applyWithin(parent *html.Node, from int) {
+	defer s.restore()
+
+	for k := from; k < len(s.ops); k++ {
+		op := s.ops[k]
+		if !op.active() {
+			continue
+		}
+		s.rewind(k)
+
+		var nodes []*html.Node
+		for child := parent.FirstChild; child != nil; child = child.NextSibling {
+			for _, node := range findNodesBySelector(child, op.Selector) {
+				if inScope(node, op.scope) && op.take(s.opts) {
+					nodes = append(nodes, node)
+				}
+			}
+		}
+		op.apply(nodes, s.opts)
+	}
+}
+
+// writeChildren renders and detaches parent's children
+// Nothing is written if rendering fails.
+func (s *streamer) writeChildren(parent *html.Node) error {
+	var buf bytes.Buffer
+	var err error
+	for child := parent.FirstChild; child != nil; child = parent.FirstChild {
+		if err == nil {
+			err = html.Render(&buf, child)
+		}
+		parent.RemoveChild(child)
+	}
+	if err != nil {
+		return err
+	}
+	s.write(buf.Bytes())
+	return nil
+}
+
+// openElement returns the stack index of the open element an end tag
+// closes, or -1 when the parser would ignore it
+func (s *streamer) openElement(a atom.Atom, name string) int {
+	scope := elementScope
+	switch a {
+	case atom.Table:
+		scope = documentScope
+	case atom.Tbody, atom.Thead, atom.Tfoot, atom.Tr, atom.Td, atom.Th, atom.Caption:
+		scope = tableScope
+	}
+	for i := len(s.stack) - 1; i >= 0; i-- {
+		node := s.stack[i].node
+		if node.Data == name {
+			return i
+		}
+		if scope[node.DataAtom] {
+			return -1
+		}
+	}
+	return -1
+}
+
+// impliedStart opens and closes the elements the parser implies before a
+// start tag (or, for 0, text), and reports whether the tag is ignored
+func (s *streamer) impliedStart(a atom.Atom) bool {
+	if s.fragment {
+		// A body context ignores document structure tags
+		if a == atom.Html || a == atom.Head || a == atom.Body {
+			return true
+		}
+		s.closeImplied(a)
+		return false
+	}
+
+	if len(s.stack) == 0 {
+		if a == atom.Html {
+			return false
+		}
+		s.openImplied(atom.Html)
+	}
+	switch {
+	case a == atom.Html:
+		return true
+	case !s.inBody:
+		return s.beforeBody(a)
+	case a == atom.Head || a == atom.Body:
+		return true
+	}
+	s.closeImplied(a)
+	return false
+}
+
+// beforeBody handles a start tag (or, for 0, text) before the body opens
+func (s *streamer) beforeBody(a atom.Atom) bool {
+	top := s.top().DataAtom
+	if top != atom.Html && top != atom.Head {
+		// Inside head content, such as a template
+		return false
+	}
+
+	if !s.headSeen {
+		s.headSeen = true
+		if a == atom.Head {
+			return false
+		}
+		s.openImplied(atom.Head)
+		top = atom.Head
+	}
+	if top == atom.Head {
+		if headElements[a] {
+			return false
+		}
+		if a == atom.Head {
+			return true
+		}
+		s.pop(nil)
+	}
+
+	switch {
+	case a == atom.Head:
+		return true
+	case a == atom.Body:
+		s.inBody = true
+		return false
+	case headElements[a]:
+		// The parser moves these back into head; here they stay under html
+		return false
+	}
+	s.openImplied(atom.Body)
+	s.inBody = true
+	return false
+}
+
+// closeImplied closes the elements a start tag ends by omission, for the
+// optional end tags pages commonly leave out
+func (s *streamer) closeImplied(a atom.Atom) {
+	if closesParagraph[a] {
+		s.closeOpen(buttonScope, atom.P)
+	}
+
+	switch a {
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		if headings[s.top().DataAtom] {
+			s.pop(nil)
+		}
+	case atom.Li:
+		s.closeOpen(itemScope, atom.Li)
+	case atom.Dd, atom.Dt:
+		s.closeOpen(itemScope, atom.Dd, atom.Dt)
+	case atom.Option:
+		s.closeTop(atom.Option)
+	case atom.Optgroup:
+		s.closeTop(atom.Option)
+		s.closeTop(atom.Optgroup)
+	case atom.Tbody, atom.Thead, atom.Tfoot:
+		s.closeOpen(tableScope, atom.Tbody, atom.Thead, atom.Tfoot)
+	case atom.Tr:
+		s.closeOpen(tableScope, atom.Tr)
+		if s.top().DataAtom == atom.Table {
+			s.openImplied(atom.Tbody)
+		}
+	case atom.Td, atom.Th:
+		s.closeOpen(rowScope, atom.Td, atom.Th)
+		if s.top().DataAtom == atom.Table {
+			s.openImplied(atom.Tbody)
+		}
+		switch s.top().DataAtom {
+		case atom.Tbody, atom.Thead, atom.Tfoot:
+			s.openImplied(atom.Tr)
+		}
+	}
+}
+
+// closeOpen closes the innermost open element that is one of targets,
+// unless an element in scope comes first
+func (s *streamer) closeOpen(scope map[atom.Atom]bool, targets ...atom.Atom) {
+	for i := len(s.stack) - 1; i >= 0; i-- {
+		a := s.stack[i].node.DataAtom
+		for _, target := range targets {
+			if a == target {
+				s.popTo(i)
+				return
+			}
+		}
+		if scope[a] {
+			return
+		}
+	}
+}
+
+// closeTop closes the innermost open element if it is a
+func (s *streamer) closeTop(a atom.Atom) {
+	if len(s.stack) > 0 && s.top().DataAtom == a {
+		s.pop(nil)
+	}
+}
+
+// openImplied opens an element the parser implies
+func (s *streamer) openImplied(a atom.Atom) {
+	node := &html.Node{Type: html.ElementNode, Data: a.String(), DataAtom: a, Parent: s.top()}
+	s.open(&streamFrame{node: node, synthetic: true}, nil, false, false)
+}
+
+// renderStartTag renders an element's start tag from its current attributes
+func renderStartTag(node *html.Node, selfClosing bool) string {
+	tok := html.Token{Type: html.StartTagToken, Data: node.Data, Attr: node.Attr}
+	if selfClosing {
+		tok.Type = html.SelfClosingTagToken
+	}
+	return tok.String()
+}
+
+// childNamespace returns the namespace of a new element under parent
+func childNamespace(parent *html.Node, a atom.Atom) string {
+	switch a {
+	case atom.Svg:
+		return "svg"
+	case atom.Math:
+		return "math"
+	}
+	if htmlIntegrationPoints[parent.Data] {
+		return ""
+	}
+	return parent.Namespace
+}
+
+// cloneAttrs copies an attribute list
+func cloneAttrs(attrs []html.Attribute) []html.Attribute {
+	return append([]html.Attribute(nil), attrs...)
+}
+
+// voidElements have no content or end tag
+var voidElements = atomSet(atom.Area, atom.Base, atom.Basefont, atom.Bgsound, atom.Br, atom.Col,
+	atom.Embed, atom.Frame, atom.Hr, atom.Img, atom.Input, atom.Keygen, atom.Link, atom.Meta,
+	atom.Param, atom.Source, atom.Track, atom.Wbr)
+
+// headElements stay in head rather than implying the body
+var headElements = atomSet(atom.Base, atom.Basefont, atom.Bgsound, atom.Link, atom.Meta,
+	atom.Noframes, atom.Noscript, atom.Script, atom.Style, atom.Template, atom.Title)
+
+// closesParagraph lists start tags that end an open <p>
+var closesParagraph = atomSet(atom.Address, atom.Article, atom.Aside, atom.Blockquote, atom.Center,
+	atom.Details, atom.Dialog, atom.Dir, atom.Div, atom.Dl, atom.Dd, atom.Dt, atom.Fieldset,
+	atom.Figcaption, atom.Figure, atom.Footer, atom.Form, atom.H1, atom.H2, atom.H3, atom.H4,
+	atom.H5, atom.H6, atom.Header, atom.Hgroup, atom.Hr, atom.Li, atom.Listing, atom.Main,
+	atom.Menu, atom.Nav, atom.Ol, atom.P, atom.Plaintext, atom.Pre, atom.Section,
+	atom.Summary, atom.Table, atom.Ul, atom.Xmp)
+
+// headings are h1 to h6, which don't nest
+var headings = atomSet(atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6)
+
+// Scopes bound the search for an open element to close: an element in
+// scope hides any target outside it
+var (
+	elementScope  = atomSet(atom.Applet, atom.Caption, atom.Html, atom.Table, atom.Td, atom.Th, atom.Marquee, atom.Object, atom.Template)
+	buttonScope   = atomSet(atom.Applet, atom.Button, atom.Caption, atom.Html, atom.Table, atom.Td, atom.Th, atom.Marquee, atom.Object, atom.Template)
+	documentScope = atomSet(atom.Html, atom.Template)
+	tableScope    = atomSet(atom.Html, atom.Table, atom.Template)
+	rowScope      = atomSet(atom.Html, atom.Table, atom.Tbody, atom.Template, atom.Tfoot, atom.Thead, atom.Tr)
+	itemScope     = atomSet(atom.Applet, atom.Article, atom.Aside, atom.Blockquote, atom.Body,
+		atom.Caption, atom.Details, atom.Dialog, atom.Dl, atom.Fieldset, atom.Figure, atom.Footer,
+		atom.Form, atom.Header, atom.Html, atom.Main, atom.Marquee, atom.Menu, atom.Nav,
+		atom.Object, atom.Ol, atom.Section, atom.Table, atom.Td, atom.Template, atom.Th, atom.Ul)
+)
+
+// htmlIntegrationPoints are foreign elements whose children are HTML,
+// by the lowercase names the tokenizer gives them
+var htmlIntegrationPoints = map[string]bool{
+	"foreignobject":  true,
+	"desc":           true,
+	"title":          true,
+	"annotation-xml": true,
+	"mi":             true,
+	"mo":             true,
+	"mn":             true,
+	"ms":             true,
+	"mtext":          true,
+}
+
+// atomSet builds a set of element atoms
+func atomSet(atoms ...atom.Atom) map[atom.Atom]bool {
+	set := make(map[atom.Atom]bool, len(atoms))
+	for _, a := range atoms {
+		set[a] = true
+	}
+	return set
+}
@@ -0,0 +1,437 @@
+package transform
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// streamBoth applies specs to page through the buffered and streaming
+// paths and returns each path's output, parsed and rendered again as a
+// browser would see it, with its results
+func streamBoth(t *testing.T, page string, specs [][]Operation, opts ApplyOptions, maxBuffer int) (buffered, streamed string, bufferedResults, streamedResults [][]OpResult) {
+	t.Helper()
+	doc, err := ParseDocument([]byte(page))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	for _, spec := range specs {
+		results, err := ApplyTransformations(doc, spec, opts)
+		if err != nil {
+			t.Fatalf("apply: %v", err)
+		}
+		bufferedResults = append(bufferedResults, results)
+	}
+	rendered, err := RenderHTML(doc)
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+
+	var out bytes.Buffer
+	// One byte at a time, so tokens straddle reads
+	streamedResults, err = StreamTransformations(&out, iotest.OneByteReader(strings.NewReader(page)), specs, opts, maxBuffer)
+	if err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	return normalize(t, rendered), normalize(t, out.String()), bufferedResults, streamedResults
+}
+
+// normalize parses and renders a page
+func normalize(t *testing.T, page string) string {
+	t.Helper()
+	doc, err := ParseDocument([]byte(page))
+	if err != nil {
+		t.Fatalf("parse output: %v", err)
+	}
+	rendered, err := RenderHTML(doc)
+	if err != nil {
+		t.Fatalf("render output: %v", err)
+	}
+	return rendered
+}
+
+// resultSummary describes the parts of a result both paths must agree on
+func resultSummary(res OpResult) string {
+	return fmt.Sprintf("#%d %s matched=%d skipped=%d conflicts=%v err=%v", res.Index, res.Type, res.Matched, res.Skipped, res.Conflicts, res.Err)
+}
+
+func compareResults(t *testing.T, buffered, streamed [][]OpResult) {
+	t.Helper()
+	if len(buffered) != len(streamed) {
+		t.Fatalf("got results for %d specs streamed, %d buffered", len(streamed), len(buffered))
+	}
+	for i := range buffered {
+		if len(buffered[i]) != len(streamed[i]) {
+			t.Fatalf("spec %d: got %d results streamed, %d buffered", i, len(streamed[i]), len(buffered[i]))
+		}
+		for j := range buffered[i] {
+			if b, s := resultSummary(buffered[i][j]), resultSummary(streamed[i][j]); b != s {
+				t.Errorf("spec %d result %d:\n streamed %s\n buffered %s", i, j, s, b)
+			}
+		}
+	}
+}
+
+const streamPage = `<!DOCTYPE html>
+<html lang="en">
+<head><title>Shop</title><meta name="description" content="Things"></head>
+<body class="home">
+<header id="top"><nav><a href="/" class="logo">Home</a> <a href="/cart">Cart</a></nav></header>
+<main>
+<h1 class="hero">Welcome</h1>
+<p class="lead">First <b>bold</b> paragraph.</p>
+<p>Second paragraph.</p>
+<ul id="list"><li>One</li><li class="x">Two</li><li>Three</li></ul>
+<img src="/a.png" alt="A">
+<button id="buy"><svg viewBox="0 0 1 1"><path d="M0 0"/></svg>Buy now</button>
+<script type="application/json" id="cfg">{"price":10,"tag":"a"}</script>
+</main>
+<footer><p>Footer</p></footer>
+</body>
+</html>
+`
+
+func TestStreamMatchesBuffered(t *testing.T) {
+	tests := []struct {
+		name string
+		page string
+		ops  []Operation
+	}{
+		{"set text", streamPage, []Operation{{Type: OpSetText, Selector: "h1", Value: "Hi"}}},
+		{"set text content", streamPage, []Operation{{Type: OpSetTextContent, Selector: "#buy", Value: "Order"}}},
+		{"set html", streamPage, []Operation{{Type: OpSetHTML, Selector: ".lead", Value: "<em>New</em> text"}}},
+		{"remove", streamPage, []Operation{{Type: OpRemove, Selector: "li.x"}}},
+		{"replace with", streamPage, []Operation{{Type: OpReplaceWith, Selector: "h1", Value: "<h2>Swapped</h2>"}}},
+		{"wrap", streamPage, []Operation{{Type: OpWrap, Selector: "img", Value: `<figure class="f"></figure>`}}},
+		{"unwrap", streamPage, []Operation{{Type: OpUnwrap, Selector: "nav"}}},
+		{"attributes", streamPage, []Operation{
+			{Type: OpSetAttr, Selector: "a", Property: "rel", Value: "nofollow"},
+			{Type: OpSetAttrIfAbsent, Selector: "img", Property: "alt", Value: "ignored"},
+			{Type: OpSetData, Selector: "h1", Property: "variant", Value: "b"},
+			{Type: OpSetStyle, Selector: "p", Property: "color", Value: "red"},
+		}},
+		{"classes", streamPage, []Operation{
+			{Type: OpAddClass, Selector: "body", Value: "exp-b"},
+			{Type: OpRemoveClass, Selector: "h1", Value: "hero"},
+			{Type: OpToggleClass, Selector: "li", Value: "x"},
+		}},
+		{"hide and show", streamPage, []Operation{
+			{Type: OpHide, Selector: "footer"},
+			{Type: OpShow, Selector: "footer"},
+			{Type: OpHide, Selector: "#top"},
+		}},
+		{"edges", streamPage, []Operation{
+			{Type: OpAppend, Selector: "#list", Value: "<li>Four</li>"},
+			{Type: OpPrepend, Selector: "#list", Value: "<li>Zero</li>"},
+			{Type: OpInsertBefore, Selector: "h1", Value: "<div>Before</div>"},
+			{Type: OpInsertAfter, Selector: "h1", Value: "<div>After</div>"},
+		}},
+		{"repeated edges", streamPage, []Operation{
+			{Type: OpPrepend, Selector: "#list", Value: "<li>A</li>"},
+			{Type: OpPrepend, Selector: "#list", Value: "<li>B</li>"},
+			{Type: OpInsertAfter, Selector: "h1", Value: "<p>1</p>"},
+			{Type: OpInsertAfter, Selector: "h1", Value: "<p>2</p>"},
+		}},
+		{"head", streamPage, []Operation{
+			{Type: OpAppend, Selector: "head", Value: `<link rel="stylesheet" href="/b.css">`},
+			{Type: OpSetAttr, Selector: `meta[name="description"]`, Property: "content", Value: "Other"},
+			{Type: OpSetText, Selector: "title", Value: "Shop B"},
+		}},
+		{"json field", streamPage, []Operation{{Type: OpSetJSONField, Selector: "#cfg", Property: "price", Value: "12"}}},
+		{"text if", streamPage, []Operation{
+			{Type: OpSetTextIf, Selector: "li", Property: "equals:Two", Value: "2"},
+			{Type: OpSetTextIf, Selector: "p", Property: "contains:nothing", Value: "no"},
+		}},
+		{"remove if empty", `<div><p></p><p>kept</p><span> </span></div>`, []Operation{
+			{Type: OpSetText, Selector: "p", Value: "", Limit: 1},
+			{Type: OpRemoveIfEmpty, Selector: "p, span"},
+		}},
+		{"limit", streamPage, []Operation{{Type: OpSetText, Selector: "li", Value: "L", Limit: 2}}},
+		{"priority", streamPage, []Operation{
+			{Type: OpSetText, Selector: "h1", Value: "Second", Priority: 2},
+			{Type: OpSetText, Selector: "h1", Value: "First", Priority: 1},
+		}},
+		{"no match", streamPage, []Operation{{Type: OpSetText, Selector: ".missing", Value: "x"}}},
+		{"unknown type", streamPage, []Operation{{Type: "teleport", Selector: "h1"}}},
+		{"descendant and child", streamPage, []Operation{
+			{Type: OpSetText, Selector: "main > p b", Value: "strong"},
+			{Type: OpAddClass, Selector: "header a", Value: "nav-link"},
+		}},
+		{"root", streamPage, []Operation{{Type: OpSetAttr, Selector: ":root", Property: "data-exp", Value: "b"}}},
+		{"scope", streamPage, []Operation{{Type: OpSetText, Selector: "p", Scope: "footer", Value: "Scoped"}}},
+		{"selector sees earlier attribute change", streamPage, []Operation{
+			{Type: OpAddClass, Selector: "h1", Value: "changed"},
+			{Type: OpSetText, Selector: "h1.changed", Value: "Seen"},
+		}},
+		{"selector sees earlier class removal", streamPage, []Operation{
+			{Type: OpSetText, Selector: "li.x", Value: "before", Priority: 0},
+			{Type: OpRemoveClass, Selector: "li", Value: "x", Priority: 1},
+			{Type: OpSetText, Selector: "li.x", Value: "after", Priority: 2},
+		}},
+		{"ancestor attributes rewound", streamPage, []Operation{
+			{Type: OpSetText, Selector: "body.home h1", Value: "Before"},
+			{Type: OpRemoveClass, Selector: "body", Value: "home"},
+			{Type: OpSetText, Selector: "body.home p", Value: "Never"},
+		}},
+		{"buffered element inside changed ancestor", streamPage, []Operation{
+			{Type: OpAddClass, Selector: "main", Value: "b"},
+			{Type: OpSetHTML, Selector: "main.b ul", Value: "<li>Only</li>"},
+		}},
+		{"edge content matched by later operation", streamPage, []Operation{
+			{Type: OpAppend, Selector: "#list", Value: `<li class="new">Four</li>`},
+			{Type: OpAddClass, Selector: "li.new", Value: "seen"},
+		}},
+		{"nested buffered operations", streamPage, []Operation{
+			{Type: OpSetText, Selector: "li", Value: "item"},
+			{Type: OpWrap, Selector: "ul", Value: "<section></section>"},
+			{Type: OpRemove, Selector: "li.x"},
+		}},
+		{"implied html head and body", `<!DOCTYPE html><title>T</title><p>Text`, []Operation{
+			{Type: OpAddClass, Selector: "body", Value: "b"},
+			{Type: OpAppend, Selector: "head", Value: "<meta name=x>"},
+			{Type: OpSetAttr, Selector: "html", Property: "lang", Value: "fr"},
+			{Type: OpAppend, Selector: "p", Value: "!"},
+		}},
+		{"text implies body", `<!DOCTYPE html>plain <b>text</b>`, []Operation{
+			{Type: OpSetAttr, Selector: "body", Property: "id", Value: "b"},
+			{Type: OpSetText, Selector: "b", Value: "bold"},
+		}},
+		{"implied tbody", `<table><tr><td>1</td><td>2</td></tr></table>`, []Operation{
+			{Type: OpAddClass, Selector: "tbody", Value: "rows"},
+			{Type: OpSetText, Selector: "tbody td", Value: "cell"},
+			{Type: OpAppend, Selector: "tr", Value: "<td>3</td>"},
+		}},
+		{"optional end tags", `<ul><li>One<li>Two</ul><p>A<p>B<div>C</div>`, []Operation{
+			{Type: OpAppend, Selector: "li", Value: "!"},
+			{Type: OpSetText, Selector: "p", Value: "P"},
+			{Type: OpInsertAfter, Selector: "li", Value: "<li>new</li>"},
+		}},
+		{"duplicate body tag", `<!DOCTYPE html><body class="a"><p>x</p><body class="b"></body>`, []Operation{
+			{Type: OpAddClass, Selector: "body", Value: "c"},
+		}},
+		{"stray end tag", `<div>one</span>two</div>`, []Operation{{Type: OpSetText, Selector: "div", Value: "x"}}},
+		{"fragment", `<div class="card"><h2>Title</h2><p>Body</p></div>`, []Operation{
+			{Type: OpSetText, Selector: "h2", Value: "New"},
+			{Type: OpAddClass, Selector: ".card", Value: "b"},
+			{Type: OpInsertBefore, Selector: ".card", Value: "<hr>"},
+		}},
+		{"fragment after comment", `<!-- partial --><p>x</p>`, []Operation{{Type: OpAppend, Selector: "p", Value: "y"}}},
+		{"svg", `<div><svg><circle r="1"/><g><rect/></g></svg></div>`, []Operation{
+			{Type: OpSetAttr, Selector: "circle", Property: "r", Value: "2"},
+			{Type: OpRemove, Selector: "g"},
+		}},
+		{"raw text", `<div><script>if (a < b) { x = "</div>"; }</script><style>p > b {}</style><textarea><b>t</b></textarea></div>`, []Operation{
+			{Type: OpSetAttr, Selector: "script", Property: "nonce", Value: "n"},
+			{Type: OpAppend, Selector: "div", Value: "<p>end</p>"},
+			{Type: OpSetText, Selector: "textarea", Value: "new"},
+		}},
+		{"entities and attributes", `<p title="a &amp; b" data-x='q"'>Tom &amp; Jerry &lt;3</p>`, []Operation{
+			{Type: OpSetAttr, Selector: "p", Property: "lang", Value: "en"},
+		}},
+		{"encoded text", streamPage, []Operation{{Type: OpSetText, Selector: "h1", Value: "Fish &amp; chips", Encoded: true}}},
+		{"conflicts", streamPage, []Operation{
+			{Type: OpSetText, Selector: "h1", Value: "A"},
+			{Type: OpSetText, Selector: "h1", Value: "B"},
+			{Type: OpSetStyle, Selector: "p", Property: "color", Value: "red"},
+			{Type: OpSetStyle, Selector: "p", Property: "color", Value: "blue"},
+		}},
+		{"unsafe html sanitized", streamPage, []Operation{{Type: OpAppend, Selector: "main", Value: `<img src=x onerror="alert(1)"><script>bad()</script>`}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !CanStream(tt.ops) {
+				t.Fatal("operations can't stream")
+			}
+			buffered, streamed, bufferedResults, streamedResults := streamBoth(t, tt.page, [][]Operation{tt.ops}, ApplyOptions{}, 0)
+			if streamed != buffered {
+				t.Errorf("output differs\n streamed %s\n buffered %s", streamed, buffered)
+			}
+			compareResults(t, bufferedResults, streamedResults)
+		})
+	}
+}
+
+func TestStreamSeveralSpecs(t *testing.T) {
+	specs := [][]Operation{
+		{{Type: OpSetText, Selector: "h1", Value: "A"}, {Type: OpAddClass, Selector: "body", Value: "exp-a"}},
+		{{Type: OpSetText, Selector: "h1", Value: "B"}, {Type: OpAppend, Selector: "#list", Value: "<li>B</li>"}},
+		{MarkApplied([]string{"a", "b"})},
+	}
+	buffered, streamed, bufferedResults, streamedResults := streamBoth(t, streamPage, specs, ApplyOptions{}, 0)
+	if streamed != buffered {
+		t.Errorf("output differs\n streamed %s\n buffered %s", streamed, buffered)
+	}
+	compareResults(t, bufferedResults, streamedResults)
+
+	// Specs aren't compared with each other
+	for _, results := range streamedResults {
+		for _, res := range results {
+			if len(res.Conflicts) > 0 {
+				t.Errorf("operation %d reports conflicts %v across specs", res.Index, res.Conflicts)
+			}
+		}
+	}
+}
+
+func TestStreamCopiesUntouchedMarkup(t *testing.T) {
+	page := "<!doctype html>\n<HTML><Head><TITLE>x</TITLE></Head><body><P CLASS=a>one<br/>two<!-- note --></P>\n<div id=d>keep &amp; this</div></body></HTML>"
+	var out bytes.Buffer
+	ops := []Operation{{Type: OpSetText, Selector: "#d", Value: "changed"}}
+	if _, err := StreamTransformations(&out, strings.NewReader(page), [][]Operation{ops}, ApplyOptions{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(page, "<div id=d>keep &amp; this</div>", `<div id="d">changed</div>`, 1)
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestStreamBufferOverflow(t *testing.T) {
+	page := `<div id="small"><p>short</p></div><div id="big"><p>` + strings.Repeat("long ", 100) + `</p></div><p id="after">after</p>`
+	ops := []Operation{
+		{Type: OpSetText, Selector: "div", Value: "replaced"},
+		{Type: OpSetText, Selector: "#after", Value: "still applied"},
+	}
+	var out bytes.Buffer
+	results, err := StreamTransformations(&out, strings.NewReader(page), [][]Operation{ops}, ApplyOptions{}, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := out.String()
+	if !strings.Contains(got, `<div id="small">replaced</div>`) {
+		t.Errorf("small element not replaced: %s", got)
+	}
+	if !strings.Contains(got, `<div id="big"><p>`+strings.Repeat("long ", 100)+`</p></div>`) {
+		t.Errorf("overflowing element not passed through untouched: %s", got)
+	}
+	if !strings.Contains(got, `<p id="after">still applied</p>`) {
+		t.Errorf("later operation not applied: %s", got)
+	}
+	if err := results[0][0].Err; !errors.Is(err, ErrStreamBuffer) {
+		t.Errorf("overflowing operation error = %v, want ErrStreamBuffer", err)
+	}
+	if err := results[0][1].Err; err != nil {
+		t.Errorf("later operation error = %v", err)
+	}
+}
+
+func TestStreamDivergences(t *testing.T) {
+	t.Run("max matched nodes", func(t *testing.T) {
+		// The buffered path rejects the operation outright; streaming has
+		// already changed the nodes before the limit
+		ops := []Operation{{Type: OpAddClass, Selector: "li", Value: "n"}}
+		opts := ApplyOptions{MaxMatchedNodes: 2}
+		_, streamed, bufferedResults, streamedResults := streamBoth(t, streamPage, [][]Operation{ops}, opts, 0)
+		if !errors.Is(bufferedResults[0][0].Err, ErrTooManyMatches) || !errors.Is(streamedResults[0][0].Err, ErrTooManyMatches) {
+			t.Fatalf("errors = %v, %v; want ErrTooManyMatches", bufferedResults[0][0].Err, streamedResults[0][0].Err)
+		}
+		if got := strings.Count(streamed, `class="n"`) + strings.Count(streamed, ` n"`); got != 2 {
+			t.Errorf("streaming changed %d nodes, want 2", got)
+		}
+	})
+
+	t.Run("scope checked per element", func(t *testing.T) {
+		// A scope container added by an earlier operation is seen when
+		// streaming, but not by the buffered path, which resolved it once
+		page := `<div><p>one</p></div><div><p>two</p></div>`
+		ops := []Operation{
+			{Type: OpAddClass, Selector: "div", Value: "box"},
+			{Type: OpSetText, Selector: "p", Scope: ".box", Value: "x"},
+		}
+		_, streamed, _, streamedResults := streamBoth(t, page, [][]Operation{ops}, ApplyOptions{}, 0)
+		if strings.Count(streamed, "<p>x</p>") != 2 || streamedResults[0][1].Err != nil {
+			t.Errorf("streamed %s, results %v", streamed, streamedResults[0][1])
+		}
+	})
+
+	t.Run("misnested formatting", func(t *testing.T) {
+		// The parser splits <b> around the </i>; streaming matches the
+		// tags as written, so the output is still well formed
+		page := `<p><b>bold <i>both</b> italic</i></p>`
+		ops := []Operation{{Type: OpSetAttr, Selector: "b", Property: "class", Value: "m"}}
+		var out bytes.Buffer
+		results, err := StreamTransformations(&out, strings.NewReader(page), [][]Operation{ops}, ApplyOptions{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results[0][0].Matched != 1 || !strings.Contains(out.String(), `<b class="m">bold`) {
+			t.Errorf("got %s, %d matched", out.String(), results[0][0].Matched)
+		}
+	})
+
+	t.Run("foster parenting", func(t *testing.T) {
+		// Content directly in a table is moved before it by the parser,
+		// but streamed where it was written
+		page := `<table><span>stray</span><tr><td>1</td></tr></table>`
+		ops := []Operation{{Type: OpSetText, Selector: "table span", Value: "x"}}
+		var out bytes.Buffer
+		results, err := StreamTransformations(&out, strings.NewReader(page), [][]Operation{ops}, ApplyOptions{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, buffered, _ := Apply(page, ops)
+		if !errors.Is(buffered[0].Err, ErrNoMatch) {
+			t.Errorf("buffered error = %v, want ErrNoMatch", buffered[0].Err)
+		}
+		if results[0][0].Matched != 1 {
+			t.Errorf("streamed %d matches, want 1", results[0][0].Matched)
+		}
+	})
+}
+
+func TestStreamWriteError(t *testing.T) {
+	errClosed := errors.New("closed")
+	ops := []Operation{{Type: OpSetText, Selector: "h1", Value: "x"}}
+	_, err := StreamTransformations(failingWriter{errClosed}, strings.NewReader(streamPage), [][]Operation{ops}, ApplyOptions{}, 0)
+	if !errors.Is(err, errClosed) {
+		t.Errorf("got %v, want the write error", err)
+	}
+}
+
+func TestStreamReadError(t *testing.T) {
+	errReset := errors.New("connection reset")
+	page := io.MultiReader(strings.NewReader(streamPage[:200]), iotest.ErrReader(errReset))
+	ops := []Operation{{Type: OpSetText, Selector: "h1", Value: "x"}}
+	_, err := StreamTransformations(io.Discard, page, [][]Operation{ops}, ApplyOptions{}, 0)
+	if !errors.Is(err, errReset) {
+		t.Errorf("got %v, want the read error", err)
+	}
+}
+
+func TestStreamTooManyOperations(t *testing.T) {
+	ops := []Operation{{Type: OpSetText, Selector: "h1"}, {Type: OpSetText, Selector: "p"}}
+	_, err := StreamTransformations(io.Discard, strings.NewReader(streamPage), [][]Operation{ops}, ApplyOptions{MaxOperations: 1}, 0)
+	if !errors.Is(err, ErrTooManyOperations) {
+		t.Errorf("got %v, want ErrTooManyOperations", err)
+	}
+}
+
+func TestCanStream(t *testing.T) {
+	tests := []struct {
+		op   Operation
+		want bool
+	}{
+		{Operation{Type: OpSetText, Selector: "main > p.lead"}, true},
+		{Operation{Type: OpSetText, Selector: ":root body"}, true},
+		{Operation{Type: OpSetText, Selector: "h1 + p"}, false},
+		{Operation{Type: OpSetText, Selector: "h1 ~ p"}, false},
+		{Operation{Type: OpSetText, Selector: "li:first-child"}, false},
+		{Operation{Type: OpSetText, Selector: "p", Scope: "h1 + div"}, false},
+		{Operation{Type: OpSetText, Selector: `a[href="a+b"]`}, true},
+		{Operation{Type: OpMove, Selector: "h1", Value: "footer"}, false},
+	}
+	for _, tt := range tests {
+		if got := CanStream([]Operation{tt.op}); got != tt.want {
+			t.Errorf("CanStream(%q in %q) = %v, want %v", tt.op.Selector, tt.op.Scope, got, tt.want)
+		}
+	}
+}
+
+type failingWriter struct{ err error }
+
+func (w failingWriter) Write(p []byte) (int, error) { return 0, w.err }
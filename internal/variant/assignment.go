@@ -3,17 +3,23 @@ package variant
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"math"
 	"math/rand"
-	"strconv"
+	"time"
 
 	"github.com/experiflow/proxy/internal/transform"
 )
 
+// allocationEpsilon is the tolerance for traffic allocations summing to 1.0
+const allocationEpsilon = 0.001
+
 // Assigner handles variant assignment logic
 type Assigner struct {
-	salt string
+	salt            string
+	experimentSalts map[string]string // Extra salt per experiment ID
 }
 
 // NewAssigner creates a new variant assigner
@@ -24,8 +30,23 @@ func NewAssigner(salt string) *Assigner {
 	return &Assigner{salt: salt}
 }
 
+// WithExperimentSalts mixes an extra salt into the buckets of each listed
+// experiment, reshuffling it without touching the others
+// Experiments without one keep the buckets of the global salt alone.
+func (a *Assigner) WithExperimentSalts(salts map[string]string) *Assigner {
+	a.experimentSalts = salts
+	return a
+}
+
 // AssignVariant deterministically assigns a variant to a user
-// Uses HMAC-based bucketing for consistent assignment
+// Uses HMAC-based bucketing for consistent assignment. Anonymous users
+// (empty userID) have nothing stable to hash, so they get a random pick
+// weighted by traffic allocation instead.
+// Variants own consecutive bucket ranges in list order, so a user only
+// changes variant when a range boundary moves past their bucket. Appending
+// an arm moves just the users between the old and new boundaries; taking
+// its share from the last arm alone leaves every other arm untouched.
+// Reordering variants reshuffles everyone.
 func (a *Assigner) AssignVariant(userID, experimentID string, variants []transform.Variant) *transform.Variant {
 	if len(variants) == 0 {
 		return nil
@@ -36,23 +57,169 @@ func (a *Assigner) AssignVariant(userID, experimentID string, variants []transfo
 		return &variants[0]
 	}
 
-	// Create deterministic bucket
-	bucket := a.getBucket(userID, experimentID)
+	if userID == "" {
+		return a.SelectRandomVariant(variants)
+	}
+
+	// Create deterministic bucket in [0, 1)
+	bucket := a.Bucket(userID, experimentID)
 
 	// Assign based on traffic allocation
+	return selectVariant(variants, bucket)
+}
+
+// selectVariant returns the variant whose traffic range contains bucket
+// A ramping variant owns the top of the range and takes its share from
+// whichever static variants sit there, so as it grows it only claims more
+// users and every other boundary stays put. The others keep the ranges
+// their allocations give them.
+func selectVariant(variants []transform.Variant, bucket float64) *transform.Variant {
+	ramped := rampedVariant(variants)
+	if ramped < 0 {
+		return pickVariant(variants, bucket)
+	}
+
+	share := rampShare(variants[ramped].Ramp, time.Now())
+	if bucket >= 1-share {
+		return &variants[ramped]
+	}
+	return pickVariant(staticVariants(variants, ramped), bucket)
+}
+
+// staticVariants returns variants without the ramped one at index ramped
+func staticVariants(variants []transform.Variant, ramped int) []transform.Variant {
+	return append(append([]transform.Variant(nil), variants[:ramped]...), variants[ramped+1:]...)
+}
+
+// pickVariant returns the variant whose cumulative traffic allocation
+// range contains bucket
+func pickVariant(variants []transform.Variant, bucket float64) *transform.Variant {
+	allocations, _ := normalizeAllocations(variants)
 	cumulative := 0.0
 	for i := range variants {
-		cumulative += variants[i].TrafficAllocation
-		if float64(bucket) < cumulative*100 {
+		cumulative += allocations[i]
+		if bucket < cumulative {
 			return &variants[i]
 		}
 	}
 
-	// Fallback to first variant (should not reach here if allocations sum to 1.0)
+	// Allocations within allocationEpsilon of 1.0 aren't normalized, so the
+	// top of the range can fall past the last boundary; it belongs to the
+	// last variant with traffic
+	for i := len(variants) - 1; i > 0; i-- {
+		if allocations[i] > 0 {
+			return &variants[i]
+		}
+	}
 	return &variants[0]
 }
 
-// SelectRandomVariant randomly selects a variant (for new users)
+// NormalizesAllocations reports whether assignment has to scale an
+// experiment's static traffic allocations because they don't sum to 1.0
+// A ramped variant's share is set by its ramp, so only the others count,
+// and a lone variant takes all the traffic left whatever its allocation.
+// It's meant to be checked once per fetched variant list, like
+// ValidateVariants, rather than on every assignment.
+func NormalizesAllocations(variants []transform.Variant) bool {
+	if ramped := rampedVariant(variants); ramped >= 0 {
+		variants = staticVariants(variants, ramped)
+	}
+	if len(variants) < 2 {
+		return false
+	}
+	_, normalized := normalizeAllocations(variants)
+	return normalized
+}
+
+// ValidateVariants checks an experiment's variant list for configuration
+// mistakes that assignment would otherwise silently work around: missing
+// or duplicate IDs, more than one control, and negative allocations
+// It returns one error per problem found.
+func ValidateVariants(variants []transform.Variant) []error {
+	var problems []error
+	seen := make(map[string]bool, len(variants))
+	controls := 0
+	for i, v := range variants {
+		switch {
+		case v.ID == "":
+			problems = append(problems, fmt.Errorf("variant %d has no ID", i))
+		case seen[v.ID]:
+			problems = append(problems, fmt.Errorf("duplicate variant ID %q", v.ID))
+		}
+		seen[v.ID] = true
+
+		if v.IsControl {
+			controls++
+		}
+		if v.TrafficAllocation < 0 {
+			problems = append(problems, fmt.Errorf("variant %q has negative traffic allocation %g", v.ID, v.TrafficAllocation))
+		}
+	}
+	if controls > 1 {
+		problems = append(problems, fmt.Errorf("%d variants are marked as control", controls))
+	}
+	return problems
+}
+
+// rampedVariant returns the index of the first variant with a ramp, or -1
+func rampedVariant(variants []transform.Variant) int {
+	for i := range variants {
+		if variants[i].Ramp != nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// rampShare returns a ramp's share of traffic in [0, 1] at now,
+// interpolated linearly between its start and end
+func rampShare(ramp *transform.Ramp, now time.Time) float64 {
+	percent := ramp.TargetPercent
+	switch {
+	case now.Before(ramp.StartTime):
+		percent = ramp.StartPercent
+	case now.Before(ramp.EndTime):
+		progress := float64(now.Sub(ramp.StartTime)) / float64(ramp.EndTime.Sub(ramp.StartTime))
+		percent = ramp.StartPercent + (ramp.TargetPercent-ramp.StartPercent)*progress
+	}
+	return math.Min(math.Max(percent/100, 0), 1)
+}
+
+// InHoldback reports whether a user falls in the holdback that never sees
+// any experiment
+// Pair it with an Assigner built from a dedicated holdback salt so the
+// holdback is independent of variant assignment.
+func (a *Assigner) InHoldback(userID string, percent float64) bool {
+	if percent <= 0 {
+		return false
+	}
+	return a.getBucket(userID, "holdback") < percent/100
+}
+
+// Sampled reports whether a user falls in the percentage (0-100) of traffic
+// that is transformed at all
+func (a *Assigner) Sampled(userID string, percent float64) bool {
+	if percent >= 100 {
+		return true
+	}
+	return a.getBucket(userID, "sample") < percent/100
+}
+
+// SelectExperiment deterministically picks the one experiment in a mutual
+// exclusion group that a user may participate in
+// The pick depends only on the user and group, so it stays stable no
+// matter which of the group's experiments are currently active.
+func (a *Assigner) SelectExperiment(userID, groupID string, experimentIDs []string) string {
+	if len(experimentIDs) == 0 {
+		return ""
+	}
+
+	bucket := a.getBucket(userID, "group:"+groupID)
+	return experimentIDs[int(bucket*float64(len(experimentIDs)))]
+}
+
+// SelectRandomVariant randomly selects a variant, weighted by traffic
+// allocation (including ramps), for users without a stable ID
 func (a *Assigner) SelectRandomVariant(variants []transform.Variant) *transform.Variant {
 	if len(variants) == 0 {
 		return nil
@@ -62,41 +229,69 @@ func (a *Assigner) SelectRandomVariant(variants []transform.Variant) *transform.
 		return &variants[0]
 	}
 
-	// Random selection based on traffic allocation
-	r := rand.Float64()
-	cumulative := 0.0
+	return selectVariant(variants, rand.Float64())
+}
 
-	for i := range variants {
-		cumulative += variants[i].TrafficAllocation
-		if r < cumulative {
-			return &variants[i]
+// normalizeAllocations returns each variant's traffic share, scaled
+// proportionally when the allocations don't sum to 1.0
+// Zero or negative allocations count as zero; if nothing is allocated,
+// traffic is split evenly. The bool reports whether scaling was needed.
+func normalizeAllocations(variants []transform.Variant) ([]float64, bool) {
+	allocations := make([]float64, len(variants))
+	total := 0.0
+	for i, v := range variants {
+		if v.TrafficAllocation > 0 {
+			allocations[i] = v.TrafficAllocation
+			total += v.TrafficAllocation
 		}
 	}
 
-	// Fallback
-	return &variants[0]
+	if math.Abs(total-1.0) <= allocationEpsilon {
+		return allocations, false
+	}
+
+	for i := range allocations {
+		if total > 0 {
+			allocations[i] /= total
+		} else {
+			allocations[i] = 1.0 / float64(len(allocations))
+		}
+	}
+	return allocations, true
 }
 
-// getBucket returns a deterministic bucket (0-99) for the user+experiment
-func (a *Assigner) getBucket(userID, experimentID string) int {
-	// Create HMAC hash
-	h := hmac.New(sha256.New, []byte(a.salt))
-	h.Write([]byte(fmt.Sprintf("%s:%s", userID, experimentID)))
-	hash := hex.EncodeToString(h.Sum(nil))
+// Bucket returns the user's deterministic bucket in [0, 1) for an experiment,
+// the same value AssignVariant compares against cumulative allocations
+func (a *Assigner) Bucket(userID, experimentID string) float64 {
+	key := experimentID
+	if salt := a.experimentSalts[experimentID]; salt != "" {
+		key += ":" + salt
+	}
+	return a.getBucket(userID, key)
+}
 
-	// Take first 8 characters and convert to int
-	hashInt, err := strconv.ParseUint(hash[:8], 16, 64)
-	if err != nil {
-		// Fallback to random if parsing fails
-		return rand.Intn(100)
+// getBucket returns a deterministic bucket in [0, 1) for the user+key, where
+// key is an experiment or another namespace such as "holdback"
+// The top 53 bits of the HMAC are used so every float64 in the range is
+// equally likely, avoiding the rounding and modulo bias of 100 buckets.
+// Anonymous users (empty userID) get a random bucket each time, so they
+// don't all land in the same one.
+func (a *Assigner) getBucket(userID, key string) float64 {
+	if userID == "" {
+		return rand.Float64()
 	}
 
-	// Return bucket 0-99
-	return int(hashInt % 100)
+	// Create HMAC hash
+	h := hmac.New(sha256.New, []byte(a.salt))
+	h.Write([]byte(fmt.Sprintf("%s:%s", userID, key)))
+	sum := h.Sum(nil)
+
+	return float64(binary.BigEndian.Uint64(sum[:8])>>11) / (1 << 53)
 }
 
 // GetUserID generates a user ID from request context
-// Priority: Cookie > IP + User-Agent hash > Random
+// Priority: Cookie > IP + User-Agent hash. Returns "" when there is no
+// identity at all, which the Assigner treats as anonymous.
 func GetUserID(cookieValue, ipAddress, userAgent string) string {
 	if cookieValue != "" {
 		return cookieValue
@@ -109,6 +304,5 @@ func GetUserID(cookieValue, ipAddress, userAgent string) string {
 		return hex.EncodeToString(h.Sum(nil))[:16]
 	}
 
-	// Fallback to random (not ideal but better than nothing)
-	return fmt.Sprintf("anon_%d", rand.Intn(1000000))
+	return ""
 }
@@ -0,0 +1,241 @@
+package variant
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/experiflow/proxy/internal/transform"
+)
+
+// variantsWith returns variants v0, v1, ... with the given allocations
+func variantsWith(allocations ...float64) []transform.Variant {
+	variants := make([]transform.Variant, len(allocations))
+	for i, allocation := range allocations {
+		variants[i] = transform.Variant{ID: fmt.Sprintf("v%d", i), TrafficAllocation: allocation}
+	}
+	return variants
+}
+
+func TestNormalizeAllocations(t *testing.T) {
+	tests := []struct {
+		name           string
+		allocations    []float64
+		want           []float64
+		wantNormalized bool
+	}{
+		{"sums to 1", []float64{0.5, 0.5}, []float64{0.5, 0.5}, false},
+		{"within epsilon", []float64{0.3333, 0.3333, 0.3333}, []float64{0.3333, 0.3333, 0.3333}, false},
+		{"sums over 1", []float64{2, 2}, []float64{0.5, 0.5}, true},
+		{"sums under 1", []float64{0.2, 0.2}, []float64{0.5, 0.5}, true},
+		{"percentages", []float64{25, 75}, []float64{0.25, 0.75}, true},
+		{"all zero", []float64{0, 0, 0, 0}, []float64{0.25, 0.25, 0.25, 0.25}, true},
+		{"negative counts as zero", []float64{-0.5, 1}, []float64{0, 1}, false},
+		{"negative among others", []float64{-1, 0.25, 0.25}, []float64{0, 0.5, 0.5}, true},
+		{"all negative", []float64{-1, -1}, []float64{0.5, 0.5}, true},
+		{"single variant", []float64{0.3}, []float64{1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, normalized := normalizeAllocations(variantsWith(tt.allocations...))
+			if normalized != tt.wantNormalized {
+				t.Errorf("normalized = %v, want %v", normalized, tt.wantNormalized)
+			}
+			for i := range got {
+				if math.Abs(got[i]-tt.want[i]) > 1e-9 {
+					t.Errorf("allocations = %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestPickVariantMalformedAllocations(t *testing.T) {
+	tests := []struct {
+		name        string
+		allocations []float64
+		buckets     map[float64]string // Bucket to expected variant ID
+	}{
+		{"sums over 1", []float64{2, 2}, map[float64]string{0: "v0", 0.49: "v0", 0.5: "v1", 0.999: "v1"}},
+		{"all zero", []float64{0, 0}, map[float64]string{0: "v0", 0.49: "v0", 0.5: "v1", 0.999: "v1"}},
+		{"negative gets no traffic", []float64{-1, 0.5, 0.5}, map[float64]string{0: "v1", 0.49: "v1", 0.5: "v2", 0.999: "v2"}},
+		{"zero gets no traffic", []float64{0.5, 0, 0.5}, map[float64]string{0: "v0", 0.5: "v2", 0.999: "v2"}},
+		{"top of range within epsilon", []float64{0.4995, 0.5, 0}, map[float64]string{0.9997: "v1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			variants := variantsWith(tt.allocations...)
+			for bucket, want := range tt.buckets {
+				if got := pickVariant(variants, bucket); got.ID != want {
+					t.Errorf("bucket %g: got %s, want %s", bucket, got.ID, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAssignVariantMalformedAllocations(t *testing.T) {
+	assigner := NewAssigner("test-salt")
+	tests := []struct {
+		name        string
+		allocations []float64
+		want        []float64 // Expected share of users per variant
+	}{
+		{"sums over 1", []float64{3, 1}, []float64{0.75, 0.25}},
+		{"all zero", []float64{0, 0}, []float64{0.5, 0.5}},
+		{"negative", []float64{-1, 1, 1}, []float64{0, 0.5, 0.5}},
+		{"single zero variant", []float64{0}, []float64{1}},
+		{"single negative variant", []float64{-1}, []float64{1}},
+	}
+	const users = 10000
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			variants := variantsWith(tt.allocations...)
+			counts := make(map[string]int)
+			for i := 0; i < users; i++ {
+				assigned := assigner.AssignVariant(fmt.Sprintf("user-%d", i), "exp", variants)
+				if assigned == nil {
+					t.Fatal("no variant assigned")
+				}
+				counts[assigned.ID]++
+			}
+			for i, want := range tt.want {
+				got := float64(counts[variants[i].ID]) / users
+				if math.Abs(got-want) > 0.03 {
+					t.Errorf("%s got %.3f of users, want %.2f", variants[i].ID, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateVariantsAllocations(t *testing.T) {
+	tests := []struct {
+		name        string
+		allocations []float64
+		want        int
+	}{
+		{"valid", []float64{0.5, 0.5}, 0},
+		{"sums over 1", []float64{2, 2}, 0},
+		{"all zero", []float64{0, 0}, 0},
+		{"one negative", []float64{-0.5, 1}, 1},
+		{"two negative", []float64{-0.5, -0.5, 1}, 2},
+		{"single variant", []float64{1}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if problems := ValidateVariants(variantsWith(tt.allocations...)); len(problems) != tt.want {
+				t.Errorf("got problems %v, want %d", problems, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizesAllocations(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	ramped := transform.Variant{ID: "ramped", Ramp: &transform.Ramp{TargetPercent: 25, StartTime: past, EndTime: past}}
+	tests := []struct {
+		name     string
+		variants []transform.Variant
+		want     bool
+	}{
+		{"valid", variantsWith(0.5, 0.5), false},
+		{"sums under 1", variantsWith(0.4, 0.4), true},
+		{"single variant", variantsWith(0.3), false},
+		{"valid beside a ramp", append(variantsWith(0.5, 0.5), ramped), false},
+		{"sums over 1 beside a ramp", append(variantsWith(1, 1), ramped), true},
+		{"lone control beside a ramp", append(variantsWith(0), ramped), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NormalizesAllocations(tt.variants); got != tt.want {
+				t.Errorf("NormalizesAllocations = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRampShareBoundaries(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(10 * time.Hour)
+	ramp := &transform.Ramp{StartPercent: 10, TargetPercent: 50, StartTime: start, EndTime: end}
+	tests := []struct {
+		name string
+		ramp *transform.Ramp
+		now  time.Time
+		want float64
+	}{
+		{"before start", ramp, start.Add(-time.Nanosecond), 0.1},
+		{"at start", ramp, start, 0.1},
+		{"midway", ramp, start.Add(5 * time.Hour), 0.3},
+		{"just before end", ramp, end.Add(-time.Nanosecond), 0.5},
+		{"at end", ramp, end, 0.5},
+		{"after end", ramp, end.Add(time.Hour), 0.5},
+		{"zero length before", &transform.Ramp{StartPercent: 0, TargetPercent: 100, StartTime: start, EndTime: start}, start.Add(-time.Second), 0},
+		{"zero length at", &transform.Ramp{StartPercent: 0, TargetPercent: 100, StartTime: start, EndTime: start}, start, 1},
+		{"ramping down", &transform.Ramp{StartPercent: 100, TargetPercent: 0, StartTime: start, EndTime: end}, start.Add(5 * time.Hour), 0.5},
+		{"above 100%", &transform.Ramp{TargetPercent: 150, StartTime: start, EndTime: start}, end, 1},
+		{"below 0%", &transform.Ramp{TargetPercent: -10, StartTime: start, EndTime: start}, end, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rampShare(tt.ramp, tt.now); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("rampShare = %g, want %g", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectVariantRampSteps(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name    string
+		percent float64
+		buckets map[float64]string // Bucket to expected variant ID
+	}{
+		{"0%", 0, map[float64]string{0: "v0", 0.49: "v0", 0.5: "v1", 0.999: "v1"}},
+		{"100%", 100, map[float64]string{0: "ramped", 0.5: "ramped", 0.999: "ramped"}},
+		{"25%", 25, map[float64]string{0: "v0", 0.499: "v0", 0.5: "v1", 0.749: "v1", 0.75: "ramped", 0.999: "ramped"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			variants := append(variantsWith(0.5, 0.5), transform.Variant{
+				ID:   "ramped",
+				Ramp: &transform.Ramp{TargetPercent: tt.percent, StartTime: past, EndTime: past},
+			})
+			for bucket, want := range tt.buckets {
+				if got := selectVariant(variants, bucket); got.ID != want {
+					t.Errorf("bucket %g: got %s, want %s", bucket, got.ID, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSelectVariantRampKeepsStaticArms(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	variantsAt := func(percent float64) []transform.Variant {
+		return append(variantsWith(0.5, 0.5), transform.Variant{
+			ID:   "ramped",
+			Ramp: &transform.Ramp{TargetPercent: percent, StartTime: past, EndTime: past},
+		})
+	}
+
+	for bucket := 0.0; bucket < 1; bucket += 0.01 {
+		before := selectVariant(variantsAt(0), bucket)
+		wasRamped := false
+		for _, percent := range []float64{5, 25, 50, 75, 100} {
+			got := selectVariant(variantsAt(percent), bucket)
+			switch {
+			case got.ID == "ramped":
+				wasRamped = true
+			case wasRamped:
+				t.Errorf("bucket %g at %g%%: left the ramp for %s", bucket, percent, got.ID)
+			case got.ID != before.ID:
+				t.Errorf("bucket %g at %g%%: moved from %s to %s", bucket, percent, before.ID, got.ID)
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package variant
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Store persists variant assignments by user and experiment, so they stick
+// across proxy instances and for clients that don't keep cookies
+// Entries written by other tools act as manual overrides.
+type Store interface {
+	// Get returns the stored assignment, or false when there is none
+	Get(ctx context.Context, userID, experimentID string) (StoredAssignment, bool, error)
+	// Set stores an assignment, replacing any existing one
+	Set(ctx context.Context, userID, experimentID string, assignment StoredAssignment) error
+}
+
+// StoredAssignment is a variant assignment kept in a Store
+type StoredAssignment struct {
+	VariantID  string `json:"variant_id"`
+	VariantKey string `json:"variant_key,omitempty"`
+}
+
+// redisKeyPrefix namespaces assignment keys in a shared Redis
+const redisKeyPrefix = "experiflow:assignment:"
+
+// RedisStore is a Store backed by Redis
+type RedisStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// NewRedisStore connects to the Redis server at rawURL, e.g.
+// redis://:password@host:6379/0, keeping assignments for ttl
+// Connections are made lazily, so an unreachable server isn't an error here.
+func NewRedisStore(rawURL string, ttl time.Duration) (*RedisStore, error) {
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse redis URL: %w", err)
+	}
+	// Honor the caller's deadline so a slow store can't stall responses
+	opts.ContextTimeoutEnabled = true
+	return &RedisStore{client: redis.NewClient(opts), ttl: ttl}, nil
+}
+
+// Get returns the assignment stored for a user and experiment
+func (s *RedisStore) Get(ctx context.Context, userID, experimentID string) (StoredAssignment, bool, error) {
+	value, err := s.client.Get(ctx, redisKey(userID, experimentID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return StoredAssignment{}, false, nil
+	}
+	if err != nil {
+		return StoredAssignment{}, false, fmt.Errorf("get assignment: %w", err)
+	}
+
+	var assignment StoredAssignment
+	if err := json.Unmarshal(value, &assignment); err != nil || assignment.VariantID == "" {
+		return StoredAssignment{}, false, fmt.Errorf("decode assignment: invalid value %q", value)
+	}
+	return assignment, true, nil
+}
+
+// Set stores an assignment for a user and experiment
+func (s *RedisStore) Set(ctx context.Context, userID, experimentID string, assignment StoredAssignment) error {
+	value, err := json.Marshal(assignment)
+	if err != nil {
+		return fmt.Errorf("encode assignment: %w", err)
+	}
+	if err := s.client.Set(ctx, redisKey(userID, experimentID), value, s.ttl).Err(); err != nil {
+		return fmt.Errorf("set assignment: %w", err)
+	}
+	return nil
+}
+
+// Close releases the store's connections
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
+
+// redisKey returns the key an assignment is stored under
+func redisKey(userID, experimentID string) string {
+	return redisKeyPrefix + experimentID + ":" + userID
+}